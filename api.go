@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// MaxNoteLength is the maximum length, in characters, of an attempt note.
+const MaxNoteLength = 280
+
+// Handler returns the HTTP handler for the session API.
+func (s *Session) Handler() http.Handler {
+	r := mux.NewRouter()
+	r.HandleFunc("/healthz", s.handleHealthz).Methods("GET")
+	r.HandleFunc("/status", s.handleStatus).Methods("GET")
+	r.HandleFunc("/replicas", s.handleReplicas).Methods("GET")
+	r.HandleFunc("/events", s.handleEvents).Methods("GET")
+	r.Handle("/proxy/resync", s.requireToken(http.HandlerFunc(s.handleResync))).Methods("POST")
+	// /api/reset and /api/switch, with the bare paths kept as aliases
+	for _, prefix := range []string{"/api", ""} {
+		r.Handle(prefix+"/reset", s.requireToken(http.HandlerFunc(s.handleReset))).Methods("POST")
+		r.Handle(prefix+"/switch", s.requireToken(http.HandlerFunc(s.handleSwitch))).Methods("POST")
+	}
+	r.HandleFunc("/attempt", s.handleAttemptNumber).Methods("GET")
+	r.Handle("/attempt", s.requireToken(http.HandlerFunc(s.handleSetAttemptNumber))).Methods("PUT")
+	r.HandleFunc("/attempt/{n:[0-9]+}", s.handleAttempt).Methods("GET")
+	r.Handle("/attempt/{n:[0-9]+}/note", s.requireToken(http.HandlerFunc(s.handleNote))).Methods("POST")
+	r.HandleFunc("/history", s.handleHistory).Methods("GET")
+	r.HandleFunc("/patterns", s.handlePatterns).Methods("GET")
+	r.Handle("/patterns", s.requireToken(http.HandlerFunc(s.handleSetPatterns))).Methods("PUT")
+	r.HandleFunc("/debug/stats", s.handleDebugStats).Methods("GET")
+	if s.Pprof {
+		registerPprof(r)
+	}
+	return r
+}
+
+// API serves the session API on APIAddr until the context is cancelled.
+func (s *Session) API(ctx context.Context) {
+	srv := &http.Server{
+		Addr:    s.APIAddr,
+		Handler: s.Handler(),
+	}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	log.Printf("[api] listening on %s", s.APIAddr)
+	err := srv.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		log.Printf("[api] error serving: %s", err)
+	}
+}
+
+// requireToken rejects requests without the API token as a bearer token. If
+// no token is configured, the wrapped handler is disabled.
+func (s *Session) requireToken(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.APIToken == "" {
+			http.Error(w, "no API token configured", http.StatusForbidden)
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.APIToken)) != 1 {
+			http.Error(w, "invalid API token", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// handleHealthz reports that the API is up, along with the replicas'
+// resource reservation if it is known.
+func (s *Session) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, struct {
+		Status      string       `json:"status"`
+		Reservation *Reservation `json:"reservation,omitempty"`
+	}{"ok", s.reservation})
+}
+
+// handleStatus returns the current state machine status.
+func (s *Session) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.Status())
+}
+
+// handleReplicas returns the state of every replica.
+func (s *Session) handleReplicas(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.Replicas())
+}
+
+// handleResync has the session loop re-send the active replica's address to
+// the proxy, so it re-targets the active world if the two have drifted apart.
+// Going through the loop keeps it in order with switches.
+func (s *Session) handleResync(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	active := s.active
+	s.mu.RUnlock()
+	if active == nil {
+		http.Error(w, "no active replica", http.StatusConflict)
+		return
+	}
+	s.inject(w, r, Event{GameID: active.ID, Type: "cmd.resync", Payload: "api"})
+}
+
+// handleReset resets the active replica, as if the runner had typed the
+// reset command in chat.
+func (s *Session) handleReset(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	active := s.active
+	s.mu.RUnlock()
+	if active == nil {
+		http.Error(w, "no active replica", http.StatusConflict)
+		return
+	}
+	s.inject(w, r, Event{GameID: active.ID, Type: "cmd.reset", Payload: "api"})
+}
+
+// handleSwitch makes the replica given by ?id= active. Replicas can only be
+// switched to between runs, once their world is ready.
+func (s *Session) handleSwitch(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "invalid replica id", http.StatusBadRequest)
+		return
+	}
+	s.mu.RLock()
+	replica, ok := s.replicas[id]
+	ready := ok && replica.Ready
+	state := s.state
+	s.mu.RUnlock()
+	switch {
+	case !ok:
+		http.Error(w, "unknown replica", http.StatusNotFound)
+		return
+	case !ready:
+		http.Error(w, "replica is not ready", http.StatusConflict)
+		return
+	case state != "":
+		http.Error(w, "a run is in progress", http.StatusConflict)
+		return
+	}
+	s.inject(w, r, Event{GameID: id, Type: "cmd.switch", Payload: "api"})
+}
+
+// inject passes evt to the session loop, which handles it like any event
+// from a game, and reports it as accepted.
+func (s *Session) inject(w http.ResponseWriter, r *http.Request, evt Event) {
+	evt.Timestamp = time.Now()
+	select {
+	case s.Events <- evt:
+		log.Printf("[api] sent '%s' to %d", evt.Type, evt.GameID)
+		writeJSON(w, http.StatusAccepted, map[string]int{"game_id": evt.GameID})
+	case <-r.Context().Done():
+	}
+}
+
+// handleAttemptNumber returns the attempt counter.
+func (s *Session) handleAttemptNumber(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	attempt := s.Data.Attempt
+	s.mu.RUnlock()
+	writeJSON(w, http.StatusOK, map[string]int{"attempt": attempt})
+}
+
+// handleSetAttemptNumber corrects the attempt counter ({"attempt": n}).
+func (s *Session) handleSetAttemptNumber(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Attempt *int `json:"attempt"`
+	}
+	err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req)
+	if err != nil || req.Attempt == nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if *req.Attempt < 0 {
+		http.Error(w, "attempt must not be negative", http.StatusBadRequest)
+		return
+	}
+	err = s.SetAttempt(*req.Attempt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("[api] set attempt counter to %d", *req.Attempt)
+	writeJSON(w, http.StatusOK, map[string]int{"attempt": *req.Attempt})
+}
+
+// handleAttempt returns the full timeline of an attempt along with its note.
+func (s *Session) handleAttempt(w http.ResponseWriter, r *http.Request) {
+	n, err := strconv.Atoi(mux.Vars(r)["n"])
+	if err != nil {
+		http.Error(w, "invalid attempt", http.StatusBadRequest)
+		return
+	}
+	attempt, ok := s.Attempt(n)
+	if !ok {
+		http.Error(w, "unknown attempt", http.StatusNotFound)
+		return
+	}
+
+	s.mu.RLock()
+	note := s.Data.Notes[n]
+	s.mu.RUnlock()
+	writeJSON(w, http.StatusOK, struct {
+		Attempt
+		Note string `json:"note,omitempty"`
+	}{attempt, note})
+}
+
+// handleHistory exports every finished attempt and its note, as JSON or,
+// with ?format=csv, as CSV.
+func (s *Session) handleHistory(w http.ResponseWriter, r *http.Request) {
+	history, notes := s.History(), s.Notes()
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+		writeJSON(w, http.StatusOK, historyRows(history, notes))
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="history.csv"`)
+		err := writeHistoryCSV(w, history, notes)
+		if err != nil {
+			log.Printf("[api] error writing history: %s", err)
+		}
+	default:
+		http.Error(w, "unknown format", http.StatusBadRequest)
+	}
+}
+
+// handleNote stores a free-text note ({"note": "..."}) against an attempt.
+func (s *Session) handleNote(w http.ResponseWriter, r *http.Request) {
+	n, err := strconv.Atoi(mux.Vars(r)["n"])
+	if err != nil {
+		http.Error(w, "invalid attempt", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Note string `json:"note"`
+	}
+	err = json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req)
+	if err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	note := sanitizeNote(req.Note)
+	if utf8.RuneCountInString(note) > MaxNoteLength {
+		http.Error(w, fmt.Sprintf("note exceeds %d characters", MaxNoteLength), http.StatusBadRequest)
+		return
+	}
+
+	err = s.SetNote(n, note)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"attempt": n, "note": note})
+}
+
+// handlePatterns returns the milestones and custom events currently matched
+// against log messages.
+func (s *Session) handlePatterns(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.Patterns.Get())
+}
+
+// handleSetPatterns replaces the milestones and custom events matched against
+// log messages. The update is applied only if every pattern is valid.
+func (s *Session) handleSetPatterns(w http.ResponseWriter, r *http.Request) {
+	var patterns Patterns
+	dec := json.NewDecoder(io.LimitReader(r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&patterns)
+	if err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	err = patterns.Validate()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.Patterns.Set(patterns)
+	log.Printf("[api] updated patterns: %d milestones, %d events", len(patterns.Milestones), len(patterns.Events))
+	writeJSON(w, http.StatusOK, patterns)
+}
+
+// sanitizeNote strips control characters and surrounding whitespace.
+func sanitizeNote(note string) string {
+	note = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, note)
+	return strings.TrimSpace(note)
+}
+
+// handleEvents streams events to the client as server-sent events until the
+// client disconnects.
+func (s *Session) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	events := s.Stream.Subscribe()
+	defer s.Stream.Unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case evt, ok := <-events:
+			if !ok {
+				// evicted for falling behind
+				fmt.Fprintf(w, "event: error\ndata: too slow\n\n")
+				flusher.Flush()
+				return
+			}
+			buf, _ := json.Marshal(evt)
+			_, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", evt.Type, buf)
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// writeJSON encodes v as the JSON response body.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Printf("[api] error writing response: %s", err)
+	}
+}
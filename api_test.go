@@ -0,0 +1,414 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// request sends a request to the session's API and returns the recorded
+// response.
+func request(s *Session, method, path, body, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, req)
+	return w
+}
+
+func TestHandleResync(t *testing.T) {
+	s, _ := newTestSession(t, 2)
+	s.APIToken = "secret"
+	s.replicas[0].Addr = "10.0.0.1"
+	s.replicas[1].Addr = "10.0.0.2"
+	proxied := runLoop(t, s)
+	// waits for the proxy to have been sent want last, and returns the last
+	// address it was sent
+	sentTo := func(want string) string {
+		t.Helper()
+		var got []string
+		for i := 0; i < 100; i++ {
+			got = proxied()
+			if len(got) > 0 && got[len(got)-1] == want {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if len(got) == 0 {
+			return ""
+		}
+		return got[len(got)-1]
+	}
+
+	send(t, s)
+	w := request(s, "POST", "/proxy/resync", "", "")
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("resync without a token: %d %s", w.Code, w.Body)
+	}
+	w = request(s, "POST", "/proxy/resync", "", "secret")
+	if w.Code != http.StatusConflict {
+		t.Errorf("resync without an active replica: %d %s", w.Code, w.Body)
+	}
+
+	ready0, ready1 := ready(0), ready(1)
+	ready0.Payload, ready1.Payload = "10.0.0.1", "10.0.0.2"
+	send(t, s, ready0, ready1)
+	sentTo("10.0.0.1")
+	n := len(proxied())
+	w = request(s, "POST", "/proxy/resync", "", "secret")
+	if w.Code != http.StatusAccepted {
+		t.Errorf("resync: %d %s", w.Code, w.Body)
+	}
+	send(t, s)
+	for i := 0; i < 100 && len(proxied()) == n; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := proxied(); len(got) != n+1 || got[n] != "10.0.0.1" {
+		t.Errorf("proxy was sent %q, want 10.0.0.1 once more", got)
+	}
+
+	// a resync racing a switch never leaves the proxy on the old replica
+	for i := 1; i <= 10; i++ {
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			request(s, "POST", "/proxy/resync", "", "secret")
+		}()
+		request(s, "POST", fmt.Sprintf("/switch?id=%d", i%2), "", "secret")
+		wg.Wait()
+		send(t, s)
+		want := fmt.Sprintf("10.0.0.%d", i%2+1)
+		if addr := sentTo(want); addr != want {
+			t.Errorf("after switch %d: proxy on %s, want %s", i, addr, want)
+		}
+	}
+}
+
+func TestHandleNote(t *testing.T) {
+	s, _ := newTestSession(t, 1)
+	s.Data.Attempt = 2
+	s.APIToken = "secret"
+
+	tests := []struct {
+		name   string
+		path   string
+		body   string
+		token  string
+		status int
+		note   string
+	}{
+		{"note", "/attempt/1/note", `{"note": " bad spawn\n"}`, "secret", http.StatusOK, "bad spawn"},
+		{"control characters", "/attempt/1/note", `{"note": "good\u0007 bastion"}`, "secret", http.StatusOK, "good bastion"},
+		{"too long", "/attempt/1/note", `{"note": "` + strings.Repeat("a", MaxNoteLength+1) + `"}`, "secret", http.StatusBadRequest, "good bastion"},
+		{"invalid body", "/attempt/1/note", `note`, "secret", http.StatusBadRequest, "good bastion"},
+		{"unknown attempt", "/attempt/3/note", `{"note": "later"}`, "secret", http.StatusNotFound, "good bastion"},
+		{"no token", "/attempt/1/note", `{"note": "vandalised"}`, "", http.StatusUnauthorized, "good bastion"},
+		{"wrong token", "/attempt/1/note", `{"note": "vandalised"}`, "guess", http.StatusUnauthorized, "good bastion"},
+		{"cleared", "/attempt/1/note", `{"note": ""}`, "secret", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		w := request(s, "POST", tt.path, tt.body, tt.token)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.status, w.Body)
+		}
+		s.mu.RLock()
+		note := s.Data.Notes[1]
+		s.mu.RUnlock()
+		if note != tt.note {
+			t.Errorf("%s: note %q, want %q", tt.name, note, tt.note)
+		}
+	}
+}
+
+func TestHandleAttempt(t *testing.T) {
+	s, _ := newTestSession(t, 2)
+	runLoop(t, s)
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	send(t, s,
+		ready(0), ready(1),
+		Event{GameID: 0, Timestamp: start, Type: "login", Payload: "alice joined the game"},
+		Event{GameID: 0, Timestamp: start.Add(30 * time.Second), Type: "custom.trade", Payload: "12 pearls"},
+		// the other replica's lifecycle is left out of the timeline
+		Event{GameID: 1, Timestamp: start.Add(40 * time.Second), Type: "crash"},
+		Event{GameID: 1, Timestamp: start.Add(45 * time.Second), Type: "started", Payload: "seed=123"},
+		Event{GameID: 1, Timestamp: start.Add(50 * time.Second), Type: "generated"},
+		Event{GameID: 0, Timestamp: start.Add(time.Minute), Type: "nether"},
+		Event{GameID: 0, Timestamp: start.Add(2 * time.Minute), Type: "cmd.reset"},
+	)
+	err := s.SetNote(0, "good bastion")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := request(s, "GET", "/attempt/0", "", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var attempt struct {
+		Attempt
+		Note string `json:"note"`
+	}
+	err = json.Unmarshal(w.Body.Bytes(), &attempt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []string
+	for _, evt := range attempt.Events {
+		events = append(events, fmt.Sprintf("%s@%s %s", evt.Type, evt.Time, evt.Payload))
+	}
+	want := "[login@0s alice joined the game custom.trade@30s 12 pearls nether@1m0s  cmd.reset@2m0s ]"
+	if fmt.Sprint(events) != want {
+		t.Errorf("events %q, want %s", events, want)
+	}
+	if len(attempt.Splits) != 1 || attempt.Splits[0].Name != "Nether" {
+		t.Errorf("splits %+v, want the nether", attempt.Splits)
+	}
+	if attempt.Result != "nether" || attempt.Note != "good bastion" {
+		t.Errorf("result %q, note %q", attempt.Result, attempt.Note)
+	}
+
+	if w := request(s, "GET", "/attempt/1", "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("unknown attempt: status %d", w.Code)
+	}
+}
+
+func TestHandleHistory(t *testing.T) {
+	s, _ := newTestSession(t, 2)
+	runLoop(t, s)
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	send(t, s,
+		ready(0), ready(1),
+		Event{GameID: 0, Timestamp: start, Type: "login"},
+		Event{GameID: 0, Timestamp: start.Add(90 * time.Second), Type: "nether"},
+		Event{GameID: 0, Timestamp: start.Add(2 * time.Minute), Type: "cmd.reset"},
+		Event{GameID: 1, Timestamp: start.Add(3 * time.Minute), Type: "login"},
+		Event{GameID: 1, Timestamp: start.Add(4 * time.Minute), Type: "cmd.reset"},
+	)
+	err := s.SetNote(0, "slow, nether")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := request(s, "GET", "/history", "", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var rows []HistoryRow
+	err = json.Unmarshal(w.Body.Bytes(), &rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || rows[0].Splits["Nether"] != 90 || len(rows[1].Splits) != 0 {
+		t.Errorf("rows %+v, want a nether split then a reset", rows)
+	}
+	if len(rows) == 2 && (rows[0].Note != "slow, nether" || rows[1].Note != "") {
+		t.Errorf("notes %q, %q, want the first attempt's", rows[0].Note, rows[1].Note)
+	}
+
+	w = request(s, "GET", "/history?format=csv", "", "")
+	want := "attempt,seed,start,result,note,Nether\n" +
+		"0,,2020-01-01T12:00:00Z,nether,\"slow, nether\",90.000\n" +
+		"1,,2020-01-01T12:03:00Z,overworld,,\n"
+	if w.Code != http.StatusOK || w.Body.String() != want {
+		t.Errorf("status %d, csv:\n%s\nwant:\n%s", w.Code, w.Body, want)
+	}
+
+	if w := request(s, "GET", "/history?format=xml", "", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown format: status %d", w.Code)
+	}
+}
+
+func TestHandleSetPatterns(t *testing.T) {
+	s, _ := newTestSession(t, 1)
+	valid := `{"milestones": [{"name": "fire", "match": "[Into Fire]"}], "events": [{"name": "blind", "pattern": "blind (\\S+)"}], "ignore": ["^Can't keep up"]}`
+
+	tests := []struct {
+		name     string
+		apiToken string
+		token    string
+		body     string
+		status   int
+		updated  bool
+	}{
+		{"no API token", "", "", valid, http.StatusForbidden, false},
+		{"missing token", "secret", "", valid, http.StatusUnauthorized, false},
+		{"wrong token", "secret", "guess", valid, http.StatusUnauthorized, false},
+		{"unknown field", "secret", "secret", `{"milestone": []}`, http.StatusBadRequest, false},
+		{"bad regexp", "secret", "secret", `{"events": [{"name": "blind", "pattern": "("}]}`, http.StatusBadRequest, false},
+		{"state milestone", "secret", "secret", `{"milestones": [{"name": "nether", "match": "x"}]}`, http.StatusBadRequest, false},
+		{"empty ignore", "secret", "secret", `{"ignore": [""]}`, http.StatusBadRequest, false},
+		{"valid", "secret", "secret", valid, http.StatusOK, true},
+	}
+	for _, tt := range tests {
+		s.APIToken = tt.apiToken
+		w := request(s, "PUT", "/patterns", tt.body, tt.token)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.status, w.Body)
+		}
+
+		var patterns Patterns
+		err := json.Unmarshal(request(s, "GET", "/patterns", "", "").Body.Bytes(), &patterns)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if updated := len(patterns.Events) == 1; updated != tt.updated {
+			t.Errorf("%s: updated %t, want %t", tt.name, updated, tt.updated)
+		}
+	}
+
+	// the new patterns are matched
+	patterns := s.Patterns.Get()
+	if payload, ok := patterns.Events[0].Match("blind 0,80,0"); !ok || payload != "0,80,0" {
+		t.Errorf("custom event matched %q, %t", payload, ok)
+	}
+	if !patterns.Ignored("Can't keep up! Is the server overloaded?") {
+		t.Errorf("ignore pattern isn't applied")
+	}
+}
+
+func TestHandleSetAttemptNumber(t *testing.T) {
+	s, _ := newTestSession(t, 1)
+	s.APIToken = "secret"
+
+	tests := []struct {
+		name    string
+		body    string
+		token   string
+		status  int
+		attempt int
+	}{
+		{"set", `{"attempt": 12}`, "secret", http.StatusOK, 12},
+		{"zero", `{"attempt": 0}`, "secret", http.StatusOK, 0},
+		{"negative", `{"attempt": -1}`, "secret", http.StatusBadRequest, 0},
+		{"missing", `{}`, "secret", http.StatusBadRequest, 0},
+		{"no token", `{"attempt": 5}`, "", http.StatusUnauthorized, 0},
+		{"again", `{"attempt": 42}`, "secret", http.StatusOK, 42},
+	}
+	for _, tt := range tests {
+		w := request(s, "PUT", "/attempt", tt.body, tt.token)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.status, w.Body)
+		}
+		var got struct{ Attempt int }
+		err := json.Unmarshal(request(s, "GET", "/attempt", "", "").Body.Bytes(), &got)
+		if err != nil || got.Attempt != tt.attempt {
+			t.Errorf("%s: attempt %d, %v, want %d", tt.name, got.Attempt, err, tt.attempt)
+		}
+	}
+
+	// the counter is saved straight away
+	data, err := ioutil.ReadFile(StateFile)
+	if err != nil || !strings.Contains(string(data), `"attempt":42`) {
+		t.Errorf("%s: %s, %v, want attempt 42", StateFile, data, err)
+	}
+}
+
+func TestHandleResetAndSwitch(t *testing.T) {
+	s, cli := newTestSession(t, 3)
+	s.APIToken = "secret"
+	runLoop(t, s)
+
+	w := request(s, "POST", "/api/reset", "", "secret")
+	if w.Code != http.StatusConflict {
+		t.Errorf("reset without an active replica: %d %s", w.Code, w.Body)
+	}
+	send(t, s, ready(0), ready(1))
+
+	tests := []struct {
+		name   string
+		path   string
+		token  string
+		status int
+		active int
+	}{
+		{"no token", "/api/switch?id=1", "", http.StatusUnauthorized, 0},
+		{"invalid id", "/api/switch?id=x", "secret", http.StatusBadRequest, 0},
+		{"unknown", "/api/switch?id=5", "secret", http.StatusNotFound, 0},
+		{"not ready", "/api/switch?id=2", "secret", http.StatusConflict, 0},
+		{"switch", "/api/switch?id=1", "secret", http.StatusAccepted, 1},
+		{"reset", "/api/reset", "secret", http.StatusAccepted, 0},
+		// the bare paths are aliases
+		{"switch alias", "/switch?id=2", "secret", http.StatusConflict, 0},
+		{"reset alias", "/reset", "", http.StatusUnauthorized, 0},
+	}
+	for _, tt := range tests {
+		w := request(s, "POST", tt.path, "", tt.token)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.status, w.Body)
+		}
+		send(t, s)
+		if active := s.Status().Active; active != tt.active {
+			t.Errorf("%s: active %d, want %d", tt.name, active, tt.active)
+		}
+	}
+	if st := s.Status(); st.Attempt != 1 {
+		t.Errorf("attempt %d after reset, want 1", st.Attempt)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(cli.Killed()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if killed := cli.Killed(); len(killed) != 1 || killed[0] != "mcspeedrun_1" {
+		t.Errorf("killed %q, want [mcspeedrun_1]", killed)
+	}
+
+	// switching is refused once a run has started
+	send(t, s, ready(1), Event{GameID: 0, Timestamp: time.Now(), Type: "login", Payload: "alice joined the game"})
+	w = request(s, "POST", "/api/switch?id=1", "", "secret")
+	if w.Code != http.StatusConflict {
+		t.Errorf("switch during a run: %d %s", w.Code, w.Body)
+	}
+}
+
+// TestHandleReplicasConcurrent polls /replicas while Loop marks replicas
+// ready, switches and resets them, for -race.
+func TestHandleReplicasConcurrent(t *testing.T) {
+	s, _ := newTestSession(t, 3)
+	runLoop(t, s)
+
+	stop := poll(func() {
+		w := request(s, "GET", "/replicas", "", "")
+		var replicas []ReplicaStatus
+		err := json.Unmarshal(w.Body.Bytes(), &replicas)
+		if err != nil {
+			t.Errorf("decoding %s: %s", w.Body, err)
+			return
+		}
+		active := 0
+		for i, replica := range replicas {
+			if replica.ID != i {
+				t.Errorf("replica %d at index %d", replica.ID, i)
+			}
+			if replica.Active {
+				active++
+			}
+		}
+		if len(replicas) != 3 || active > 1 {
+			t.Errorf("%d replicas with %d active, want 3 with at most 1", len(replicas), active)
+		}
+	})
+	for i := 0; i < 5; i++ {
+		now := time.Now()
+		send(t, s,
+			ready(0), ready(1), ready(2),
+			Event{GameID: 2, Timestamp: now, Type: "crash"},
+			Event{GameID: 1, Timestamp: now, Type: "cmd.switch"},
+			Event{GameID: 1, Timestamp: now, Type: "cmd.reset"},
+		)
+	}
+	stop()
+
+	replicas := s.Replicas()
+	if replicas[1].Ready || replicas[2].Ready {
+		t.Errorf("replicas %+v, want 1 and 2 not ready", replicas)
+	}
+}
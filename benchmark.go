@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"time"
+)
+
+// Benchmark launches every replica, waits for each to generate its world and
+// returns the generation times. The containers are removed before returning.
+// It bypasses Loop() and the proxy entirely.
+func (s *Session) Benchmark(ctx context.Context) []time.Duration {
+	runCtx, cancel := context.WithCancel(ctx)
+	s.configureReplicas()
+	for _, replica := range s.replicas {
+		go replica.Launch(runCtx)
+		go replica.Monitor(runCtx)
+	}
+
+	started := make(map[int]time.Time)
+	times := make(map[int]time.Duration)
+	for len(times) < len(s.replicas) {
+		var evt Event
+		select {
+		case <-ctx.Done():
+			log.Printf("[bench] interrupted")
+		case evt = <-s.Events:
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		switch evt.Type {
+		case "started":
+			started[evt.GameID] = time.Now()
+		case "generated":
+			start, ok := started[evt.GameID]
+			if _, done := times[evt.GameID]; done || !ok {
+				continue
+			}
+			times[evt.GameID] = time.Since(start)
+			log.Printf("[bench] server %d generated in %s", evt.GameID, times[evt.GameID])
+		}
+	}
+	cancel()
+
+	// the session context may be cancelled, so clean up with a fresh one
+	cleanupCtx, cleanupCancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cleanupCancel()
+	for _, replica := range s.replicas {
+		err := replica.Reset(cleanupCtx)
+		if err != nil {
+			log.Printf("[%s] error removing container: %s", replica.Name, err)
+		}
+	}
+
+	durations := make([]time.Duration, 0, len(times))
+	for _, d := range times {
+		durations = append(durations, d)
+	}
+	return durations
+}
+
+// PrintBenchmark prints min/max/avg/p95 statistics for generation times.
+func PrintBenchmark(durations []time.Duration) {
+	if len(durations) == 0 {
+		fmt.Println("no worlds generated")
+		return
+	}
+	sort.Slice(durations, func(i, j int) bool {
+		return durations[i] < durations[j]
+	})
+
+	var total time.Duration
+	for _, d := range durations {
+		total += d
+	}
+	p95 := durations[int(math.Ceil(0.95*float64(len(durations))))-1]
+
+	fmt.Printf("worlds: %d\n", len(durations))
+	fmt.Printf("min:    %s\n", durations[0].Round(time.Millisecond))
+	fmt.Printf("max:    %s\n", durations[len(durations)-1].Round(time.Millisecond))
+	fmt.Printf("avg:    %s\n", (total / time.Duration(len(durations))).Round(time.Millisecond))
+	fmt.Printf("p95:    %s\n", p95.Round(time.Millisecond))
+}
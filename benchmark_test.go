@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// stdout returns what f prints to the standard output.
+func stdout(t *testing.T, f func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = orig }()
+	f()
+	w.Close()
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestPrintBenchmark(t *testing.T) {
+	var twenty []time.Duration
+	for i := 20; i > 0; i-- {
+		twenty = append(twenty, time.Duration(i)*time.Second)
+	}
+	tests := []struct {
+		name      string
+		durations []time.Duration
+		out       string
+	}{
+		{"none", nil, "no worlds generated\n"},
+		{"one", []time.Duration{1500 * time.Millisecond},
+			"worlds: 1\nmin:    1.5s\nmax:    1.5s\navg:    1.5s\np95:    1.5s\n"},
+		{"twenty", twenty,
+			"worlds: 20\nmin:    1s\nmax:    20s\navg:    10.5s\np95:    19s\n"},
+	}
+	for _, tt := range tests {
+		out := stdout(t, func() { PrintBenchmark(tt.durations) })
+		if out != tt.out {
+			t.Errorf("%s: printed\n%s\nwant\n%s", tt.name, out, tt.out)
+		}
+	}
+}
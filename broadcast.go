@@ -0,0 +1,55 @@
+package main
+
+import (
+	"sync"
+)
+
+// subscriberBuffer is how many events a subscriber may fall behind before it
+// is evicted.
+const subscriberBuffer = 64
+
+// Broadcaster fans events out to every subscriber of the event stream. Each
+// subscriber has its own buffered channel, and the producer never blocks: a
+// subscriber whose buffer is full is evicted and its channel closed.
+type Broadcaster struct {
+	mu   sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+// Subscribe registers a new subscriber and returns its event channel. The
+// channel is closed if the subscriber is evicted for falling behind.
+func (b *Broadcaster) Subscribe() chan Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subs == nil {
+		b.subs = make(map[chan Event]struct{})
+	}
+	ch := make(chan Event, subscriberBuffer)
+	b.subs[ch] = struct{}{}
+	return ch
+}
+
+// Unsubscribe removes a subscriber registered with Subscribe.
+func (b *Broadcaster) Unsubscribe(ch chan Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subs, ch)
+}
+
+// Publish sends an event to every subscriber without blocking, and returns
+// the number of subscribers evicted because their buffer was full.
+func (b *Broadcaster) Publish(evt Event) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	evicted := 0
+	for ch := range b.subs {
+		select {
+		case ch <- evt:
+		default:
+			delete(b.subs, ch)
+			close(ch)
+			evicted++
+		}
+	}
+	return evicted
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestBroadcaster(t *testing.T) {
+	var b Broadcaster
+	fast := b.Subscribe()
+	slow := b.Subscribe()
+	gone := b.Subscribe()
+	b.Unsubscribe(gone)
+
+	tests := []struct {
+		name    string
+		evicted int
+	}{
+		{"within the buffer", 0},
+		{"slow subscriber falls behind", 1},
+		{"after the eviction", 0},
+	}
+	for _, tt := range tests {
+		evicted := 0
+		for i := 0; i < subscriberBuffer; i++ {
+			evicted += b.Publish(Event{GameID: i, Type: "test"})
+			<-fast
+		}
+		if evicted != tt.evicted {
+			t.Errorf("%s: evicted %d, want %d", tt.name, evicted, tt.evicted)
+		}
+	}
+
+	// the slow subscriber gets what was buffered, then sees its channel close
+	n := 0
+	for range slow {
+		n++
+	}
+	if n != subscriberBuffer {
+		t.Errorf("slow subscriber got %d events before eviction, want %d", n, subscriberBuffer)
+	}
+	select {
+	case evt := <-gone:
+		t.Errorf("unsubscribed channel got %v", evt)
+	default:
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// captureConn tees everything written to a connection into a capture file.
+type captureConn struct {
+	net.Conn
+	w io.Writer
+}
+
+func (c *captureConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		// a failed capture shouldn't break the proxied connection
+		c.w.Write(b[:n])
+	}
+	return n, err
+}
+
+// createCaptures creates the capture files for a connection from remote in
+// dir: one for client to upstream traffic and one for upstream to client.
+// The files are only readable by the owner, since they include login
+// handshakes.
+func createCaptures(dir string, remote net.Addr) (*os.File, *os.File, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, nil, err
+	}
+	prefix := fmt.Sprintf("%s_%s", time.Now().Format("20060102-150405.000"),
+		strings.NewReplacer(":", "_", "[", "", "]", "").Replace(remote.String()))
+
+	up, err := os.OpenFile(filepath.Join(dir, prefix+"_up.bin"), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	down, err := os.OpenFile(filepath.Join(dir, prefix+"_down.bin"), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		up.Close()
+		return nil, nil, err
+	}
+	return up, down, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Category defines the order of the splits in a run. A run starts in the
+// overworld on login and moves through Splits in order; an optional split
+// may be skipped. The last split must be "credits", which ends the run.
+type Category struct {
+	Name   string          `json:"name"`
+	Splits []CategorySplit `json:"splits"`
+}
+
+// CategorySplit is a state the run can enter: "nether", "end" or "credits".
+type CategorySplit struct {
+	State    string `json:"state"`
+	Optional bool   `json:"optional"`
+}
+
+// splitStates are the states a category may include.
+var splitStates = []string{"nether", "end", "credits"}
+
+// DefaultCategory returns the any% route: nether, end, credits.
+func DefaultCategory() *Category {
+	return &Category{
+		Name: "any%",
+		Splits: []CategorySplit{
+			{State: "nether"},
+			{State: "end"},
+			{State: "credits"},
+		},
+	}
+}
+
+// LoadCategory reads and validates a JSON category rules file.
+func LoadCategory(path string) (*Category, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var c Category
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&c)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %s", path, err)
+	}
+	err = c.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("validating %s: %s", path, err)
+	}
+	return &c, nil
+}
+
+// Validate checks that the splits are known, unique, and end with credits.
+func (c *Category) Validate() error {
+	if len(c.Splits) == 0 {
+		return fmt.Errorf("category %s has no splits", c.Name)
+	}
+	seen := make(map[string]bool)
+	for _, split := range c.Splits {
+		if !contains(splitStates, split.State) {
+			return fmt.Errorf("split %q must be one of %v", split.State, splitStates)
+		}
+		if seen[split.State] {
+			return fmt.Errorf("split %s appears more than once", split.State)
+		}
+		seen[split.State] = true
+	}
+	last := c.Splits[len(c.Splits)-1]
+	if last.State != "credits" || last.Optional {
+		return fmt.Errorf("the last split must be a required credits split")
+	}
+	return nil
+}
+
+// Allows reports whether a run in state from may move to state to: to must
+// come later in the category, with only optional splits in between. A run
+// in the overworld (or any state outside the category) is before the
+// first split.
+func (c *Category) Allows(from string, to string) bool {
+	i := c.index(from)
+	j := c.index(to)
+	if j < 0 || j <= i {
+		return false
+	}
+	for _, split := range c.Splits[i+1 : j] {
+		if !split.Optional {
+			return false
+		}
+	}
+	return true
+}
+
+// index returns the position of state in the splits, or -1.
+func (c *Category) index(state string) int {
+	for i, split := range c.Splits {
+		if split.State == state {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,60 @@
+package main
+
+import "testing"
+
+func TestCategoryValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		splits []CategorySplit
+		ok     bool
+	}{
+		{"any%", DefaultCategory().Splits, true},
+		{"nether skip", []CategorySplit{{State: "nether", Optional: true}, {State: "end"}, {State: "credits"}}, true},
+		{"credits only", []CategorySplit{{State: "credits"}}, true},
+		{"empty", nil, false},
+		{"unknown split", []CategorySplit{{State: "stronghold"}, {State: "credits"}}, false},
+		{"repeated split", []CategorySplit{{State: "nether"}, {State: "nether"}, {State: "credits"}}, false},
+		{"no credits", []CategorySplit{{State: "nether"}, {State: "end"}}, false},
+		{"optional credits", []CategorySplit{{State: "end"}, {State: "credits", Optional: true}}, false},
+		{"credits not last", []CategorySplit{{State: "credits"}, {State: "end"}}, false},
+	}
+	for _, tt := range tests {
+		c := &Category{Name: tt.name, Splits: tt.splits}
+		err := c.Validate()
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: Validate() = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestCategoryAllows(t *testing.T) {
+	anyPercent := DefaultCategory()
+	netherSkip := &Category{Splits: []CategorySplit{
+		{State: "nether", Optional: true},
+		{State: "end"},
+		{State: "credits"},
+	}}
+	tests := []struct {
+		category *Category
+		from, to string
+		allowed  bool
+	}{
+		{anyPercent, "overworld", "nether", true},
+		{anyPercent, "nether", "end", true},
+		{anyPercent, "end", "credits", true},
+		{anyPercent, "overworld", "end", false},
+		{anyPercent, "nether", "credits", false},
+		{anyPercent, "end", "nether", false},
+		{anyPercent, "nether", "nether", false},
+		{anyPercent, "overworld", "overworld", false},
+		{netherSkip, "overworld", "end", true},
+		{netherSkip, "overworld", "nether", true},
+		{netherSkip, "nether", "end", true},
+		{netherSkip, "overworld", "credits", false},
+	}
+	for _, tt := range tests {
+		if got := tt.category.Allows(tt.from, tt.to); got != tt.allowed {
+			t.Errorf("%v: Allows(%s, %s) = %v, want %v", tt.category.Splits, tt.from, tt.to, got, tt.allowed)
+		}
+	}
+}
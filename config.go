@@ -0,0 +1,665 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	units "github.com/docker/go-units"
+	"gopkg.in/yaml.v2"
+)
+
+// stateEvents lists the event types that drive the state machine in Loop().
+var stateEvents = []string{"cmd.reset", "cmd.retime", "cmd.split", "cmd.pause", "cmd.resume", "login", "nether", "endportal", "end", "credits"}
+
+// Config holds settings loaded from the file passed with -config. Flags
+// given on the command line override the file.
+type Config struct {
+	Replicas         int    `json:"replicas"`
+	Image            string `json:"image"`
+	MaxConcurrentGen int    `json:"max_concurrent_gen"`
+
+	// Warm, if set, is the number of replicas kept generated or generating
+	// besides the active one. Replicas are added as needed, up to
+	// MaxReplicas containers in total.
+	Warm        int `json:"warm"`
+	MaxReplicas int `json:"max_replicas"`
+
+	// ReplicaLimit caps the number of containers, counting warm ones, so
+	// that a typo can't exhaust the host.
+	ReplicaLimit int `json:"replica_limit"`
+
+	// ProxyAddr and ProxyPort are the address and port the proxy listens
+	// on for players, and ServerPort the port the servers listen on inside
+	// their containers.
+	ProxyAddr  string `json:"proxy_addr"`
+	ProxyPort  int    `json:"proxy_port"`
+	ServerPort int    `json:"server_port"`
+
+	// Announce styles the split announcements in chat.
+	Announce AnnounceStyle `json:"announce"`
+
+	// WebhookURL, if set, is a Discord or Slack webhook posted to on every
+	// split and finished run.
+	WebhookURL string `json:"webhook_url"`
+
+	// Binds are volumes mounted into every server, as
+	// "host:container[:options]".
+	Binds []string `json:"binds"`
+
+	// ExportDir, if set, is where the world of each completed run is
+	// exported for later verification.
+	ExportDir string `json:"export_dir"`
+
+	// Network, if set, is a user-defined Docker network (created if
+	// missing) the servers are attached to. They are then reached by
+	// container name, which only resolves for a session that runs on the
+	// same network.
+	Network string `json:"network"`
+
+	// IPv6 connects to the servers on their global IPv6 address, for
+	// Docker networks without IPv4.
+	IPv6 bool `json:"ipv6"`
+
+	// ProxyProtocol sends the servers a PROXY protocol v2 header with each
+	// player's address. The servers must be set up to expect it.
+	ProxyProtocol bool `json:"proxy_protocol"`
+
+	// ContainerPrefix names the server containers, "<prefix>_<id>". Sessions
+	// sharing a Docker host need different prefixes.
+	ContainerPrefix string `json:"container_prefix"`
+
+	// ContainerUser is the user ("uid:gid") the servers run as.
+	ContainerUser string `json:"container_user"`
+
+	// ResetCommand, SplitCommand, PauseCommand and ResumeCommand are the
+	// chat messages that control the run, see Game.
+	ResetCommand  string `json:"reset_command"`
+	SplitCommand  string `json:"split_command"`
+	PauseCommand  string `json:"pause_command"`
+	ResumeCommand string `json:"resume_command"`
+
+	// Memory limits each server's memory, e.g. "2g", and MemorySwap its
+	// memory plus swap ("-1" for unlimited swap). CPUs limits its CPU time.
+	// A memory or CPU limit of 0 removes the limit.
+	Memory     string   `json:"memory"`
+	MemorySwap string   `json:"memory_swap"`
+	CPUs       *float64 `json:"cpus"`
+	memory     int64
+	memorySwap int64
+
+	Events     []CustomEvent `json:"events"`
+	Milestones []Milestone   `json:"milestones"`
+
+	// LoginCommands are run on the server after the built-in login
+	// commands when a run starts, e.g. to set up a coordinate display.
+	LoginCommands []string `json:"login_commands"`
+
+	// GeneratedCommands are run on each server once its world is
+	// generated, before anyone logs in, e.g. to set the difficulty.
+	GeneratedCommands []string `json:"generated_commands"`
+
+	// Pace overrides the split colors used by pace against the personal
+	// best.
+	Pace []PaceColor `json:"pace"`
+
+	// Ignore lists regexps for server log lines that are dropped before
+	// detection and never echoed.
+	Ignore []string `json:"ignore"`
+
+	// LevelEnv, if set, is the container environment variable used to give
+	// each replica its own world directory, named by formatting LevelName
+	// with the replica ID. This keeps replicas sharing a mounted volume
+	// from writing to the same world.
+	LevelEnv  string `json:"level_env"`
+	LevelName string `json:"level_name"`
+
+	// Seed, if set, is the world seed passed to every server in the SeedEnv
+	// environment variable. RandomSeed generates a new seed for each world
+	// instead, recorded with the attempt so the run can be reproduced.
+	Seed    string `json:"seed"`
+	SeedEnv string `json:"seed_env"`
+
+	// Env sets extra environment variables on every server, e.g. EULA or
+	// image-specific settings. JavaOpts, if set, is passed in JavaOptsEnv.
+	// Neither may set a variable that the session sets itself.
+	Env      map[string]string `json:"env"`
+	JavaOpts string            `json:"java_opts"`
+}
+
+// AnnounceStyle styles split announcements. ClickCoords lets players click
+// the position in an announcement to copy its coordinates.
+type AnnounceStyle struct {
+	Bold        bool `json:"bold"`
+	Italic      bool `json:"italic"`
+	ClickCoords bool `json:"click_coords"`
+}
+
+// RandomSeed is the Seed that generates a new seed for each world.
+const RandomSeed = "random"
+
+// DefaultSeedEnv is the seed variable used when SeedEnv is unset.
+const DefaultSeedEnv = "SEED"
+
+// JavaOptsEnv is the container environment variable that JavaOpts is
+// passed in.
+const JavaOptsEnv = "JVM_OPTS"
+
+// DefaultLevelName is the world name format used when LevelName is unset.
+const DefaultLevelName = "world_%d"
+
+// DefaultLevel is the server's world name when LevelEnv is unset.
+const DefaultLevel = "world"
+
+var levelExpression = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// prefixExpression matches container prefixes that make valid container
+// names.
+var prefixExpression = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// Level returns the world name for a replica.
+func (c *Config) Level(id int) string {
+	format := c.LevelName
+	if format == "" {
+		format = DefaultLevelName
+	}
+	return fmt.Sprintf(format, id)
+}
+
+// Milestone is an informational event emitted when a log message contains
+// Match, typically an advancement such as "[Into Fire]". Milestones appear
+// in the event stream but never change the run's state. A milestone with a
+// Split name is also recorded and announced as a split, the first time it
+// is reached in a run.
+type Milestone struct {
+	Name  string `json:"name"`
+	Match string `json:"match"`
+	Split string `json:"split,omitempty"`
+}
+
+// defaultMilestones are detected unless overridden by name in the config.
+// None of them split unless configured to, so that external timers only see
+// the splits of the category by default.
+var defaultMilestones = []Milestone{
+	{Name: "blazerods", Match: "[Into Fire]"},
+	{Name: "bastion", Match: "[Those Were the Days]"},
+	{Name: "fortress", Match: "[A Terrible Fortress]"},
+	{Name: "stronghold", Match: "[Eye Spy]"},
+}
+
+// MilestoneSet returns the default milestones merged with the configured
+// ones. A configured milestone replaces a default with the same name, and
+// keeps its match if it has none, e.g. to only give it a split.
+func (c *Config) MilestoneSet() []Milestone {
+	milestones := make([]Milestone, 0, len(defaultMilestones)+len(c.Milestones))
+	for _, m := range defaultMilestones {
+		if c.milestone(m.Name) == nil {
+			milestones = append(milestones, m)
+		}
+	}
+	for _, m := range c.Milestones {
+		if d := defaultMilestone(m.Name); m.Match == "" && d != nil {
+			m.Match = d.Match
+		}
+		milestones = append(milestones, m)
+	}
+	return milestones
+}
+
+// defaultMilestone returns the default milestone with the given name, if any.
+func defaultMilestone(name string) *Milestone {
+	for i := range defaultMilestones {
+		if defaultMilestones[i].Name == name {
+			return &defaultMilestones[i]
+		}
+	}
+	return nil
+}
+
+// milestone returns the configured milestone with the given name, if any.
+func (c *Config) milestone(name string) *Milestone {
+	for i := range c.Milestones {
+		if c.Milestones[i].Name == name {
+			return &c.Milestones[i]
+		}
+	}
+	return nil
+}
+
+// CustomEvent describes a user-defined event emitted by HandleLog() when a
+// log message matches Pattern. If Pattern has capture groups, the captured
+// text (space separated) becomes the event payload.
+type CustomEvent struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"`
+
+	// State marks an event that feeds the state machine. Its Name must then
+	// be one of the built-in event types (e.g. "nether"); otherwise the
+	// event is emitted as "custom.<name>" and is informational only.
+	State bool `json:"state"`
+
+	re *regexp.Regexp
+}
+
+// Type returns the event type emitted for a match.
+func (e *CustomEvent) Type() string {
+	if e.State {
+		return e.Name
+	}
+	return "custom." + e.Name
+}
+
+// Match returns the event payload if text matches the pattern.
+func (e *CustomEvent) Match(text string) (string, bool) {
+	m := e.re.FindStringSubmatch(text)
+	if m == nil {
+		return "", false
+	}
+	if len(m) == 1 {
+		return text, true
+	}
+	return strings.Join(m[1:], " "), true
+}
+
+// LoadConfig reads a JSON or, for .yaml and .yml files, YAML config file.
+// Unknown keys are an error so that typos don't go unnoticed. The config must
+// be validated with Validate once flags have been applied.
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		data, err = yamlToJSON(data)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %s", path, err)
+		}
+	}
+
+	var c Config
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&c)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %s", path, err)
+	}
+	return &c, nil
+}
+
+// yamlToJSON converts a YAML document to JSON so that both formats share the
+// json struct tags and strict decoding of Config.
+func yamlToJSON(data []byte) ([]byte, error) {
+	var v interface{}
+	err := yaml.Unmarshal(data, &v)
+	if err != nil {
+		return nil, err
+	}
+	v, err = jsonValue(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// jsonValue replaces the map[interface{}]interface{} values produced by the
+// YAML decoder with string-keyed maps.
+func jsonValue(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			key, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("non-string key %v", k)
+			}
+			val, err := jsonValue(val)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = val
+		}
+		return m, nil
+	case []interface{}:
+		for i, val := range v {
+			val, err := jsonValue(val)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = val
+		}
+	}
+	return v, nil
+}
+
+// Defaults for settings that the config file and flags leave unset.
+const (
+	DefaultProxyAddr       = "0.0.0.0"
+	DefaultProxyPort       = 25565
+	DefaultServerPort      = 25565
+	DefaultContainerUser   = "1337:1337"
+	DefaultContainerPrefix = "mcspeedrun"
+	DefaultResetCommand    = "rr"
+	DefaultSplitCommand    = "split"
+	DefaultPauseCommand    = "pause"
+	DefaultResumeCommand   = "resume"
+	DefaultMemory          = "2g"
+	DefaultCPUs            = 2.0
+	DefaultReplicaLimit    = 16
+)
+
+// MinMemory is the lowest memory limit accepted, below which the server's JVM
+// is killed as soon as it starts.
+const MinMemory = 512 * units.MiB
+
+// checkReplicas checks the number of replicas against ReplicaLimit.
+func (c *Config) checkReplicas() error {
+	if c.Replicas < 1 {
+		return fmt.Errorf("replicas must be at least 1")
+	}
+	if c.MaxReplicas < c.Replicas {
+		return fmt.Errorf("max_replicas must be at least replicas (%d)", c.Replicas)
+	}
+	if c.MaxReplicas > c.ReplicaLimit {
+		return fmt.Errorf("%d replicas exceed replica_limit (%d)", c.MaxReplicas, c.ReplicaLimit)
+	}
+	return nil
+}
+
+// Validate fills in defaults, checks the config and compiles its patterns.
+func (c *Config) Validate() error {
+	if c.ProxyAddr == "" {
+		c.ProxyAddr = DefaultProxyAddr
+	}
+	if c.ProxyPort == 0 {
+		c.ProxyPort = DefaultProxyPort
+	}
+	if c.ServerPort == 0 {
+		c.ServerPort = DefaultServerPort
+	}
+	if c.ContainerUser == "" {
+		c.ContainerUser = DefaultContainerUser
+	}
+	if c.ContainerPrefix == "" {
+		c.ContainerPrefix = DefaultContainerPrefix
+	}
+	if c.ResetCommand == "" {
+		c.ResetCommand = DefaultResetCommand
+	}
+	if c.SplitCommand == "" {
+		c.SplitCommand = DefaultSplitCommand
+	}
+	if c.PauseCommand == "" {
+		c.PauseCommand = DefaultPauseCommand
+	}
+	if c.ResumeCommand == "" {
+		c.ResumeCommand = DefaultResumeCommand
+	}
+	if c.Memory == "" {
+		c.Memory = DefaultMemory
+	}
+	if c.Seed != "" && c.SeedEnv == "" {
+		c.SeedEnv = DefaultSeedEnv
+	}
+	if c.CPUs == nil {
+		cpus := DefaultCPUs
+		c.CPUs = &cpus
+	}
+	if c.ReplicaLimit == 0 {
+		c.ReplicaLimit = DefaultReplicaLimit
+	}
+	if c.Image == "" {
+		return fmt.Errorf("no image")
+	}
+	if c.MaxConcurrentGen < 0 {
+		return fmt.Errorf("max_concurrent_gen must not be negative")
+	}
+	if c.Warm < 0 {
+		return fmt.Errorf("warm must not be negative")
+	}
+	if c.MaxReplicas == 0 {
+		c.MaxReplicas = c.Replicas
+		if c.Warm+1 > c.MaxReplicas {
+			c.MaxReplicas = c.Warm + 1
+		}
+	}
+	err := c.checkReplicas()
+	if err != nil {
+		return err
+	}
+	if c.ProxyPort < 1 || c.ProxyPort > 65535 {
+		return fmt.Errorf("invalid proxy port %d", c.ProxyPort)
+	}
+	if c.ServerPort < 1 || c.ServerPort > 65535 {
+		return fmt.Errorf("invalid server port %d", c.ServerPort)
+	}
+	if !prefixExpression.MatchString(c.ContainerPrefix) {
+		return fmt.Errorf("invalid container prefix %q", c.ContainerPrefix)
+	}
+	err = validateChatCommands(map[string]string{
+		"reset":  c.ResetCommand,
+		"split":  c.SplitCommand,
+		"pause":  c.PauseCommand,
+		"resume": c.ResumeCommand,
+	})
+	if err != nil {
+		return err
+	}
+	err = c.parseLimits()
+	if err != nil {
+		return err
+	}
+
+	err = validateEvents(c.Events)
+	if err != nil {
+		return err
+	}
+	if c.LevelEnv != "" {
+		if c.LevelName != "" && !strings.Contains(c.LevelName, "%d") {
+			return fmt.Errorf("level name %q must include %%d for the replica ID", c.LevelName)
+		}
+		level := c.Level(0)
+		if !levelExpression.MatchString(level) {
+			return fmt.Errorf("invalid level name %q", level)
+		}
+	}
+	_, err = compileIgnore(c.Ignore)
+	if err != nil {
+		return err
+	}
+	err = validatePace(c.Pace)
+	if err != nil {
+		return err
+	}
+	if c.WebhookURL != "" {
+		u, err := url.Parse(c.WebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("invalid webhook url %q", c.WebhookURL)
+		}
+	}
+	reserved := c.reservedEnv()
+	for key := range c.Env {
+		if key == "" || strings.Contains(key, "=") {
+			return fmt.Errorf("invalid env variable %q", key)
+		}
+		if contains(reserved, key) {
+			return fmt.Errorf("env variable %s is set by mcspeedrun", key)
+		}
+	}
+	for i, bind := range c.Binds {
+		if !strings.Contains(bind, ":") {
+			return fmt.Errorf("bind %d must be host:container", i)
+		}
+	}
+	for i, cmd := range c.LoginCommands {
+		if !strings.HasPrefix(cmd, "/") {
+			return fmt.Errorf("login command %d must start with /", i)
+		}
+	}
+	for i, cmd := range c.GeneratedCommands {
+		if !strings.HasPrefix(cmd, "/") {
+			return fmt.Errorf("generated command %d must start with /", i)
+		}
+	}
+	return validateMilestones(c.MilestoneSet())
+}
+
+// reservedEnv returns the container environment variables set for each
+// server by the session itself.
+func (c *Config) reservedEnv() []string {
+	env := []string{"ENABLE_RCON", "RCON_PORT", "RCON_PASSWORD"}
+	if c.SeedEnv != "" {
+		env = append(env, c.SeedEnv)
+	}
+	if c.LevelEnv != "" {
+		env = append(env, c.LevelEnv)
+	}
+	if c.JavaOpts != "" {
+		env = append(env, JavaOptsEnv)
+	}
+	return env
+}
+
+// ContainerEnv returns the configured environment variables, as "key=value"
+// sorted by key, along with JavaOpts.
+func (c *Config) ContainerEnv() []string {
+	keys := make([]string, 0, len(c.Env))
+	for key := range c.Env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	env := make([]string, 0, len(keys)+1)
+	for _, key := range keys {
+		env = append(env, key+"="+c.Env[key])
+	}
+	if c.JavaOpts != "" {
+		env = append(env, JavaOptsEnv+"="+c.JavaOpts)
+	}
+	return env
+}
+
+// validateEvents checks custom events and compiles their patterns.
+func validateEvents(events []CustomEvent) error {
+	for i := range events {
+		evt := &events[i]
+		if evt.Name == "" {
+			return fmt.Errorf("event %d has no name", i)
+		}
+		if evt.Pattern == "" {
+			return fmt.Errorf("event %s has no pattern", evt.Name)
+		}
+		if evt.State && !contains(stateEvents, evt.Name) {
+			return fmt.Errorf("event %s: state events must be one of %v", evt.Name, stateEvents)
+		}
+		re, err := regexp.Compile(evt.Pattern)
+		if err != nil {
+			return fmt.Errorf("event %s: %s", evt.Name, err)
+		}
+		evt.re = re
+	}
+	return nil
+}
+
+// validateChatCommands checks that the chat commands, by name, are distinct
+// and have no surrounding whitespace, which chat messages never do.
+func validateChatCommands(commands map[string]string) error {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	seen := make(map[string]string)
+	for _, name := range names {
+		cmd := commands[name]
+		if strings.TrimSpace(cmd) != cmd {
+			return fmt.Errorf("%s command %q has surrounding whitespace", name, cmd)
+		}
+		if other, ok := seen[cmd]; ok {
+			return fmt.Errorf("%s and %s commands are both %q", other, name, cmd)
+		}
+		seen[cmd] = name
+	}
+	return nil
+}
+
+// validateMilestones checks milestones.
+func validateMilestones(milestones []Milestone) error {
+	for i, m := range milestones {
+		if m.Name == "" {
+			return fmt.Errorf("milestone %d has no name", i)
+		}
+		if m.Match == "" {
+			return fmt.Errorf("milestone %s has no match", m.Name)
+		}
+		if contains(stateEvents, m.Name) {
+			return fmt.Errorf("milestone %s conflicts with a state event", m.Name)
+		}
+	}
+	return nil
+}
+
+// contains reports whether list includes item.
+func contains(list []string, item string) bool {
+	for _, v := range list {
+		if v == item {
+			return true
+		}
+	}
+	return false
+}
+
+// parseLimits parses and checks the memory and CPU limits.
+func (c *Config) parseLimits() error {
+	var err error
+	c.memory, err = units.RAMInBytes(c.Memory)
+	if err != nil {
+		return fmt.Errorf("invalid memory limit %q: %s", c.Memory, err)
+	}
+	if c.memory != 0 && c.memory < MinMemory {
+		return fmt.Errorf("memory limit %s is below the minimum of %s", c.Memory, units.BytesSize(MinMemory))
+	}
+
+	c.memorySwap = 0
+	switch c.MemorySwap {
+	case "":
+	case "-1":
+		c.memorySwap = -1
+	default:
+		c.memorySwap, err = units.RAMInBytes(c.MemorySwap)
+		if err != nil {
+			return fmt.Errorf("invalid memory swap limit %q: %s", c.MemorySwap, err)
+		}
+		if c.memory == 0 || c.memorySwap < c.memory {
+			return fmt.Errorf("memory swap limit %s must be at least the memory limit", c.MemorySwap)
+		}
+	}
+
+	if *c.CPUs < 0 {
+		return fmt.Errorf("CPU limit must not be negative")
+	}
+	return nil
+}
+
+// Resources returns the container limits for each server.
+func (c *Config) Resources() container.Resources {
+	return container.Resources{
+		NanoCPUs:   int64(*c.CPUs * 1e9),
+		Memory:     c.memory,
+		MemorySwap: c.memorySwap,
+	}
+}
+
+// ProxyListenAddr returns the address the proxy listens on.
+func (c *Config) ProxyListenAddr() string {
+	return net.JoinHostPort(c.ProxyAddr, strconv.Itoa(c.ProxyPort))
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateEvents(t *testing.T) {
+	tests := []struct {
+		name  string
+		event CustomEvent
+		err   string
+	}{
+		{"custom", CustomEvent{Name: "blind", Pattern: `blind`}, ""},
+		{"state", CustomEvent{Name: "nether", Pattern: `nether`, State: true}, ""},
+		{"no name", CustomEvent{Pattern: `blind`}, "has no name"},
+		{"no pattern", CustomEvent{Name: "blind"}, "has no pattern"},
+		{"unknown state", CustomEvent{Name: "blind", Pattern: `blind`, State: true}, "state events must be one of"},
+		{"bad pattern", CustomEvent{Name: "blind", Pattern: `(blind`}, "missing closing )"},
+	}
+	for _, tt := range tests {
+		err := validateEvents([]CustomEvent{tt.event})
+		if tt.err == "" && err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+		}
+		if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestValidateMilestones(t *testing.T) {
+	tests := []struct {
+		name      string
+		milestone Milestone
+		err       string
+	}{
+		{"milestone", Milestone{Name: "pearls", Match: "[A Seedy Place]"}, ""},
+		{"split", Milestone{Name: "pearls", Match: "[A Seedy Place]", Split: "Pearls"}, ""},
+		{"no name", Milestone{Match: "[A Seedy Place]"}, "milestone 0 has no name"},
+		{"no match", Milestone{Name: "pearls"}, "milestone pearls has no match"},
+		{"state", Milestone{Name: "end", Match: "[The End?]"}, "milestone end conflicts with a state event"},
+	}
+	for _, tt := range tests {
+		err := validateMilestones([]Milestone{tt.milestone})
+		if tt.err == "" && err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+		}
+		if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestConfigMilestoneSet(t *testing.T) {
+	c := &Config{Milestones: []Milestone{
+		{Name: "blazerods", Match: "[Spooky Scary Skeleton]"},
+		{Name: "stronghold", Split: "Stronghold"},
+		{Name: "pearls", Match: "[A Seedy Place]"},
+	}}
+	var got []string
+	for _, m := range c.MilestoneSet() {
+		got = append(got, m.Name+" "+m.Match+" "+m.Split)
+	}
+	want := []string{
+		"bastion [Those Were the Days] ",
+		"fortress [A Terrible Fortress] ",
+		// configured milestones replace the defaults, keeping their match
+		// if they have none
+		"blazerods [Spooky Scary Skeleton] ",
+		"stronghold [Eye Spy] Stronghold",
+		"pearls [A Seedy Place] ",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("milestones %q, want %q", got, want)
+	}
+	if n := len((&Config{}).MilestoneSet()); n != len(defaultMilestones) {
+		t.Errorf("%d milestones without config, want %d", n, len(defaultMilestones))
+	}
+}
+
+func TestCustomEventMatch(t *testing.T) {
+	tests := []struct {
+		event   CustomEvent
+		text    string
+		typ     string
+		payload string
+		ok      bool
+	}{
+		{CustomEvent{Name: "bastion", Pattern: `bastion`}, "entered a bastion", "custom.bastion", "entered a bastion", true},
+		{CustomEvent{Name: "trade", Pattern: `traded (\d+) (\w+)`}, "traded 12 pearls", "custom.trade", "12 pearls", true},
+		{CustomEvent{Name: "nether", Pattern: `lit a portal`, State: true}, "lit a portal", "nether", "lit a portal", true},
+		{CustomEvent{Name: "bastion", Pattern: `bastion`}, "entered a fortress", "custom.bastion", "", false},
+	}
+	for _, tt := range tests {
+		events := []CustomEvent{tt.event}
+		err := validateEvents(events)
+		if err != nil {
+			t.Fatal(err)
+		}
+		evt := &events[0]
+		if typ := evt.Type(); typ != tt.typ {
+			t.Errorf("%s: type %q, want %q", evt.Name, typ, tt.typ)
+		}
+		payload, ok := evt.Match(tt.text)
+		if payload != tt.payload || ok != tt.ok {
+			t.Errorf("%s: Match(%q) = %q, %t, want %q, %t", evt.Name, tt.text, payload, ok, tt.payload, tt.ok)
+		}
+	}
+}
+
+func TestConfigLevel(t *testing.T) {
+	tests := []struct {
+		name      string
+		levelName string
+		level     string
+		err       string
+	}{
+		{"default", "", "world_1", ""},
+		{"format", "run-%d", "run-1", ""},
+		{"shared", "world", "", "must include %d"},
+		{"path", "../world_%d", "", "invalid level name"},
+	}
+	for _, tt := range tests {
+		c := &Config{Image: "test", Replicas: 2, LevelEnv: "LEVEL", LevelName: tt.levelName}
+		err := c.Validate()
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+		}
+		if level := c.Level(1); level != tt.level {
+			t.Errorf("%s: level %q, want %q", tt.name, level, tt.level)
+		}
+	}
+}
+
+func TestCompileIgnore(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		err      string
+	}{
+		{nil, ""},
+		{[]string{`Can't keep up`, `^\[Rcon`}, ""},
+		{[]string{`ok`, ``}, "ignore pattern 1 is empty"},
+		{[]string{`[`}, "ignore pattern 0: error parsing regexp"},
+	}
+	for _, tt := range tests {
+		res, err := compileIgnore(tt.patterns)
+		if tt.err == "" {
+			if err != nil || len(res) != len(tt.patterns) {
+				t.Errorf("compileIgnore(%q) = %d, %v", tt.patterns, len(res), err)
+			}
+		} else if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+			t.Errorf("compileIgnore(%q) error %v, want %q", tt.patterns, err, tt.err)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		file string
+		data string
+		err  string
+	}{
+		{"config.json", `{"replicas": 3, "image": "mc:1.16", "login_commands": ["/say hi"]}`, ""},
+		{"config.yaml", "replicas: 3\nimage: mc:1.16\nlogin_commands:\n  - /say hi\n", ""},
+		{"config.yml", "replicas: 3\nimage: mc:1.16\nlogin_commands: [/say hi]\n", ""},
+		{"typo.json", `{"replica": 3}`, `unknown field "replica"`},
+		{"typo.yaml", "replicas: 3\nimgae: mc:1.16\n", `unknown field "imgae"`},
+		{"bad.yaml", "replicas: [3\n", "parsing"},
+		{"bad.json", `{"replicas": "3"}`, "parsing"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, tt.file)
+		err := ioutil.WriteFile(path, []byte(tt.data), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := LoadConfig(path)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: error %v, want %q", tt.file, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.file, err)
+			continue
+		}
+		if c.Replicas != 3 || c.Image != "mc:1.16" || len(c.LoginCommands) != 1 || c.LoginCommands[0] != "/say hi" {
+			t.Errorf("%s: loaded %+v", tt.file, c)
+		}
+	}
+
+	_, err := LoadConfig(filepath.Join(dir, "missing.yaml"))
+	if !os.IsNotExist(err) {
+		t.Errorf("missing file: error %v", err)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	c := &Config{Image: "mc:1.16", Replicas: 2}
+	err := c.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ProxyPort != DefaultProxyPort || c.ServerPort != DefaultServerPort || c.ResetCommand != DefaultResetCommand {
+		t.Errorf("defaults not filled in: %+v", c)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+		err    string
+	}{
+		{"no image", func(c *Config) { c.Image = "" }, "no image"},
+		{"no replicas", func(c *Config) { c.Replicas = 0 }, "replicas must be at least 1"},
+		{"too many replicas", func(c *Config) { c.Replicas = 100 }, "100 replicas exceed replica_limit (16)"},
+		{"too many warm", func(c *Config) { c.Warm = 16 }, "17 replicas exceed replica_limit (16)"},
+		{"lower limit", func(c *Config) { c.ReplicaLimit = 1 }, "2 replicas exceed replica_limit (1)"},
+		{"negative generation limit", func(c *Config) { c.MaxConcurrentGen = -1 }, "max_concurrent_gen must not be negative"},
+		{"proxy port", func(c *Config) { c.ProxyPort = 70000 }, "invalid proxy port 70000"},
+		{"server port", func(c *Config) { c.ServerPort = -1 }, "invalid server port -1"},
+		{"login command", func(c *Config) { c.LoginCommands = []string{"say hi"} }, "login command 0 must start with /"},
+		{"generated command", func(c *Config) { c.GeneratedCommands = []string{"difficulty hard"} }, "generated command 0 must start with /"},
+		{"webhook", func(c *Config) { c.WebhookURL = "ftp://example.com" }, "invalid webhook url"},
+		{"bind", func(c *Config) { c.Binds = []string{"/data"} }, "bind 0 must be host:container"},
+		{"rcon env", func(c *Config) { c.Env = map[string]string{"RCON_PORT": "1"} }, "env variable RCON_PORT is set by mcspeedrun"},
+		{"seed env", func(c *Config) { c.Seed = "1"; c.Env = map[string]string{"SEED": "2"} }, "env variable SEED is set by mcspeedrun"},
+		{"java opts env", func(c *Config) { c.JavaOpts = "-Xmx2G"; c.Env = map[string]string{"JVM_OPTS": "-Xmx1G"} }, "env variable JVM_OPTS is set by mcspeedrun"},
+		{"pace", func(c *Config) { c.Pace = []PaceColor{{Behind: "0s", Color: "orange"}} }, "unknown color"},
+		{"milestone match", func(c *Config) { c.Milestones = []Milestone{{Name: "pearls", Split: "Pearls"}} }, "milestone pearls has no match"},
+		{"reset command", func(c *Config) { c.ResetCommand = " rr" }, `reset command " rr" has surrounding whitespace`},
+		{"duplicate command", func(c *Config) { c.PauseCommand = "rr" }, `pause and reset commands are both "rr"`},
+	}
+	for _, tt := range tests {
+		c := &Config{Image: "mc:1.16", Replicas: 2}
+		tt.modify(c)
+		err := c.Validate()
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestConfigContainerEnv(t *testing.T) {
+	c := &Config{
+		Env:      map[string]string{"MEMORY": "2G", "EULA": "TRUE"},
+		JavaOpts: "-XX:+UseG1GC",
+	}
+	want := "EULA=TRUE MEMORY=2G JVM_OPTS=-XX:+UseG1GC"
+	if env := strings.Join(c.ContainerEnv(), " "); env != want {
+		t.Errorf("env %q, want %q", env, want)
+	}
+}
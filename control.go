@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// The proxy control protocol is a stream of newline-terminated upstream
+// addresses sent by the session to a standalone proxy over a Unix socket.
+// An empty line means there is no active replica.
+
+// ServeControl listens on the Unix socket at path and forwards every upstream
+// address received from a session onto addrs until the context is cancelled.
+func ServeControl(ctx context.Context, path string, addrs chan<- string) error {
+	// remove a stale socket left behind by a previous run
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	log.Printf("[control] listening on %s", path)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return nil
+			default:
+			}
+			return err
+		}
+		log.Printf("[control] session connected")
+		go func(c net.Conn) {
+			defer c.Close()
+			sc := bufio.NewScanner(c)
+			for sc.Scan() {
+				select {
+				case addrs <- strings.TrimSpace(sc.Text()):
+				case <-ctx.Done():
+					return
+				}
+			}
+			log.Printf("[control] session disconnected")
+		}(conn)
+	}
+}
+
+// SendUpstreams forwards every upstream address received on addrs to the
+// standalone proxy listening on the Unix socket at path. It reconnects if the
+// proxy goes away, re-sending the latest address on each new connection.
+func SendUpstreams(ctx context.Context, path string, addrs <-chan string) {
+	var conn net.Conn
+	var current string
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	for {
+		if conn == nil {
+			var err error
+			conn, err = net.Dial("unix", path)
+			if err != nil {
+				log.Printf("[control] error connecting to proxy: %s", err)
+			} else {
+				_, err = fmt.Fprintf(conn, "%s\n", current)
+			}
+			if err != nil {
+				conn = nil
+				select {
+				case current = <-addrs:
+				case <-time.After(time.Second):
+				case <-ctx.Done():
+					return
+				}
+				continue
+			}
+		}
+
+		select {
+		case current = <-addrs:
+			log.Printf("[control] switching proxy to %s", current)
+			_, err := fmt.Fprintf(conn, "%s\n", current)
+			if err != nil {
+				log.Printf("[control] error updating proxy: %s", err)
+				conn.Close()
+				conn = nil
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
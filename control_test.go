@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestControl(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "control.sock")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the session starts first, and re-sends the latest address once the
+	// proxy is up
+	sent := make(chan string)
+	go SendUpstreams(ctx, path, sent)
+	sent <- "10.0.0.1"
+	received := make(chan string)
+	go ServeControl(ctx, path, received)
+
+	receive := func(want string) {
+		t.Helper()
+		select {
+		case addr := <-received:
+			if addr != want {
+				t.Errorf("proxy received %q, want %q", addr, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("proxy didn't receive %q", want)
+		}
+	}
+	receive("10.0.0.1")
+
+	for _, addr := range []string{"10.0.0.2", "", "10.0.0.3"} {
+		sent <- addr
+		receive(addr)
+	}
+}
+
+func TestControlSessionRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "control.sock")
+	p := &ProxyServer{
+		ListenAddr: freeAddr(t, "127.0.0.1"),
+		ServerPort: echoServer(t, "127.0.0.1"),
+	}
+	addrs := runProxy(t, p)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ServeControl(ctx, path, addrs)
+
+	// waits for the proxy to be pointed at addr
+	upstream := func(addr string) {
+		t.Helper()
+		for i := 0; p.upstream.Get() != addr; i++ {
+			if i == 500 {
+				t.Fatalf("proxy didn't switch to %q", addr)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	session, stop := context.WithCancel(ctx)
+	sent := make(chan string)
+	go SendUpstreams(session, path, sent)
+	sent <- "127.0.0.1"
+	upstream("127.0.0.1")
+	c, err := net.Dial("tcp", p.ListenAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	echo(t, c, "hello")
+
+	// the restarted session clears the upstream on connecting, then sends
+	// the replica that is still active
+	stop()
+	session, stop = context.WithCancel(ctx)
+	defer stop()
+	sent = make(chan string)
+	go SendUpstreams(session, path, sent)
+	upstream("")
+	sent <- "127.0.0.1"
+	upstream("127.0.0.1")
+
+	time.Sleep(50 * time.Millisecond)
+	echo(t, c, "still here")
+}
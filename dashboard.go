@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+)
+
+// DashboardState is the snapshot polled by the dashboard page.
+type DashboardState struct {
+	State   string `json:"state"`
+	Active  int    `json:"active"`
+	Attempt int    `json:"attempt"`
+
+	// ElapsedMs is the run's elapsed time: running while in progress, the
+	// final time after the credits and zero before login. Paused is set
+	// while the timer is held.
+	ElapsedMs int64           `json:"elapsed_ms"`
+	Paused    bool            `json:"paused"`
+	Splits    []Split         `json:"splits"`
+	Replicas  []ReplicaStatus `json:"replicas"`
+}
+
+// DashboardState returns a snapshot of the timer and replicas.
+func (s *Session) DashboardState() DashboardState {
+	status := s.Status()
+	state := DashboardState{
+		State:    status.State,
+		Active:   status.Active,
+		Attempt:  status.Attempt,
+		Paused:   status.Paused,
+		Splits:   []Split{},
+		Replicas: s.Replicas(),
+	}
+	if attempt, ok := s.Attempt(status.Attempt); ok && attempt.Splits != nil {
+		state.Splits = attempt.Splits
+	}
+	state.ElapsedMs = s.elapsedMs(status.State, state.Splits)
+	return state
+}
+
+// Dashboard serves a read-only web dashboard, and the overlay for streams, on
+// DashboardAddr until the context is cancelled.
+func (s *Session) Dashboard(ctx context.Context) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/state", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.DashboardState())
+	})
+	mux.Handle("/overlay/ws", s.overlayFeed(ctx))
+	mux.HandleFunc("/overlay", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, overlayPage)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, dashboardPage)
+	})
+	srv := &http.Server{
+		Addr:    s.DashboardAddr,
+		Handler: mux,
+	}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	log.Printf("[dashboard] listening on %s", s.DashboardAddr)
+	err := srv.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		log.Printf("[dashboard] error serving: %s", err)
+	}
+}
+
+// dashboardPage polls /api/state every second. The timer ticks locally
+// between polls while a run is in progress.
+const dashboardPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>mcspeedrun</title>
+<style>
+body { font-family: monospace; background: #111; color: #ddd; margin: 2em; }
+#timer { font-size: 4em; color: #5f5; }
+#state { color: #aaa; }
+table { border-collapse: collapse; margin-top: 1em; }
+td, th { padding: 0.2em 1em; text-align: left; }
+.ready { color: #5f5; }
+.active { font-weight: bold; }
+</style>
+</head>
+<body>
+<div id="state">connecting...</div>
+<div id="timer">0:00.000</div>
+<table id="splits"></table>
+<table id="replicas"></table>
+<script>
+var state = null, fetched = 0;
+
+function fmt(ms) {
+	var h = Math.floor(ms / 3600000), m = Math.floor(ms / 60000) % 60;
+	var s = Math.floor(ms / 1000) % 60, f = ms % 1000;
+	var t = (m < 10 && h ? "0" : "") + m + ":" + (s < 10 ? "0" : "") + s + "." + ("00" + f).slice(-3);
+	return h ? h + ":" + t : t;
+}
+
+function rows(id, head, items) {
+	var el = document.getElementById(id);
+	el.innerHTML = "";
+	var tr = el.insertRow();
+	head.forEach(function(h) { var th = document.createElement("th"); th.textContent = h; tr.appendChild(th); });
+	items.forEach(function(item) {
+		var tr = el.insertRow();
+		tr.className = item.className || "";
+		item.cells.forEach(function(c) { tr.insertCell().textContent = c; });
+	});
+}
+
+function render() {
+	if (!state) return;
+	var elapsed = state.elapsed_ms;
+	if (state.state && state.state !== "credits" && !state.paused) elapsed += Date.now() - fetched;
+	document.getElementById("timer").textContent = fmt(elapsed);
+}
+
+function poll() {
+	fetch("api/state").then(function(r) { return r.json(); }).then(function(s) {
+		state = s;
+		fetched = Date.now();
+		document.getElementById("state").textContent =
+			"attempt #" + s.attempt + " - " + (s.state || "waiting") + (s.paused ? " (paused)" : "") +
+			(s.active >= 0 ? " on replica " + s.active : " - no active replica");
+		rows("splits", ["split", "time"], s.splits.map(function(sp) {
+			return {cells: [sp.name, fmt(Math.floor(sp.time / 1e6))]};
+		}));
+		rows("replicas", ["replica", "status", "address"], s.replicas.map(function(r) {
+			var status = r.paused ? "paused" : r.ready ? "ready" : "starting";
+			return {
+				className: (r.ready ? "ready" : "") + (r.active ? " active" : ""),
+				cells: [r.name + (r.active ? " (active)" : ""), status, r.addr]
+			};
+		}));
+	}).catch(function() {
+		document.getElementById("state").textContent = "disconnected";
+	});
+}
+
+poll();
+setInterval(poll, 1000);
+setInterval(render, 50);
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"sync/atomic"
+
+	"github.com/gorilla/mux"
+)
+
+// counter is a gauge of running goroutines or open connections, safe for
+// concurrent use.
+type counter struct {
+	n int64
+}
+
+func (c *counter) Inc()       { atomic.AddInt64(&c.n, 1) }
+func (c *counter) Dec()       { atomic.AddInt64(&c.n, -1) }
+func (c *counter) Get() int64 { return atomic.LoadInt64(&c.n) }
+
+// goCounted runs fn in a new goroutine, counted by c while it runs.
+func goCounted(c *counter, fn func()) {
+	c.Inc()
+	go func() {
+		defer c.Dec()
+		fn()
+	}()
+}
+
+// DebugStats is a snapshot of the process's resource usage.
+type DebugStats struct {
+	Goroutines int   `json:"goroutines"`
+	ProxyConns int64 `json:"proxy_conns"`
+	Monitors   int64 `json:"monitors"`
+	Launchers  int64 `json:"launchers"`
+	OpenFDs    int   `json:"open_fds"`
+}
+
+// DebugStats returns the current resource usage. OpenFDs is -1 where it
+// can't be determined.
+func (s *Session) DebugStats() DebugStats {
+	stats := DebugStats{
+		Goroutines: runtime.NumGoroutine(),
+		Monitors:   s.monitors.Get(),
+		Launchers:  s.launchers.Get(),
+		OpenFDs:    -1,
+	}
+	if s.proxy != nil {
+		stats.ProxyConns = s.proxy.conns.Get()
+	}
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err == nil {
+		stats.OpenFDs = len(fds)
+	}
+	return stats
+}
+
+// handleDebugStats returns the current resource usage.
+func (s *Session) handleDebugStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.DebugStats())
+}
+
+// registerPprof serves the net/http/pprof handlers under /debug/pprof/.
+func registerPprof(r *mux.Router) {
+	r.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	r.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	r.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	r.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	r.PathPrefix("/debug/pprof/").HandlerFunc(pprof.Index)
+}
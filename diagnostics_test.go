@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// waitFor polls c until it reaches n.
+func waitFor(t *testing.T, c *counter, n int64) {
+	t.Helper()
+	for i := 0; c.Get() != n; i++ {
+		if i == 500 {
+			t.Fatalf("counter is %d, want %d", c.Get(), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestGoCounted(t *testing.T) {
+	var c counter
+	release := make(chan struct{})
+	for i := 0; i < 3; i++ {
+		goCounted(&c, func() { <-release })
+	}
+	if n := c.Get(); n != 3 {
+		t.Errorf("counted %d goroutines, want 3", n)
+	}
+	close(release)
+	waitFor(t, &c, 0)
+}
+
+func TestProxyConnsCounted(t *testing.T) {
+	p := &ProxyServer{
+		ListenAddr: freeAddr(t, "127.0.0.1"),
+		ServerPort: echoServer(t, "127.0.0.1"),
+	}
+	addrs := runProxy(t, p)
+	setUpstream(t, p, addrs, "127.0.0.1")
+	waitFor(t, &p.conns, 0)
+
+	c, err := net.Dial("tcp", p.ListenAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, c, "hello")
+	waitFor(t, &p.conns, 1)
+	c.Close()
+	waitFor(t, &p.conns, 0)
+}
+
+func TestHandleDebugStats(t *testing.T) {
+	tests := []struct {
+		pprof  bool
+		status int
+	}{
+		{false, http.StatusNotFound},
+		{true, http.StatusOK},
+	}
+	for _, tt := range tests {
+		s, _ := newTestSession(t, 1)
+		s.Pprof = tt.pprof
+
+		w := request(s, "GET", "/debug/stats", "", "")
+		var stats DebugStats
+		err := json.Unmarshal(w.Body.Bytes(), &stats)
+		if w.Code != http.StatusOK || err != nil {
+			t.Fatalf("stats: status %d, %v", w.Code, err)
+		}
+		if stats.Goroutines == 0 || stats.OpenFDs == 0 {
+			t.Errorf("stats %+v", stats)
+		}
+		if w := request(s, "GET", "/debug/pprof/", "", ""); w.Code != tt.status {
+			t.Errorf("pprof %t: status %d, want %d", tt.pprof, w.Code, tt.status)
+		}
+	}
+}
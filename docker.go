@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// DefaultDockerTimeout bounds short Docker API calls unless configured.
+const DefaultDockerTimeout = 10 * time.Second
+
+// DockerClient is the subset of the Docker API used to manage replicas. It
+// is satisfied by *client.Client, and can be faked to drive a Game or
+// Session without a Docker daemon.
+type DockerClient interface {
+	ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, platform *specs.Platform, containerName string) (container.ContainerCreateCreatedBody, error)
+	ImagePull(ctx context.Context, refStr string, options types.ImagePullOptions) (io.ReadCloser, error)
+	ContainerStart(ctx context.Context, container string, options types.ContainerStartOptions) error
+	ContainerWait(ctx context.Context, container string, condition container.WaitCondition) (<-chan container.ContainerWaitOKBody, <-chan error)
+	ContainerKill(ctx context.Context, container, signal string) error
+	ContainerStop(ctx context.Context, container string, timeout *time.Duration) error
+	ContainerInspect(ctx context.Context, container string) (types.ContainerJSON, error)
+	ContainerLogs(ctx context.Context, container string, options types.ContainerLogsOptions) (io.ReadCloser, error)
+	ContainerAttach(ctx context.Context, container string, options types.ContainerAttachOptions) (types.HijackedResponse, error)
+	ContainerRename(ctx context.Context, container, newContainerName string) error
+	ContainerPause(ctx context.Context, container string) error
+	ContainerUnpause(ctx context.Context, container string) error
+	CopyFromContainer(ctx context.Context, container, srcPath string) (io.ReadCloser, types.ContainerPathStat, error)
+	CopyToContainer(ctx context.Context, container, path string, content io.Reader, options types.CopyToContainerOptions) error
+	NetworkCreate(ctx context.Context, name string, options types.NetworkCreate) (types.NetworkCreateResponse, error)
+	NetworkInspect(ctx context.Context, network string, options types.NetworkInspectOptions) (types.NetworkResource, error)
+	Info(ctx context.Context) (types.Info, error)
+}
+
+var _ DockerClient = (*client.Client)(nil)
+
+// apiContext derives the context for a short Docker API call from a
+// long-lived one, so that a hung daemon can't wedge the caller. A timeout of
+// 0 leaves the call unbounded.
+func apiContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// EnsureNetwork creates the bridge network name for the replicas unless it
+// already exists.
+func EnsureNetwork(ctx context.Context, cli DockerClient, name string) error {
+	ctx, cancel := apiContext(ctx, DefaultDockerTimeout)
+	defer cancel()
+	_, err := cli.NetworkInspect(ctx, name, types.NetworkInspectOptions{})
+	if err == nil {
+		return nil
+	}
+	if !client.IsErrNotFound(err) {
+		return err
+	}
+	_, err = cli.NetworkCreate(ctx, name, types.NetworkCreate{
+		CheckDuplicate: true,
+		Driver:         "bridge",
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("[core] created network %s", name)
+	return nil
+}
+
+// PullImage pulls image, logging its progress. Credentials for the image's
+// registry are taken from the Docker config file, as for the docker CLI.
+func PullImage(ctx context.Context, cli DockerClient, image string) error {
+	auth, err := registryAuth(image)
+	if err != nil {
+		log.Printf("[core] error reading registry credentials, pulling %s anonymously: %s", image, err)
+	}
+	log.Printf("[core] pulling %s", image)
+	body, err := cli.ImagePull(ctx, image, types.ImagePullOptions{RegistryAuth: auth})
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	dec := json.NewDecoder(body)
+	for {
+		var msg struct {
+			ID       string `json:"id"`
+			Status   string `json:"status"`
+			Progress string `json:"progress"`
+			Error    string `json:"error"`
+		}
+		err = dec.Decode(&msg)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if msg.Error != "" {
+			return fmt.Errorf("%s", msg.Error)
+		}
+		// skip the progress bars, which are sent many times a second
+		if msg.Progress != "" {
+			continue
+		}
+		if msg.ID != "" {
+			log.Printf("[core] %s: %s", msg.ID, msg.Status)
+		} else {
+			log.Printf("[core] %s", msg.Status)
+		}
+	}
+	log.Printf("[core] pulled %s", image)
+	return nil
+}
+
+// dockerHubAuthKey is the key of Docker Hub's credentials in the Docker
+// config file.
+const dockerHubAuthKey = "https://index.docker.io/v1/"
+
+// registryAuth returns the encoded credentials for the registry of image
+// from the Docker config file ($DOCKER_CONFIG/config.json, or
+// ~/.docker/config.json), or "" if there are none. Credential helpers are not
+// supported.
+func registryAuth(image string) (string, error) {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", nil
+		}
+		dir = filepath.Join(home, ".docker")
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "config.json"))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	var config struct {
+		Auths map[string]types.AuthConfig `json:"auths"`
+	}
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return "", err
+	}
+
+	registry := imageRegistry(image)
+	key := registry
+	if registry == "" {
+		key = dockerHubAuthKey
+	}
+	auth, ok := config.Auths[key]
+	if !ok {
+		return "", nil
+	}
+	if auth.Auth != "" {
+		creds, err := base64.StdEncoding.DecodeString(auth.Auth)
+		if err != nil {
+			return "", fmt.Errorf("invalid auth for %s: %s", key, err)
+		}
+		parts := strings.SplitN(string(creds), ":", 2)
+		if len(parts) != 2 {
+			return "", fmt.Errorf("invalid auth for %s", key)
+		}
+		auth.Username, auth.Password, auth.Auth = parts[0], parts[1], ""
+	}
+	auth.ServerAddress = key
+	buf, err := json.Marshal(auth)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(buf), nil
+}
+
+// imageRegistry returns the registry host of an image reference, or "" for
+// Docker Hub. Like docker, the first component names a registry only if it
+// looks like a host name.
+func imageRegistry(image string) string {
+	i := strings.Index(image, "/")
+	if i < 0 {
+		return ""
+	}
+	host := image[:i]
+	if !strings.ContainsAny(host, ".:") && host != "localhost" {
+		return ""
+	}
+	if host == "docker.io" || host == "index.docker.io" {
+		return ""
+	}
+	return host
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+)
+
+func TestImageRegistry(t *testing.T) {
+	tests := []struct {
+		image    string
+		registry string
+	}{
+		{"tigres/minecraft-fabric:latest", ""},
+		{"ubuntu", ""},
+		{"docker.io/library/ubuntu", ""},
+		{"ghcr.io/alice/fabric:1.16", "ghcr.io"},
+		{"localhost:5000/fabric", "localhost:5000"},
+		{"localhost/fabric", "localhost"},
+	}
+	for _, tt := range tests {
+		if registry := imageRegistry(tt.image); registry != tt.registry {
+			t.Errorf("imageRegistry(%q) = %q, want %q", tt.image, registry, tt.registry)
+		}
+	}
+}
+
+func TestRegistryAuth(t *testing.T) {
+	dir := t.TempDir()
+	config := `{"auths": {"ghcr.io": {"auth": "` + base64.StdEncoding.EncodeToString([]byte("alice:s3cr:et")) + `"}}}`
+	err := ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte(config), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := os.Getenv("DOCKER_CONFIG")
+	os.Setenv("DOCKER_CONFIG", dir)
+	defer os.Setenv("DOCKER_CONFIG", old)
+
+	encoded, err := registryAuth("ghcr.io/alice/fabric")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := base64.URLEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var auth types.AuthConfig
+	err = json.Unmarshal(buf, &auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth.Username != "alice" || auth.Password != "s3cr:et" || auth.ServerAddress != "ghcr.io" {
+		t.Errorf("auth %+v, want alice on ghcr.io", auth)
+	}
+
+	encoded, err = registryAuth("tigres/minecraft-fabric")
+	if err != nil || encoded != "" {
+		t.Errorf("docker hub auth %q, %v, want none", encoded, err)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+)
+
+// EventLog appends every game event to a file as JSON lines, for debugging
+// detection after the fact. It is registered as an inline EventSink.
+type EventLog struct {
+	f   *os.File
+	enc *json.Encoder
+}
+
+// OpenEventLog opens path for appending, creating it if needed.
+func OpenEventLog(path string) (*EventLog, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &EventLog{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+// Write appends an event.
+func (l *EventLog) Write(evt Event) error {
+	return l.enc.Encode(evt)
+}
+
+// Handle appends a game event. The session's own events, such as timer
+// events, are left out, so that the log can be replayed (see Rebuild).
+func (l *EventLog) Handle(ctx context.Context, evt Event) {
+	if isSessionEvent(evt.Type) {
+		return
+	}
+	err := l.Write(evt)
+	if err != nil {
+		log.Printf("[core] error writing event log: %s", err)
+	}
+}
+
+// Close closes the file.
+func (l *EventLog) Close() error {
+	return l.f.Close()
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	l, err := OpenEventLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	events := []Event{
+		{GameID: 0, Timestamp: at, Type: "end", Matched: "builtin:[The End?]"},
+		{GameID: 0, Timestamp: at, Type: "custom.trade", Payload: "12", Matched: "event:trade"},
+	}
+	for _, evt := range events {
+		err = l.Write(evt)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// as a sink, the log leaves out the session's own events
+	l.Handle(context.Background(), Event{GameID: 0, Timestamp: at, Type: "timer.split", Payload: "time=0 split=End"})
+	l.Handle(context.Background(), Event{GameID: 0, Timestamp: at, Type: "credits"})
+	err = l.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	want := [][]string{
+		{`"type":"end"`, `"matched":"builtin:[The End?]"`},
+		{`"type":"custom.trade"`, `"matched":"event:trade"`},
+		{`"type":"credits"`},
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("logged %d events, want %d:\n%s", len(lines), len(want), data)
+	}
+	for i, fields := range want {
+		for _, field := range fields {
+			if !strings.Contains(lines[i], field) {
+				t.Errorf("%s is missing %s", lines[i], field)
+			}
+		}
+	}
+}
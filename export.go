@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// exportSaveTimeout is how long to wait for the server to confirm it saved
+// the world before exporting it anyway.
+const exportSaveTimeout = 10 * time.Second
+
+// exportTimeout bounds copying a world out of its container.
+const exportTimeout = 5 * time.Minute
+
+// pendingExport is a completed run's world waiting for the server to save
+// it before it is exported.
+type pendingExport struct {
+	replica *Game
+	attempt int
+	seed    string
+}
+
+// requestExport asks the active server to save its world, which is exported
+// once the save is logged or exportSaveTimeout elapses. Saving was turned
+// off at login, so without this the export would miss the end of the run.
+func (s *Session) requestExport(ctx context.Context, attempt Attempt) {
+	s.export = &pendingExport{
+		replica: s.active,
+		attempt: attempt.Number,
+		seed:    attempt.Seed,
+	}
+	s.exportTimeout = time.After(exportSaveTimeout)
+	err := s.active.Command(ctx, "/save-all flush")
+	if err != nil {
+		s.gameError(s.active, "saving the world for export", err)
+	}
+}
+
+// finishExport exports the pending world to a directory under ExportDir
+// named by the time, attempt number and seed.
+func (s *Session) finishExport(ctx context.Context) {
+	e := s.export
+	s.export, s.exportTimeout = nil, nil
+
+	name := fmt.Sprintf("%s_attempt-%d", time.Now().Format("20060102-150405"), e.attempt)
+	if e.seed != "" {
+		name += "_seed-" + e.seed
+	}
+	dir := filepath.Join(s.config.ExportDir, name)
+	ctx, cancel := context.WithTimeout(ctx, exportTimeout)
+	defer cancel()
+	err := e.replica.Export(ctx, dir)
+	if err != nil {
+		log.Printf("[core] error exporting world of attempt #%d: %s", e.attempt, err)
+		return
+	}
+	log.Printf("[core] exported world of attempt #%d to %s", e.attempt, dir)
+}
+
+// Export copies the world out of the container into dir, as a tar archive
+// named world.tar.
+func (g *Game) Export(ctx context.Context, dir string) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	r, _, err := g.Client.CopyFromContainer(ctx, g.Name, path.Join(g.DataDir, g.Level))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	f, err := os.Create(filepath.Join(dir, "world.tar"))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -3,35 +3,164 @@ package main
 import (
 	"bufio"
 	"context"
+	"crypto/rand"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"log"
+	"math"
+	"net"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
 )
 
 var (
-	logExpression = regexp.MustCompile(`^\[(\d+:\d+:\d+)\] \[([\s\w/-]+)\]: (.+)$`)
+	// chatExpression matches a player's chat message, e.g. "<alice> rr",
+	// which 1.19+ servers may mark "[Not Secure]".
+	chatExpression = regexp.MustCompile(`^(?:\[Not Secure\] )?<[^<>]+> (.*)$`)
+	dimExpression  = regexp.MustCompile(`^[a-z0-9_.-]+:[a-z0-9_./-]+$`)
+	posExpression  = regexp.MustCompile(`has the following entity data: \[(-?[\d.]+)d, (-?[\d.]+)d, (-?[\d.]+)d\]`)
 )
 
 type Game struct {
 	ID     int
 	Name   string
 	Image  string
-	Addr   string
-	Ready  bool
 	Events chan Event
 
-	Client  *client.Client
+	// Addr and Ready, like Paused, ReadyAt, ResetAt and WorldSeed, are
+	// guarded by the owning Session's mu once the game has been launched.
+	// The session sets them itself, so that the Docker and RCON calls of
+	// the methods below never run while holding mu.
+	Addr  string
+	Ready bool
+
+	// Paused is set while the container is paused after sitting idle, and
+	// ReadyAt records when the game last became ready or was unpaused.
+	Paused  bool
+	ReadyAt time.Time
+
+	// ResetAt records when the game was last reset or crashed. Its
+	// container is replaced by a new one generating a fresh world, so
+	// "generated" and "ready" events from before it are stale and ignored.
+	ResetAt time.Time
+
+	// StartedAt records when the container was last started. It is set by
+	// Loop() on the "started" event.
+	StartedAt time.Time
+
+	// Patterns are matched against log messages that don't match a
+	// built-in event.
+	Patterns *PatternSet
+
+	// User is the user the server runs as.
+	User string
+
+	// ResetCommand, SplitCommand, PauseCommand and ResumeCommand are the
+	// chat messages that reset the run, record a split named by the rest
+	// of the message (e.g. "split blind"), and hold and restart the run
+	// timer. Only a player's whole message counts, so the command said in
+	// passing does nothing. An empty command is disabled.
+	ResetCommand  string
+	SplitCommand  string
+	PauseCommand  string
+	ResumeCommand string
+
+	// DockerTimeout bounds each short Docker API call, such as inspecting or
+	// killing the container. Log and wait streams are not bounded.
+	DockerTimeout time.Duration
+
+	// Env, Resources and Binds (volumes, as "host:container[:options]")
+	// are passed to the container on Start.
+	Env       []string
+	Resources container.Resources
+	Binds     []string
+
+	// IPv6 makes Refresh use the container's global IPv6 address.
+	IPv6 bool
+
+	// PullMu, if set, is shared by games of the same image so that only
+	// one of them pulls it when it is missing.
+	PullMu *sync.Mutex
+
+	// Network, if set, is the Docker network the container is attached to
+	// on Start. Addr is then the container's name.
+	Network string
+
+	// Seed, if set, is passed to the container in SeedEnv on Start, with
+	// RandomSeed replaced by a new seed each time. WorldSeed is the seed of
+	// the current world, set by Loop() on the "started" event.
+	Seed      string
+	SeedEnv   string
+	WorldSeed string
+
+	// Template, if set, is a world directory copied into the container on
+	// Start as the world Level under DataDir, instead of generating one.
+	Template string
+	DataDir  string
+	Level    string
+
+	// CrashGrace is how long a container may keep running after its log
+	// stream ends before the stream is just followed again.
+	CrashGrace time.Duration
+	killed     int32 // 1 once Reset has killed the container, accessed atomically
+
+	// StopTimeout, if set, stops the container gracefully on Reset and
+	// Stop: the server is sent SIGTERM so that it saves its world and
+	// exits, and is only killed if it is still running this long after.
+	// Otherwise it is killed straight away.
+	StopTimeout time.Duration
+
+	// AutoRemove removes the container once it stops. Otherwise a stopped
+	// container is renamed out of the way before the next one starts.
+	AutoRemove bool
+
+	// GenSlots, if set, limits how many games generate worlds at once. A
+	// slot is taken before the container starts and given back when the
+	// world is generated or the container goes away.
+	GenSlots chan struct{}
+	genSlot  int32 // 1 while this game holds a slot, accessed atomically
+
+	// lastLog is the timestamp of the last parsed log line, used by
+	// HandleLog() to date the next one.
+	lastLog time.Time
+
+	// RconPassword is the password the server is started with for its RCON
+	// port. rcon is connected by Refresh once the server is up.
+	RconPassword string
+	rcon         *RconConn
+	rconMu       sync.Mutex
+
+	Client DockerClient
 }
 
-// Command attaches to the container and sends a command.
+// Command sends a single command, see Commands.
 func (g *Game) Command(ctx context.Context, command string) error {
+	return g.Commands(ctx, command)
+}
+
+// Commands sends commands in order over RCON. If RCON isn't connected, the
+// remaining commands are written to the container's stdin over a single
+// attach.
+func (g *Game) Commands(ctx context.Context, commands ...string) error {
+	for len(commands) > 0 && g.rconCommand(commands[0]) {
+		commands = commands[1:]
+	}
+	if len(commands) == 0 {
+		return nil
+	}
+
+	ctx, cancel := g.apiContext(ctx)
+	defer cancel()
 	resp, err := g.Client.ContainerAttach(ctx, g.Name, types.ContainerAttachOptions{
 		Stream: true,
 		Stdin:  true,
@@ -40,122 +169,606 @@ func (g *Game) Command(ctx context.Context, command string) error {
 		return err
 	}
 	defer resp.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		resp.Conn.SetWriteDeadline(deadline)
+	}
 
-	fmt.Fprintf(resp.Conn, "%s\n", command)
+	for _, command := range commands {
+		_, err = fmt.Fprintf(resp.Conn, "%s\n", command)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// rconCommand sends a command over RCON and reports whether it was sent. The
+// connection is dropped on error, leaving later commands to the fallback.
+func (g *Game) rconCommand(command string) bool {
+	g.rconMu.Lock()
+	defer g.rconMu.Unlock()
+	if g.rcon == nil {
+		return false
+	}
+	resp, err := g.rcon.Command(strings.TrimPrefix(command, "/"))
+	if err != nil {
+		log.Printf("[%s] rcon error, falling back to stdin: %s", g.Name, err)
+		g.rcon.Close()
+		g.rcon = nil
+		return false
+	}
+	if resp != "" {
+		log.Printf("[%s] rcon: %s", g.Name, resp)
+	}
+	return true
+}
+
+// connectRcon replaces the RCON connection with a new one to the server at
+// addr. Without one, commands are sent over stdin.
+func (g *Game) connectRcon(addr string) {
+	g.rconMu.Lock()
+	defer g.rconMu.Unlock()
+	if g.rcon != nil {
+		g.rcon.Close()
+		g.rcon = nil
+	}
+	if addr == "" || g.RconPassword == "" {
+		return
+	}
+	conn, err := DialRcon(net.JoinHostPort(addr, RconPort), g.RconPassword)
+	if err != nil {
+		log.Printf("[%s] rcon unavailable, using stdin for commands: %s", g.Name, err)
+		return
+	}
+	g.rcon = conn
+}
+
 // Say uses the /tellraw command to send a message to all players.
 func (g *Game) Say(ctx context.Context, text string, color string) error {
-	buf, _ := json.Marshal([]Message{
+	return g.Command(ctx, tellraw(text, color))
+}
+
+// SayComponents sends a message made of styled components to all players.
+func (g *Game) SayComponents(ctx context.Context, msgs []Message) error {
+	return g.Command(ctx, tellrawComponents(msgs))
+}
+
+// tellraw returns the command that sends a message to all players.
+func tellraw(text string, color string) string {
+	return tellrawComponents([]Message{
+		{Text: text, Color: color},
+	})
+}
+
+// tellrawComponents returns the command that sends a message made of
+// components to all players.
+func tellrawComponents(msgs []Message) string {
+	buf, _ := json.Marshal(msgs)
+	return fmt.Sprintf("/tellraw @a %s", buf)
+}
+
+// SayIn sends a message only to players in the given dimension.
+func (g *Game) SayIn(ctx context.Context, dimension string, text string, color string) error {
+	return g.SayComponentsIn(ctx, dimension, []Message{
 		{Text: text, Color: color},
 	})
-	return g.Command(ctx, fmt.Sprintf("/tellraw @a %s", buf))
 }
 
+// SayComponentsIn sends a message made of components only to players in
+// the given dimension.
+func (g *Game) SayComponentsIn(ctx context.Context, dimension string, msgs []Message) error {
+	buf, _ := json.Marshal(msgs)
+	return g.Command(ctx, fmt.Sprintf("/execute in %s run tellraw @a[distance=0..] %s", dimension, buf))
+}
+
+// ParseDimension validates a dimension ID, adding the minecraft namespace if
+// none is given.
+func ParseDimension(dimension string) (string, error) {
+	if !strings.Contains(dimension, ":") {
+		dimension = "minecraft:" + dimension
+	}
+	if !dimExpression.MatchString(dimension) {
+		return "", fmt.Errorf("invalid dimension %q", dimension)
+	}
+	return dimension, nil
+}
+
+// Restart backoff for Launch(). A container that stops within
+// launchStableAfter of starting (other than through Reset) or fails to start
+// counts as a failure; consecutive failures back off exponentially between
+// launchBackoffMin and launchBackoffMax, and crashLoopFailures of them emit a
+// "crashloop" event.
+const (
+	launchBackoffMin  = time.Second
+	launchBackoffMax  = 30 * time.Second
+	launchStableAfter = time.Minute
+	crashLoopFailures = 5
+)
+
 // Launch keeps the container alive. Each time the container is removed,
-// this function starts the container again.
+// this function starts the container again, backing off if it keeps failing.
 func (g *Game) Launch(ctx context.Context) {
+	var lastStart time.Time
+	var startFailed bool
+	var backoff time.Duration
+	failures := 0
 	for {
-		okchan, errchan := g.Client.ContainerWait(ctx, g.Name, container.WaitConditionRemoved)
+		condition := container.WaitConditionRemoved
+		if !g.AutoRemove {
+			condition = container.WaitConditionNotRunning
+		}
+		okchan, errchan := g.Client.ContainerWait(ctx, g.Name, condition)
 		select {
 		case <-okchan:
-			log.Printf("[%s], removed container", g.Name)
+			if g.AutoRemove {
+				log.Printf("[%s], removed container", g.Name)
+			} else {
+				log.Printf("[%s] container stopped", g.Name)
+			}
 		case err := <-errchan:
 			log.Printf("[%s] error waiting for container: %s", g.Name, err)
 		case <-ctx.Done():
 			return
 		}
+		if !g.AutoRemove {
+			g.keep(ctx)
+		}
+		g.releaseSlot()
+
+		killed := atomic.LoadInt32(&g.killed) == 1
+		if startFailed || (!killed && !lastStart.IsZero() && time.Since(lastStart) < launchStableAfter) {
+			failures++
+			backoff = nextBackoff(backoff)
+		} else {
+			failures = 0
+			backoff = 0
+		}
+		if failures == crashLoopFailures {
+			log.Printf("[%s] crash loop: %d consecutive failed starts", g.Name, failures)
+			g.emit("crashloop", fmt.Sprintf("failures=%d", failures))
+		}
+		if backoff > 0 {
+			log.Printf("[%s] restarting in %s after %d failures", g.Name, backoff, failures)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		if !g.acquireSlot(ctx) {
+			return
+		}
+		lastStart = time.Now()
 		err := g.Start(ctx)
+		startFailed = err != nil
 		if err != nil {
 			log.Printf("[%s] error starting container: %s", g.Name, err)
+			g.releaseSlot()
+		}
+	}
+}
+
+// nextBackoff doubles a restart backoff, starting at launchBackoffMin and
+// capped at launchBackoffMax.
+func nextBackoff(backoff time.Duration) time.Duration {
+	if backoff == 0 {
+		return launchBackoffMin
+	}
+	backoff *= 2
+	if backoff > launchBackoffMax {
+		backoff = launchBackoffMax
+	}
+	return backoff
+}
+
+// acquireSlot waits for a world generation slot. It returns false if the
+// context is cancelled first.
+func (g *Game) acquireSlot(ctx context.Context) bool {
+	if g.GenSlots == nil {
+		return true
+	}
+	select {
+	case g.GenSlots <- struct{}{}:
+	default:
+		log.Printf("[%s] waiting for a generation slot", g.Name)
+		select {
+		case g.GenSlots <- struct{}{}:
+		case <-ctx.Done():
+			return false
 		}
 	}
+	atomic.StoreInt32(&g.genSlot, 1)
+	return true
+}
+
+// releaseSlot gives back the generation slot, if this game holds one.
+func (g *Game) releaseSlot() {
+	if g.GenSlots == nil {
+		return
+	}
+	if atomic.CompareAndSwapInt32(&g.genSlot, 1, 0) {
+		<-g.GenSlots
+	}
+}
+
+// keep renames a stopped container so that its name is free for the next
+// one. It does nothing if there is no container.
+func (g *Game) keep(ctx context.Context) {
+	name := fmt.Sprintf("%s_%s", g.Name, time.Now().Format("20060102-150405"))
+	ctx, cancel := g.apiContext(ctx)
+	defer cancel()
+	err := g.Client.ContainerRename(ctx, g.Name, name)
+	if err != nil {
+		if !client.IsErrNotFound(err) {
+			log.Printf("[%s] error renaming stopped container: %s", g.Name, err)
+		}
+		return
+	}
+	log.Printf("[%s] kept stopped container as %s", g.Name, name)
 }
 
 // Start creates and starts a container.
 func (g *Game) Start(ctx context.Context) error {
-	resp, err := g.Client.ContainerCreate(ctx, &container.Config{
+	env := g.Env
+	seed := g.Seed
+	if seed == RandomSeed {
+		seed = randomSeed()
+	}
+	if seed != "" {
+		env = append(env[:len(env):len(env)], g.SeedEnv+"="+seed)
+	}
+	resp, err := g.create(ctx, env)
+	if client.IsErrNotFound(err) {
+		resp, err = g.pullAndCreate(ctx, env)
+	}
+	if err != nil {
+		return err
+	}
+	if g.Template != "" {
+		err = g.copyTemplate(ctx, resp.ID)
+		if err != nil {
+			return fmt.Errorf("copying world template: %s", err)
+		}
+	}
+	startCtx, cancel := g.apiContext(ctx)
+	defer cancel()
+	err = g.Client.ContainerStart(startCtx, resp.ID, types.ContainerStartOptions{})
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt32(&g.killed, 0)
+	log.Printf("[%s] started container with %s", g.Name, describeResources(g.Resources))
+	if seed != "" {
+		log.Printf("[%s] using seed %s", g.Name, seed)
+		g.emit("started", "seed="+seed)
+	} else {
+		g.emit("started", "")
+	}
+	return nil
+}
+
+// create creates the container with the given environment.
+func (g *Game) create(ctx context.Context, env []string) (container.ContainerCreateCreatedBody, error) {
+	ctx, cancel := g.apiContext(ctx)
+	defer cancel()
+	return g.Client.ContainerCreate(ctx, &container.Config{
 		Image:     g.Image,
-		User:      "1337:1337",
+		Env:       env,
+		User:      g.User,
 		Tty:       true,
 		OpenStdin: true,
 	}, &container.HostConfig{
-		AutoRemove: true,
-	}, nil, nil, g.Name)
+		AutoRemove:  g.AutoRemove,
+		Resources:   g.Resources,
+		NetworkMode: container.NetworkMode(g.Network),
+		Binds:       g.Binds,
+	}, g.networkingConfig(), nil, g.Name)
+}
+
+// pullAndCreate pulls the missing image and creates the container. Games
+// sharing PullMu pull one at a time, and a game that finds the image already
+// pulled by another once it gets its turn doesn't pull it again.
+func (g *Game) pullAndCreate(ctx context.Context, env []string) (container.ContainerCreateCreatedBody, error) {
+	if g.PullMu != nil {
+		g.PullMu.Lock()
+		defer g.PullMu.Unlock()
+	}
+	resp, err := g.create(ctx, env)
+	if !client.IsErrNotFound(err) {
+		return resp, err
+	}
+	err = PullImage(ctx, g.Client, g.Image)
 	if err != nil {
-		return err
+		return resp, fmt.Errorf("pulling %s: %s", g.Image, err)
+	}
+	return g.create(ctx, env)
+}
+
+// networkingConfig attaches the container to Network, if set.
+func (g *Game) networkingConfig() *network.NetworkingConfig {
+	if g.Network == "" {
+		return nil
 	}
-	err = g.Client.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{})
+	return &network.NetworkingConfig{
+		EndpointsConfig: map[string]*network.EndpointSettings{
+			g.Network: {},
+		},
+	}
+}
+
+// randomSeed generates a world seed.
+func randomSeed() string {
+	var buf [8]byte
+	_, err := rand.Read(buf[:])
 	if err != nil {
-		return err
+		panic(err)
 	}
-	log.Printf("[%s] started container", g.Name)
-	return nil
+	return strconv.FormatInt(int64(binary.BigEndian.Uint64(buf[:])), 10)
 }
 
-// Refresh inspects the container and updates the IP address.
-func (g *Game) Refresh(ctx context.Context) error {
+// Refresh inspects the container, reconnects to its RCON port and returns
+// its address, which the caller stores in Addr. The address is the
+// container's name if it is on Network, or else its IP address (the global
+// IPv6 address if IPv6 is set and the container has one).
+func (g *Game) Refresh(ctx context.Context) (string, error) {
+	ctx, cancel := g.apiContext(ctx)
+	defer cancel()
 	c, err := g.Client.ContainerInspect(ctx, g.Name)
 	if err != nil {
-		return err
+		return "", err
 	}
-	g.Addr = c.NetworkSettings.DefaultNetworkSettings.IPAddress
-	return nil
+	var addr string
+	switch {
+	case g.Network != "":
+		addr = g.Name
+	case g.IPv6 && c.NetworkSettings.DefaultNetworkSettings.GlobalIPv6Address != "":
+		addr = c.NetworkSettings.DefaultNetworkSettings.GlobalIPv6Address
+	default:
+		addr = c.NetworkSettings.DefaultNetworkSettings.IPAddress
+	}
+	g.connectRcon(addr)
+	return addr, nil
+}
+
+// LogFormat is a server log line format. Expression captures the timestamp
+// and then the message, and Layout parses the timestamp. For layouts without
+// a date, the date is inferred by Game.logTime().
+type LogFormat struct {
+	Expression *regexp.Regexp
+	Layout     string
+}
+
+// LogFormats are the log line formats recognized by HandleLog(), tried in
+// order.
+var LogFormats = []LogFormat{
+	// fabric and vanilla: [12:34:56] [Server thread/INFO]: message
+	{regexp.MustCompile(`^\[(\d+:\d+:\d+)\] \[[\s\w/-]+\]: (.+)$`), "15:04:05"},
+	// paper and older vanilla: [12:34:56 INFO]: message
+	{regexp.MustCompile(`^\[(\d+:\d+:\d+) [A-Z]+\]: (.+)$`), "15:04:05"},
+	// ISO dates: [2006-01-02T15:04:05.000] [Server thread/INFO]: message
+	{regexp.MustCompile(`^\[?(\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d(?:\.\d+)?)\]? \[[\s\w/-]+\]: (.+)$`), "2006-01-02T15:04:05"},
+	{regexp.MustCompile(`^\[?(\d{4}-\d\d-\d\d \d\d:\d\d:\d\d(?:\.\d+)?)\]? \[[\s\w/-]+\]: (.+)$`), "2006-01-02 15:04:05"},
+}
+
+// parseLogLine extracts the timestamp and message from a server log line in
+// any of the LogFormats. Timestamps without a date are in year 0.
+func parseLogLine(line string) (time.Time, string, bool) {
+	for _, f := range LogFormats {
+		m := f.Expression.FindStringSubmatch(line)
+		if len(m) != 3 {
+			continue
+		}
+		t, err := time.Parse(f.Layout, m[1])
+		if err != nil {
+			continue
+		}
+		return t, m[2], true
+	}
+	return time.Time{}, "", false
 }
 
-// HandleLog parses container log lines and generates game events.
+// logTime dates a log timestamp. A timestamp without a date is placed on the
+// day of the previous one, rolling over to the next day if its clock time is
+// earlier, so that splits stay correct across midnight. The first is placed
+// on the day that puts it closest to now.
+func (g *Game) logTime(t time.Time, now time.Time) time.Time {
+	if t.Year() != 0 {
+		g.lastLog = t
+		return t
+	}
+	// log clock times are compared as if they were UTC
+	now = time.Date(now.Year(), now.Month(), now.Day(),
+		now.Hour(), now.Minute(), now.Second(),
+		now.Nanosecond(), time.UTC)
+	base := g.lastLog
+	if base.IsZero() {
+		base = now
+	}
+	t = time.Date(base.Year(), base.Month(), base.Day(),
+		t.Hour(), t.Minute(), t.Second(),
+		now.Nanosecond(), time.UTC)
+	switch {
+	case !g.lastLog.IsZero():
+		if t.Truncate(time.Second).Before(g.lastLog.Truncate(time.Second)) {
+			t = t.AddDate(0, 0, 1)
+		}
+	case t.Sub(now) > 12*time.Hour:
+		t = t.AddDate(0, 0, -1)
+	case now.Sub(t) > 12*time.Hour:
+		t = t.AddDate(0, 0, 1)
+	}
+	g.lastLog = t
+	return t
+}
+
+// logEvents are the built-in events detected by HandleLog(), matched in
+// order against the text of each log message after the reset command.
+var logEvents = []struct {
+	Type  string
+	Match string
+}{
+	{"cmd.retime", ": Set the time to 0]"},
+	{"generated", `For help, type "help"`},
+	{"login", "joined the game"},
+	{"nether", "[We Need to Go Deeper]"},
+	{"end", "[The End?]"},
+	{"credits", "[Credits!]"},
+	{"save", "Saving..."},
+	{"save", "Saved the game"},
+}
+
+// HandleLog parses container log lines and generates game events. Each event
+// records the pattern it matched, e.g. "builtin:[The End?]", "milestone:<name>"
+// or "event:<name>".
 func (g *Game) HandleLog(line string) {
-	log.Printf("[%s] %s", g.Name, line)
-	m := logExpression.FindAllStringSubmatch(line, 1)
-	if len(m) != 1 {
+	patterns := g.Patterns.Get()
+	if patterns.Ignored(line) {
 		return
 	}
-	if len(m[0]) != 4 {
+	t, text, ok := parseLogLine(line)
+	if !ok {
+		log.Printf("[%s] %s", g.Name, line)
 		return
 	}
-	ts, text := m[0][1], m[0][3]
+	t = g.logTime(t, time.Now())
 
-	t, err := time.Parse("15:04:05", ts)
-	if err != nil {
-		log.Printf("[%s] error parsing time: %s", g.Name, err)
+	typ, payload, matched := g.match(text, &patterns)
+	if typ == "" {
+		log.Printf("[%s] %s", g.Name, line)
 		return
 	}
-	now := time.Now()
-	t = time.Date(now.Year(), now.Month(), now.Day(),
-		t.Hour(), t.Minute(), t.Second(),
-		now.Nanosecond(), time.UTC)
+	if typ == "generated" {
+		g.releaseSlot()
+	}
+	evt := Event{
+		Timestamp: t,
+		GameID:    g.ID,
+		Type:      typ,
+		Payload:   payload,
+		Matched:   matched,
+	}
+	logEvent(g.Name, evt, "%s", line)
+	g.Events <- evt
+}
 
-	var typ string
+// chatCommand detects the command in a player's chat message, returning its
+// event type (empty if there is none) and the pattern it matched. The
+// payload of a split is set to its name.
+func (g *Game) chatCommand(msg string, payload *string) (typ string, matched string) {
 	switch {
-	case strings.Contains(text, "> rr"):
-		typ = "cmd.reset"
-	case strings.Contains(text, ": Set the time to 0]"):
-		typ = "cmd.retime"
-	case strings.Contains(text, "For help, type \"help\""):
-		typ = "generated"
-	case strings.Contains(text, "joined the game"):
-		typ = "login"
-	case strings.Contains(text, "[We Need to Go Deeper]"):
-		typ = "nether"
-	case strings.Contains(text, "[The End?]"):
-		typ = "end"
-	case strings.Contains(text, "[Credits!]"):
-		typ = "credits"
+	case g.ResetCommand != "" && msg == g.ResetCommand:
+		return "cmd.reset", "builtin:> " + g.ResetCommand
+	case g.SplitCommand != "" && strings.HasPrefix(msg, g.SplitCommand+" "):
+		*payload = strings.TrimSpace(msg[len(g.SplitCommand)+1:])
+		return "cmd.split", "builtin:> " + g.SplitCommand
+	case g.PauseCommand != "" && msg == g.PauseCommand:
+		return "cmd.pause", "builtin:> " + g.PauseCommand
+	case g.ResumeCommand != "" && msg == g.ResumeCommand:
+		return "cmd.resume", "builtin:> " + g.ResumeCommand
+	}
+	return "", ""
+}
+
+// match detects the event in a log message, returning its type (empty if
+// there is none), payload and the pattern it matched.
+func (g *Game) match(text string, patterns *Patterns) (typ string, payload string, matched string) {
+	// feedback from commands sent over RCON, e.g. "[Rcon: Set the time to
+	// 0]", would otherwise look like a player's command
+	if strings.HasPrefix(text, "[Rcon: ") {
+		return "", "", ""
+	}
+
+	payload = text
+	if m := chatExpression.FindStringSubmatch(text); m != nil {
+		typ, matched = g.chatCommand(strings.TrimSpace(m[1]), &payload)
+	}
+	if typ == "" {
+		for _, e := range logEvents {
+			if strings.Contains(text, e.Match) {
+				typ, matched = e.Type, "builtin:"+e.Match
+				break
+			}
+		}
+	}
+	switch {
+	case typ != "":
+	case posExpression.MatchString(text):
+		typ, matched = "position", "builtin:position"
+		payload = parsePosition(text)
+	default:
+		for _, m := range patterns.Milestones {
+			if strings.Contains(text, m.Match) {
+				typ, matched = m.Name, "milestone:"+m.Name
+				break
+			}
+		}
+		if typ != "" {
+			break
+		}
+		for i := range patterns.Events {
+			m, ok := patterns.Events[i].Match(text)
+			if ok {
+				typ, payload = patterns.Events[i].Type(), m
+				matched = "event:" + patterns.Events[i].Name
+				break
+			}
+		}
 	}
+	return typ, payload, matched
+}
 
-	if typ != "" {
-		g.Events <- Event{
-			Timestamp: t,
-			GameID:    g.ID,
-			Type:      typ,
-			Payload:   text,
+// parsePosition formats the block coordinates from a /data get entity Pos
+// response as "x, y, z".
+func parsePosition(text string) string {
+	m := posExpression.FindStringSubmatch(text)
+	coords := make([]string, 0, 3)
+	for _, v := range m[1:] {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return ""
 		}
+		coords = append(coords, strconv.Itoa(int(math.Floor(f))))
+	}
+	return strings.Join(coords, ", ")
+}
+
+// logCursor tracks the docker timestamp of the last log line consumed, so
+// that a reopened log stream resumes after it instead of replaying lines.
+type logCursor struct {
+	last time.Time
+}
+
+// Since returns the ContainerLogs Since option resuming from the last line,
+// or "" to read the whole log if no line has been consumed yet.
+func (c *logCursor) Since() string {
+	if c.last.IsZero() {
+		return ""
+	}
+	return fmt.Sprintf("%d.%09d", c.last.Unix(), c.last.Nanosecond())
+}
+
+// Next strips the timestamp docker prefixes to a log line and reports
+// whether the line is new. Since is inclusive, so lines at or before the last
+// one consumed are replays.
+func (c *logCursor) Next(line string) (string, bool) {
+	parts := strings.SplitN(line, " ", 2)
+	ts, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil || len(parts) != 2 {
+		return line, true
 	}
+	if !ts.After(c.last) {
+		return "", false
+	}
+	c.last = ts
+	return parts[1], true
 }
 
-// Monitor watches container logs and passes new lines to HandleLog().
+// Monitor watches container logs and passes new lines to HandleLog(). When
+// the log stream ends, it checks whether the container crashed before
+// following the logs again from the last line handled.
 func (g *Game) Monitor(ctx context.Context) {
+	var cursor logCursor
 	for {
 		select {
 		case <-ctx.Done():
@@ -164,6 +777,8 @@ func (g *Game) Monitor(ctx context.Context) {
 			r, err := g.Client.ContainerLogs(ctx, g.Name, types.ContainerLogsOptions{
 				ShowStdout: true,
 				Follow:     true,
+				Timestamps: true,
+				Since:      cursor.Since(),
 			})
 			if err != nil {
 				log.Printf("[%s] error monitoring logs: %s", g.Name, err)
@@ -176,23 +791,160 @@ func (g *Game) Monitor(ctx context.Context) {
 				line, err := rd.ReadString('\n')
 				if err != nil {
 					log.Printf("[%s] error reading logs: %s", g.Name, err)
-					time.Sleep(time.Second)
 					break
 				}
-				line = strings.Trim(line, "\r\n")
+				line, ok := cursor.Next(strings.Trim(line, "\r\n"))
+				if !ok {
+					continue
+				}
 
 				g.HandleLog(line)
 			}
+			r.Close()
+
+			reason, crashed := g.crashed(ctx)
+			if crashed {
+				log.Printf("[%s] crashed: %s", g.Name, reason)
+				g.emit("crash", reason)
+			}
+			time.Sleep(time.Second)
 		}
 	}
 }
 
-// Reset marks a server as not-ready and kills the container.
+// crashed reports whether the container exited without being reset, along
+// with the reason. A container still running after CrashGrace means the log
+// stream just hiccuped.
+func (g *Game) crashed(ctx context.Context) (string, bool) {
+	deadline := time.Now().Add(g.CrashGrace)
+	for {
+		var reason string
+		inspectCtx, cancel := g.apiContext(ctx)
+		c, err := g.Client.ContainerInspect(inspectCtx, g.Name)
+		cancel()
+		switch {
+		case client.IsErrNotFound(err):
+			reason = "container removed"
+		case err != nil:
+			log.Printf("[%s] error inspecting container: %s", g.Name, err)
+			return "", false
+		case !c.State.Running:
+			reason = fmt.Sprintf("exit code %d", c.State.ExitCode)
+			if c.State.OOMKilled {
+				reason += " (out of memory)"
+			}
+		}
+		if reason != "" {
+			return reason, atomic.LoadInt32(&g.killed) == 0
+		}
+		if !time.Now().Before(deadline) {
+			return "", false
+		}
+		select {
+		case <-ctx.Done():
+			return "", false
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// Pause freezes the container so an idle, generated world stops using CPU.
+// The container is paused rather than stopped because it would otherwise be
+// auto-removed along with its world.
+func (g *Game) Pause(ctx context.Context) error {
+	ctx, cancel := g.apiContext(ctx)
+	defer cancel()
+	err := g.Client.ContainerPause(ctx, g.Name)
+	if err != nil {
+		return err
+	}
+	g.emit("paused", "")
+	return nil
+}
+
+// Unpause resumes a paused container.
+func (g *Game) Unpause(ctx context.Context) error {
+	ctx, cancel := g.apiContext(ctx)
+	defer cancel()
+	err := g.Client.ContainerUnpause(ctx, g.Name)
+	if err != nil {
+		return err
+	}
+	g.emit("unpaused", "")
+	return nil
+}
+
+// apiContext derives the context for a short Docker API call, bounded by
+// DockerTimeout.
+func (g *Game) apiContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return apiContext(ctx, g.DockerTimeout)
+}
+
+// emit sends an event from outside the log monitor without blocking the
+// caller, which may be Loop() itself.
+func (g *Game) emit(typ string, payload string) {
+	evt := Event{
+		Timestamp: time.Now(),
+		GameID:    g.ID,
+		Type:      typ,
+		Payload:   payload,
+	}
+	go func() {
+		g.Events <- evt
+	}()
+}
+
+// Reset kills the container. The session marks the game as not ready
+// before calling it.
 func (g *Game) Reset(ctx context.Context) error {
-	g.Ready = false
+	atomic.StoreInt32(&g.killed, 1)
+	g.rconMu.Lock()
+	if g.rcon != nil {
+		g.rcon.Close()
+		g.rcon = nil
+	}
+	g.rconMu.Unlock()
+	if g.StopTimeout > 0 {
+		// the session moves on to another replica without waiting for
+		// the world to be saved
+		go func() {
+			err := g.stopContainer(ctx)
+			if err != nil && !client.IsErrNotFound(err) {
+				log.Printf("[%s] error stopping container: %s", g.Name, err)
+			}
+		}()
+		return nil
+	}
+	ctx, cancel := g.apiContext(ctx)
+	defer cancel()
 	err := g.Client.ContainerKill(ctx, g.Name, "KILL")
 	if err != nil {
 		return err
 	}
 	return nil
 }
+
+// Stop kills the container on exit, or stops it gracefully if StopTimeout
+// is set, without the session bookkeeping of Reset.
+func (g *Game) Stop(ctx context.Context) error {
+	atomic.StoreInt32(&g.killed, 1)
+	if g.StopTimeout > 0 {
+		return g.stopContainer(ctx)
+	}
+	ctx, cancel := g.apiContext(ctx)
+	defer cancel()
+	return g.Client.ContainerKill(ctx, g.Name, "KILL")
+}
+
+// stopContainer sends the container SIGTERM and waits for it to exit,
+// killing it after StopTimeout. DockerTimeout bounds the call beyond that.
+func (g *Game) stopContainer(ctx context.Context) error {
+	timeout := g.StopTimeout
+	apiTimeout := g.DockerTimeout
+	if apiTimeout > 0 {
+		apiTimeout += timeout
+	}
+	ctx, cancel := apiContext(ctx, apiTimeout)
+	defer cancel()
+	return g.Client.ContainerStop(ctx, g.Name, &timeout)
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/errdefs"
+)
+
+func TestParsePosition(t *testing.T) {
+	tests := []struct {
+		text string
+		pos  string
+	}{
+		{"alice has the following entity data: [12.5d, 64.0d, -8.25d]", "12, 64, -9"},
+		{"alice has the following entity data: [-0.5d, 70d, 0.99d]", "-1, 70, 0"},
+		{"alice has the following entity data: [1.2.3d, 64.0d, 0d]", ""},
+	}
+	for _, tt := range tests {
+		if pos := parsePosition(tt.text); pos != tt.pos {
+			t.Errorf("parsePosition(%q) = %q, want %q", tt.text, pos, tt.pos)
+		}
+	}
+}
+
+func TestParseDimension(t *testing.T) {
+	tests := []struct {
+		dimension string
+		want      string
+		ok        bool
+	}{
+		{"the_nether", "minecraft:the_nether", true},
+		{"minecraft:overworld", "minecraft:overworld", true},
+		{"mymod:deep/dark", "mymod:deep/dark", true},
+		{"The End", "", false},
+		{"@a] run kill @a[", "", false},
+	}
+	for _, tt := range tests {
+		got, err := ParseDimension(tt.dimension)
+		if got != tt.want || (err == nil) != tt.ok {
+			t.Errorf("ParseDimension(%q) = %q, %v, want %q", tt.dimension, got, err, tt.want)
+		}
+	}
+}
+
+func TestRunDimension(t *testing.T) {
+	tests := []struct {
+		state     string
+		dimension string
+	}{
+		{"", "minecraft:overworld"},
+		{"login", "minecraft:overworld"},
+		{"nether", "minecraft:the_nether"},
+		{"end", "minecraft:the_end"},
+		{"credits", "minecraft:overworld"},
+	}
+	for _, tt := range tests {
+		if dimension := runDimension(tt.state); dimension != tt.dimension {
+			t.Errorf("runDimension(%q) = %q, want %q", tt.state, dimension, tt.dimension)
+		}
+	}
+}
+
+func TestGenSlots(t *testing.T) {
+	slots := make(chan struct{}, 1)
+	a := &Game{Name: "mcspeedrun_0", GenSlots: slots}
+	b := &Game{Name: "mcspeedrun_1", GenSlots: slots}
+
+	tests := []struct {
+		name    string
+		do      func()
+		game    *Game
+		acquire bool
+	}{
+		{"free slot", func() {}, a, true},
+		{"taken slot", func() {}, b, false},
+		{"released slot", a.releaseSlot, b, true},
+		// releasing twice doesn't free the slot b holds
+		{"released twice", a.releaseSlot, a, false},
+	}
+	for _, tt := range tests {
+		tt.do()
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		acquired := tt.game.acquireSlot(ctx)
+		cancel()
+		if acquired != tt.acquire {
+			t.Errorf("%s: acquired %t, want %t", tt.name, acquired, tt.acquire)
+		}
+	}
+}
+
+func TestMatchSave(t *testing.T) {
+	events := make(chan Event, 1)
+	g := &Game{Events: events, Patterns: &PatternSet{}}
+	tests := []struct {
+		text string
+		typ  string
+	}{
+		{"Saving...", "save"},
+		{"Saved the game", "save"},
+		{"Saving chunks for level 'ServerLevel[world]'/minecraft:overworld", ""},
+	}
+	for _, tt := range tests {
+		g.HandleLog("[12:00:00] [Server thread/INFO]: " + tt.text)
+		var typ string
+		select {
+		case evt := <-events:
+			typ = evt.Type
+		default:
+		}
+		if typ != tt.typ {
+			t.Errorf("HandleLog(%q) sent %q, want %q", tt.text, typ, tt.typ)
+		}
+	}
+}
+
+func TestHandleLogMatched(t *testing.T) {
+	patterns := Patterns{
+		Milestones: (&Config{}).MilestoneSet(),
+		Events:     []CustomEvent{{Name: "trade", Pattern: `traded (\d+) pearls`}},
+	}
+	err := patterns.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &Game{Name: "mcspeedrun_0", Events: make(chan Event, 1), Patterns: &PatternSet{}}
+	g.ResetCommand, g.SplitCommand, g.PauseCommand, g.ResumeCommand = "rr", "split", "pause", "resume"
+	g.Patterns.Set(patterns)
+
+	tests := []struct {
+		text    string
+		typ     string
+		matched string
+	}{
+		{"alice has made the advancement [The End?]", "end", "builtin:[The End?]"},
+		{"alice has made the advancement [Into Fire]", "blazerods", "milestone:blazerods"},
+		{"alice traded 12 pearls", "custom.trade", "event:trade"},
+		{"<alice> rr", "cmd.reset", "builtin:> rr"},
+		{"<alice> pause", "cmd.pause", "builtin:> pause"},
+		{"<alice> resume", "cmd.resume", "builtin:> resume"},
+		{"<alice> split blind", "cmd.split", "builtin:> split"},
+		{"[Not Secure] <alice> rr", "cmd.reset", "builtin:> rr"},
+	}
+	for _, tt := range tests {
+		g.HandleLog("[12:34:56] [Server thread/INFO]: " + tt.text)
+		select {
+		case evt := <-g.Events:
+			if evt.Type != tt.typ || evt.Matched != tt.matched {
+				t.Errorf("%q: '%s' matched %q, want '%s' matched %q", tt.text, evt.Type, evt.Matched, tt.typ, tt.matched)
+			}
+		default:
+			t.Errorf("%q: no event", tt.text)
+		}
+	}
+}
+
+func TestHandleLogChatCommands(t *testing.T) {
+	g := &Game{Name: "mcspeedrun_0", Events: make(chan Event, 1), Patterns: &PatternSet{}}
+	g.ResetCommand, g.SplitCommand, g.PauseCommand, g.ResumeCommand = "!reset", "!split", "!pause", "!resume"
+
+	tests := []struct {
+		text string
+		typ  string
+	}{
+		{"<alice> !reset", "cmd.reset"},
+		{"<alice> !split blind", "cmd.split"},
+		{"<alice> rr", ""},
+		{"<alice> !reset later", ""},
+		{"<alice> I said !pause", ""},
+		{"<alice> <bob> !resume", ""},
+		{"alice said <bob> !reset", ""},
+		{"<alice> !split", ""},
+	}
+	for _, tt := range tests {
+		g.HandleLog("[12:34:56] [Server thread/INFO]: " + tt.text)
+		typ := ""
+		select {
+		case evt := <-g.Events:
+			typ = evt.Type
+		default:
+		}
+		if typ != tt.typ {
+			t.Errorf("HandleLog(%q) emitted %q, want %q", tt.text, typ, tt.typ)
+		}
+	}
+}
+
+func TestHandleLogIgnored(t *testing.T) {
+	patterns := Patterns{Ignore: []string{`Can't keep up`, `/WARN\]: `}}
+	err := patterns.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &Game{Name: "mcspeedrun_0", Events: make(chan Event, 1), Patterns: &PatternSet{}}
+	g.Patterns.Set(patterns)
+
+	tests := []struct {
+		line string
+		typ  string
+	}{
+		{"[12:34:56] [Server thread/INFO]: alice joined the game", "login"},
+		{"[12:34:56] [Server thread/WARN]: alice joined the game", ""},
+		{"[12:34:56] [Server thread/INFO]: Can't keep up! alice joined the game", ""},
+	}
+	for _, tt := range tests {
+		g.HandleLog(tt.line)
+		typ := ""
+		select {
+		case evt := <-g.Events:
+			typ = evt.Type
+		default:
+		}
+		if typ != tt.typ {
+			t.Errorf("HandleLog(%q) emitted %q, want %q", tt.line, typ, tt.typ)
+		}
+	}
+}
+
+func TestStartPullsMissingImage(t *testing.T) {
+	f := &fakeDocker{noImage: true}
+	g := &Game{Name: "mcspeedrun_0", Image: "mc:latest", Client: f, Events: make(chan Event, 2), PullMu: &sync.Mutex{}}
+	for i := 0; i < 2; i++ {
+		err := g.Start(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if pulled := f.Pulled(); len(pulled) != 1 || pulled[0] != "mc:latest" {
+		t.Errorf("pulled %q, want mc:latest once", pulled)
+	}
+	if n := len(f.Created()); n != 2 {
+		t.Errorf("created %d containers, want 2", n)
+	}
+}
+
+// inspectClient answers each ContainerInspect with the next of states, the
+// last one repeating, or with err. Containers have the network settings of
+// settings.
+type inspectClient struct {
+	fakeDocker
+	states   []types.ContainerState
+	settings types.DefaultNetworkSettings
+	err      error
+}
+
+func (c *inspectClient) ContainerInspect(ctx context.Context, container string) (types.ContainerJSON, error) {
+	if c.err != nil {
+		return types.ContainerJSON{}, c.err
+	}
+	var state types.ContainerState
+	if len(c.states) > 0 {
+		state = c.states[0]
+	}
+	if len(c.states) > 1 {
+		c.states = c.states[1:]
+	}
+	return types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{State: &state},
+		NetworkSettings:   &types.NetworkSettings{DefaultNetworkSettings: c.settings},
+	}, nil
+}
+
+func TestCrashed(t *testing.T) {
+	running := types.ContainerState{Running: true}
+	exited := types.ContainerState{ExitCode: 1}
+	tests := []struct {
+		name    string
+		client  *inspectClient
+		grace   time.Duration
+		killed  bool
+		reason  string
+		crashed bool
+	}{
+		{"log hiccup", &inspectClient{states: []types.ContainerState{running}}, 0, false, "", false},
+		{"exited", &inspectClient{states: []types.ContainerState{exited}}, 0, false, "exit code 1", true},
+		{"out of memory", &inspectClient{states: []types.ContainerState{{ExitCode: 137, OOMKilled: true}}}, 0, false, "exit code 137 (out of memory)", true},
+		{"removed", &inspectClient{err: errdefs.NotFound(errors.New("no such container"))}, 0, false, "container removed", true},
+		{"reset", &inspectClient{states: []types.ContainerState{exited}}, 0, true, "exit code 1", false},
+		{"inspect error", &inspectClient{err: errors.New("timeout")}, 0, false, "", false},
+		{"exited within the grace", &inspectClient{states: []types.ContainerState{running, exited}}, 5 * time.Second, false, "exit code 1", true},
+	}
+	for _, tt := range tests {
+		g := &Game{Name: "mcspeedrun_0", Client: tt.client, CrashGrace: tt.grace}
+		if tt.killed {
+			g.killed = 1
+		}
+		reason, crashed := g.crashed(context.Background())
+		if reason != tt.reason || crashed != tt.crashed {
+			t.Errorf("%s: crashed %q, %t, want %q, %t", tt.name, reason, crashed, tt.reason, tt.crashed)
+		}
+	}
+}
+
+func TestParseLogLine(t *testing.T) {
+	tests := []struct {
+		line string
+		time string
+		text string
+		ok   bool
+	}{
+		{"[12:34:56] [Server thread/INFO]: alice joined the game", "0000-01-01T12:34:56Z", "alice joined the game", true},
+		{"[12:34:56 INFO]: alice joined the game", "0000-01-01T12:34:56Z", "alice joined the game", true},
+		{"[2020-01-02T12:34:56.789] [Server thread/INFO]: alice joined the game", "2020-01-02T12:34:56.789Z", "alice joined the game", true},
+		{"2020-01-02 12:34:56 [Server thread/INFO]: alice joined the game", "2020-01-02T12:34:56Z", "alice joined the game", true},
+		{"Starting minecraft server version 1.16.4", "", "", false},
+	}
+	for _, tt := range tests {
+		lt, text, ok := parseLogLine(tt.line)
+		if ok != tt.ok || text != tt.text {
+			t.Errorf("parseLogLine(%q) = %q, %v, want %q, %v", tt.line, text, ok, tt.text, tt.ok)
+			continue
+		}
+		if ok && lt.Format(time.RFC3339Nano) != tt.time {
+			t.Errorf("parseLogLine(%q) time %s, want %s", tt.line, lt.Format(time.RFC3339Nano), tt.time)
+		}
+	}
+}
+
+func TestLogTime(t *testing.T) {
+	day := func(d, h, m, s int) time.Time {
+		return time.Date(2020, 1, d, h, m, s, 0, time.UTC)
+	}
+	tests := []struct {
+		name    string
+		now     time.Time
+		lines   []string
+		want    []time.Time
+		elapsed time.Duration
+	}{
+		{
+			"same day",
+			day(1, 12, 0, 0),
+			[]string{"11:59:00", "12:00:00"},
+			[]time.Time{day(1, 11, 59, 0), day(1, 12, 0, 0)},
+			time.Minute,
+		},
+		{
+			"run crossing midnight",
+			day(1, 23, 59, 59),
+			[]string{"23:59:59", "00:00:05"},
+			[]time.Time{day(1, 23, 59, 59), day(2, 0, 0, 5)},
+			6 * time.Second,
+		},
+		{
+			"first line from before midnight",
+			day(2, 0, 0, 3),
+			[]string{"23:59:59", "00:00:05"},
+			[]time.Time{day(1, 23, 59, 59), day(2, 0, 0, 5)},
+			6 * time.Second,
+		},
+		{
+			"first line from after midnight",
+			day(1, 23, 59, 58),
+			[]string{"00:00:01"},
+			[]time.Time{day(2, 0, 0, 1)},
+			0,
+		},
+	}
+	for _, tt := range tests {
+		g := &Game{}
+		var first time.Time
+		for i, line := range tt.lines {
+			lt, err := time.Parse("15:04:05", line)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := g.logTime(lt, tt.now)
+			if !got.Equal(tt.want[i]) {
+				t.Errorf("%s: line %d at %s is %s, want %s", tt.name, i, line, got, tt.want[i])
+			}
+			if i == 0 {
+				first = got
+			}
+		}
+		if elapsed := g.lastLog.Sub(first); elapsed != tt.elapsed {
+			t.Errorf("%s: elapsed %s, want %s", tt.name, elapsed, tt.elapsed)
+		}
+	}
+}
+
+func TestLogCursor(t *testing.T) {
+	var c logCursor
+	if since := c.Since(); since != "" {
+		t.Errorf("fresh cursor resumes from %q", since)
+	}
+
+	// a reopened stream replays the lines up to the last one consumed
+	tests := []struct {
+		line  string
+		text  string
+		isNew bool
+		since string
+	}{
+		{"2020-01-02T12:34:56.000000001Z [12:34:56] alice joined the game", "[12:34:56] alice joined the game", true, "1577968496.000000001"},
+		{"2020-01-02T12:35:00.5Z [12:35:00] Saved the game", "[12:35:00] Saved the game", true, "1577968500.500000000"},
+		{"2020-01-02T12:35:00.5Z [12:35:00] Saved the game", "", false, "1577968500.500000000"},
+		{"2020-01-02T12:34:56.000000001Z [12:34:56] alice joined the game", "", false, "1577968500.500000000"},
+		{"no timestamp", "no timestamp", true, "1577968500.500000000"},
+		{"2020-01-02T12:36:00Z [12:36:00] alice left the game", "[12:36:00] alice left the game", true, "1577968560.000000000"},
+	}
+	for _, tt := range tests {
+		text, isNew := c.Next(tt.line)
+		if text != tt.text || isNew != tt.isNew {
+			t.Errorf("Next(%q) = %q, %t, want %q, %t", tt.line, text, isNew, tt.text, tt.isNew)
+		}
+		if since := c.Since(); since != tt.since {
+			t.Errorf("after %q: since %q, want %q", tt.line, since, tt.since)
+		}
+	}
+}
+
+func TestRefreshAddress(t *testing.T) {
+	dual := types.DefaultNetworkSettings{IPAddress: "172.17.0.2", GlobalIPv6Address: "2001:db8::2"}
+	tests := []struct {
+		name     string
+		network  string
+		ipv6     bool
+		settings types.DefaultNetworkSettings
+		addr     string
+	}{
+		{"IPv4", "", false, dual, "172.17.0.2"},
+		{"IPv6", "", true, dual, "2001:db8::2"},
+		{"IPv6 without an address", "", true, types.DefaultNetworkSettings{IPAddress: "172.17.0.2"}, "172.17.0.2"},
+		{"network", "speedrun", true, dual, "mcspeedrun_0"},
+	}
+	for _, tt := range tests {
+		g := &Game{
+			Name:    "mcspeedrun_0",
+			Client:  &inspectClient{settings: tt.settings},
+			Network: tt.network,
+			IPv6:    tt.ipv6,
+		}
+		addr, err := g.Refresh(context.Background())
+		if err != nil || addr != tt.addr {
+			t.Errorf("%s: address %q, %v, want %q", tt.name, addr, err, tt.addr)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Attempt is the recorded timeline of a single attempt, from login until it
+// is reset or completed.
+type Attempt struct {
+	Number int             `json:"number"`
+	Start  time.Time       `json:"start"`
+	Events []TimelineEvent `json:"events"`
+	Splits []Split         `json:"splits"`
+
+	// Seed is the world's seed, if one was configured.
+	Seed string `json:"seed,omitempty"`
+
+	// Result is the furthest state the attempt reached, e.g. "nether" or
+	// "credits" for a completed run. It is empty while in progress.
+	Result string `json:"result"`
+}
+
+// TimelineEvent is an event within an attempt, timed relative to its start.
+type TimelineEvent struct {
+	Type    string        `json:"type"`
+	Time    time.Duration `json:"time"`
+	Payload string        `json:"payload,omitempty"`
+}
+
+// startAttempt begins recording a new attempt. It is called by Loop() on
+// login.
+func (s *Session) startAttempt(evt Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.current = &Attempt{
+		Number: s.Data.Attempt,
+		Start:  evt.Timestamp,
+	}
+	if s.active != nil {
+		s.current.Seed = s.active.WorldSeed
+	}
+}
+
+// recordEvent appends an event to the attempt in progress, if any.
+func (s *Session) recordEvent(evt Event) {
+	if s.current == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.current.Events = append(s.current.Events, TimelineEvent{
+		Type:    evt.Type,
+		Time:    evt.Timestamp.Sub(s.current.Start),
+		Payload: evt.Payload,
+	})
+}
+
+// recordSplit appends a split to the attempt in progress, if any.
+func (s *Session) recordSplit(split Split) {
+	if s.current == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.current.Splits = append(s.current.Splits, split)
+}
+
+// hasSplit reports whether the attempt in progress has a split with the given
+// name.
+func (s *Session) hasSplit(name string) bool {
+	if s.current == nil {
+		return false
+	}
+	for _, split := range s.current.Splits {
+		if split.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// finishAttempt moves the attempt in progress, if any, into the session
+// history with the current state as its result.
+func (s *Session) finishAttempt() {
+	if s.current == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.current.Result = s.state
+	s.Data.History = append(s.Data.History, *s.current)
+	s.current = nil
+}
+
+// Attempt returns a copy of the attempt with the given number, including the
+// one in progress, or false if there is none.
+func (s *Session) Attempt(n int) (Attempt, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.current != nil && s.current.Number == n {
+		return *s.current, true
+	}
+	for i := len(s.Data.History) - 1; i >= 0; i-- {
+		if s.Data.History[i].Number == n {
+			return s.Data.History[i], true
+		}
+	}
+	return Attempt{}, false
+}
+
+// History returns a copy of the finished attempts, oldest first.
+func (s *Session) History() []Attempt {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]Attempt(nil), s.Data.History...)
+}
+
+// Notes returns a copy of the attempt notes, by attempt number.
+func (s *Session) Notes() map[int]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	notes := make(map[int]string, len(s.Data.Notes))
+	for n, note := range s.Data.Notes {
+		notes[n] = note
+	}
+	return notes
+}
+
+// HistoryRow is an attempt's summary in the history export. Splits maps each
+// split reached to its time in seconds.
+type HistoryRow struct {
+	Number int                `json:"number"`
+	Seed   string             `json:"seed,omitempty"`
+	Start  time.Time          `json:"start"`
+	Result string             `json:"result"`
+	Note   string             `json:"note,omitempty"`
+	Splits map[string]float64 `json:"splits"`
+}
+
+// historyRows summarizes attempts for export, with their notes. Attempts
+// reset before any split are included with no splits.
+func historyRows(attempts []Attempt, notes map[int]string) []HistoryRow {
+	rows := make([]HistoryRow, len(attempts))
+	for i, a := range attempts {
+		rows[i] = HistoryRow{
+			Number: a.Number,
+			Seed:   a.Seed,
+			Start:  a.Start,
+			Result: a.Result,
+			Note:   notes[a.Number],
+			Splits: make(map[string]float64, len(a.Splits)),
+		}
+		for _, split := range a.Splits {
+			rows[i].Splits[split.Name] = split.Time.Seconds()
+		}
+	}
+	return rows
+}
+
+// historySplits returns every split name in attempts, in the order first seen.
+func historySplits(attempts []Attempt) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, a := range attempts {
+		for _, split := range a.Splits {
+			if !seen[split.Name] {
+				seen[split.Name] = true
+				names = append(names, split.Name)
+			}
+		}
+	}
+	return names
+}
+
+// writeHistoryCSV writes attempts and their notes as CSV with a column per
+// split, in seconds. Splits an attempt didn't reach are left blank.
+func writeHistoryCSV(w io.Writer, attempts []Attempt, notes map[int]string) error {
+	names := historySplits(attempts)
+	cw := csv.NewWriter(w)
+	cw.Write(append([]string{"attempt", "seed", "start", "result", "note"}, names...))
+	for _, row := range historyRows(attempts, notes) {
+		record := []string{
+			fmt.Sprint(row.Number),
+			row.Seed,
+			row.Start.Format(time.RFC3339),
+			row.Result,
+			row.Note,
+		}
+		for _, name := range names {
+			cell := ""
+			if t, ok := row.Splits[name]; ok {
+				cell = fmt.Sprintf("%.3f", t)
+			}
+			record = append(record, cell)
+		}
+		cw.Write(record)
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// liveSplitTimeout bounds connecting and sending to the LiveSplit server.
+const liveSplitTimeout = 2 * time.Second
+
+// LiveSplit drives a LiveSplit Server component from the session's timer
+// events. Before each split the game time is set to the run's elapsed time,
+// so LiveSplit's game time comparison matches the splits announced in chat.
+type LiveSplit struct {
+	Addr string
+
+	conn    net.Conn
+	running bool
+}
+
+// NewLiveSplit returns a sink sending commands to the LiveSplit server at
+// addr. It connects on the first event and reconnects after errors.
+func NewLiveSplit(addr string) *LiveSplit {
+	return &LiveSplit{Addr: addr}
+}
+
+func (l *LiveSplit) Handle(ctx context.Context, evt Event) {
+	var commands []string
+	switch evt.Type {
+	case "timer.start":
+		if l.running {
+			commands = append(commands, "reset")
+		}
+		commands = append(commands, "starttimer", "initgametime")
+		l.running = true
+	case "timer.split", "timer.finish":
+		elapsed, ok := timerElapsed(evt.Payload)
+		if !ok {
+			return
+		}
+		commands = append(commands, "setgametime "+liveSplitTime(elapsed), "split")
+	case "timer.pause":
+		commands = append(commands, "pause")
+	case "timer.resume":
+		commands = append(commands, "resume")
+	case "timer.reset":
+		commands = append(commands, "reset")
+		l.running = false
+	default:
+		return
+	}
+
+	for _, cmd := range commands {
+		err := l.send(cmd)
+		if err != nil {
+			log.Printf("[livesplit] error sending %q: %s", cmd, err)
+			return
+		}
+	}
+}
+
+// send writes a command, connecting first if needed. The connection is
+// dropped on error so the next command reconnects.
+func (l *LiveSplit) send(cmd string) error {
+	if l.conn == nil {
+		conn, err := net.DialTimeout("tcp", l.Addr, liveSplitTimeout)
+		if err != nil {
+			return err
+		}
+		l.conn = conn
+	}
+	l.conn.SetWriteDeadline(time.Now().Add(liveSplitTimeout))
+	_, err := fmt.Fprintf(l.conn, "%s\r\n", cmd)
+	if err != nil {
+		l.conn.Close()
+		l.conn = nil
+	}
+	return err
+}
+
+// timerElapsed parses the elapsed time from a timer event's payload, e.g.
+// "time=95500 split=Nether".
+func timerElapsed(payload string) (time.Duration, bool) {
+	fields := strings.Fields(payload)
+	if len(fields) == 0 || !strings.HasPrefix(fields[0], "time=") {
+		return 0, false
+	}
+	ms, err := strconv.ParseInt(strings.TrimPrefix(fields[0], "time="), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return time.Duration(ms) * time.Millisecond, true
+}
+
+// liveSplitTime formats a duration as h:mm:ss.fff for LiveSplit.
+func liveSplitTime(d time.Duration) string {
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLiveSplit(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	received := make(chan string, 100)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					received <- line
+				}
+			}()
+		}
+	}()
+
+	l := NewLiveSplit(ln.Addr().String())
+	defer func() {
+		if l.conn != nil {
+			l.conn.Close()
+		}
+	}()
+	for _, evt := range []Event{
+		{Type: "timer.start", Payload: "time=0"},
+		{Type: "nether", Payload: "alice has made the advancement [We Need to Go Deeper]"},
+		{Type: "timer.split", Payload: "time=83456 split=Nether"},
+		{Type: "timer.pause", Payload: "time=90000"},
+		{Type: "timer.resume", Payload: "time=90000"},
+		{Type: "timer.finish", Payload: "time=3754321"},
+		// a new attempt while the last is still on the timer resets it first
+		{Type: "timer.start", Payload: "time=0"},
+		{Type: "timer.split", Payload: "time=60000 split=Nether"},
+		{Type: "timer.reset", Payload: "time=65000"},
+		{Type: "timer.start", Payload: "time=0"},
+	} {
+		l.Handle(context.Background(), evt)
+	}
+
+	want := []string{
+		"starttimer", "initgametime",
+		"setgametime 0:01:23.456", "split",
+		"pause",
+		"resume",
+		"setgametime 1:02:34.321", "split",
+		"reset", "starttimer", "initgametime",
+		"setgametime 0:01:00.000", "split",
+		"reset",
+		"starttimer", "initgametime",
+	}
+	var got []string
+	timeout := time.After(5 * time.Second)
+	for len(got) < len(want) {
+		select {
+		case line := <-received:
+			if !strings.HasSuffix(line, "\r\n") {
+				t.Errorf("command %q isn't terminated by CRLF", line)
+			}
+			got = append(got, strings.TrimSuffix(line, "\r\n"))
+		case <-timeout:
+			t.Fatalf("received %q, want %q", got, want)
+		}
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("command %d is %q, want %q", i, got[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log formats for -log-format.
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// jsonLog, if set, receives all logging as JSON lines instead of text.
+var jsonLog *jsonLogger
+
+// SetLogFormat switches logging to the given format.
+func SetLogFormat(format string, w io.Writer) error {
+	switch format {
+	case LogFormatText:
+	case LogFormatJSON:
+		jsonLog = &jsonLogger{w: w}
+		log.SetFlags(0)
+		log.SetOutput(jsonLog)
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	return nil
+}
+
+// logEvent logs a message from component about an event. In text mode it is
+// the same as log.Printf with a "[component]" prefix; in JSON mode the game
+// ID and event type are logged as fields of their own.
+func logEvent(component string, evt Event, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if jsonLog == nil {
+		log.Printf("[%s] %s", component, msg)
+		return
+	}
+	entry := newLogEntry(component, msg)
+	entry.GameID = &evt.GameID
+	entry.EventType = evt.Type
+	jsonLog.write(entry)
+}
+
+// logEntry is a line of JSON logging.
+type logEntry struct {
+	Time      time.Time `json:"time"`
+	Component string    `json:"component,omitempty"`
+	GameID    *int      `json:"game_id,omitempty"`
+	EventType string    `json:"event_type,omitempty"`
+	Msg       string    `json:"msg"`
+}
+
+// gameComponent matches the names games log under, e.g. "mcspeedrun_0".
+var gameComponent = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*_(\d+)$`)
+
+// newLogEntry creates an entry for a message from component. Messages from a
+// game are logged under the "game" component with its ID.
+func newLogEntry(component string, msg string) logEntry {
+	entry := logEntry{
+		Time:      time.Now(),
+		Component: component,
+		Msg:       msg,
+	}
+	if m := gameComponent.FindStringSubmatch(component); m != nil {
+		id, err := strconv.Atoi(m[1])
+		if err == nil {
+			entry.Component = "game"
+			entry.GameID = &id
+		}
+	}
+	return entry
+}
+
+// logPrefix matches the "[component]" prefix of a log line.
+var logPrefix = regexp.MustCompile(`^\[([^\]]+)\],? ?`)
+
+// jsonLogger converts lines written by the log package to JSON, taking the
+// component from the line's "[component]" prefix.
+type jsonLogger struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *jsonLogger) Write(p []byte) (int, error) {
+	line := strings.TrimSuffix(string(p), "\n")
+	component := ""
+	if m := logPrefix.FindStringSubmatch(line); m != nil {
+		component = m[1]
+		line = line[len(m[0]):]
+	}
+	l.write(newLogEntry(component, line))
+	return len(p), nil
+}
+
+// write writes an entry as a single line.
+func (l *jsonLogger) write(entry logEntry) {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(append(b, '\n'))
+}
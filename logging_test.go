@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+// captureLog sends logging to a buffer in the given format for the rest of
+// the test.
+func captureLog(t *testing.T, format string) *bytes.Buffer {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	err := SetLogFormat(format, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		jsonLog = nil
+		log.SetFlags(log.LstdFlags)
+		log.SetOutput(os.Stderr)
+	})
+	return &buf
+}
+
+func TestSetLogFormat(t *testing.T) {
+	err := SetLogFormat("xml", os.Stderr)
+	if err == nil || jsonLog != nil {
+		t.Errorf("unknown format: error %v", err)
+	}
+
+	buf := captureLog(t, LogFormatText)
+	log.SetFlags(0)
+	logEvent("core", Event{GameID: 0, Type: "nether"}, "received '%s' from %d", "nether", 0)
+	if got, want := buf.String(), "[core] received 'nether' from 0\n"; got != want {
+		t.Errorf("text log %q, want %q", got, want)
+	}
+}
+
+func TestJSONLog(t *testing.T) {
+	buf := captureLog(t, LogFormatJSON)
+	log.Printf("[core] server %d is online", 1)
+	log.Printf("[mcspeedrun_2] Done (3.2s)!")
+	log.Printf("[proxy], client disconnected")
+	log.Printf("no component")
+	logEvent("core", Event{GameID: 0, Type: "nether"}, "received '%s' from %d", "nether", 0)
+	logEvent("mcspeedrun_1", Event{GameID: 1, Type: "login"}, "%s", "alice joined the game")
+
+	// fields are written out with %v, absent ones as <nil>
+	want := []string{
+		"core <nil> <nil> server 1 is online",
+		"game 2 <nil> Done (3.2s)!",
+		"proxy <nil> <nil> client disconnected",
+		"<nil> <nil> <nil> no component",
+		"core 0 nether received 'nether' from 0",
+		"game 1 login alice joined the game",
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != len(want) {
+		t.Fatalf("logged %d lines, want %d:\n%s", len(lines), len(want), buf)
+	}
+	for i, line := range lines {
+		var entry map[string]interface{}
+		err := json.Unmarshal([]byte(line), &entry)
+		if err != nil {
+			t.Errorf("line %d %q: %s", i, line, err)
+			continue
+		}
+		if ts, _ := entry["time"].(string); ts == "" {
+			t.Errorf("line %d %q has no time", i, line)
+		}
+		got := fmt.Sprintf("%v %v %v %v", entry["component"], entry["game_id"], entry["event_type"], entry["msg"])
+		if got != want[i] {
+			t.Errorf("line %d is %q, want %q", i, got, want[i])
+		}
+	}
+}
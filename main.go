@@ -3,25 +3,172 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"os"
 	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/docker/docker/client"
 )
 
 var (
 	flagReplicas int
+	flagMaxGen   int
+	flagWarm     int
+	flagMaxRepl  int
+	flagLimit    int
+	flagBench    int
 	flagImage    string
+	flagConfig   string
+	flagMemory   string
+	flagMemSwap  string
+	flagCPUs     float64
+	flagKeep     bool
+	flagCrash    time.Duration
+	flagTemplate string
+	flagDataDir  string
+	flagCategory string
+	flagRebuild  string
+	flagReplay   string
+	flagRealtime bool
+	flagLevelEnv string
+	flagProxy    string
+	flagPort     int
+	flagSrvPort  int
+	flagPROXY    bool
+	flagIPv6     bool
+	flagNetwork  string
+	flagExport   string
+	flagWebhook  string
+	flagSeed     string
+	flagAPIAddr  string
+	flagDashAddr string
+	flagAPIToken string
+	flagPprof    bool
+
+	flagSpectatorAddr string
+	flagProxyControl  string
+	flagProxyOnly     bool
+	flagProxyHosts    string
+	flagStatus        bool
+	flagMOTD          string
+	flagProxyIdle     time.Duration
+	flagDialRetries   int
+	flagConnRate      int
+	flagConnInterval  time.Duration
+	flagMaxConns      int
+	flagProxyGrace    time.Duration
+	flagDrainGrace    time.Duration
+	flagReconnect     time.Duration
+	flagCaptureDir    string
+	flagIdlePause     time.Duration
+	flagPauseEmpty    time.Duration
+	flagHeartbeat     time.Duration
+	flagStatsdAddr    string
+	flagDogStatsD     bool
+	flagSplitCoords   bool
+	flagSplitDim      string
+
+	flagShutdownCommands string
+	flagShutdownTimeout  time.Duration
+	flagStopOnExit       bool
+	flagBackupDir        string
+	flagAutoReset        time.Duration
+	flagResetDebounce    time.Duration
+	flagSwitchPolicy     string
+	flagSelectPolicy     string
+	flagLogFormat        string
+	flagDockerTimeout    time.Duration
+	flagStopTimeout      time.Duration
+	flagReissueSaveOff   bool
+	flagEventLog         string
+	flagMetricsAddr      string
+	flagLiveSplit        string
 )
 
 func main() {
 	flag.IntVar(&flagReplicas, "replicas", 2, "number of replicas")
+	flag.IntVar(&flagMaxGen, "max-concurrent-gen", 0, "maximum number of worlds generating at once (unlimited if 0)")
+	flag.IntVar(&flagWarm, "warm", 0, "number of replicas to keep generated besides the active one, adding replicas as needed")
+	flag.IntVar(&flagMaxRepl, "max-replicas", 0, "maximum number of replicas when keeping warm ones (default replicas or warm+1)")
+	flag.IntVar(&flagLimit, "replica-limit", DefaultReplicaLimit, "refuse to run more replicas than this, counting warm ones")
+	flag.IntVar(&flagBench, "benchmark", 0, "generate this many worlds, print generation time statistics, and exit")
 	flag.StringVar(&flagImage, "image", "tigres/minecraft-fabric:latest", "docker image for servers")
+	flag.StringVar(&flagMemory, "memory", DefaultMemory, "memory limit for each server, e.g. 4g (unlimited if 0)")
+	flag.StringVar(&flagMemSwap, "memory-swap", "", "memory plus swap limit for each server (-1 for unlimited swap; docker's default if empty)")
+	flag.Float64Var(&flagCPUs, "cpus", DefaultCPUs, "CPU limit for each server (unlimited if 0)")
+	flag.BoolVar(&flagKeep, "keep-containers", false, "keep stopped server containers for inspection instead of removing them")
+	flag.DurationVar(&flagCrash, "crash-grace", 5*time.Second, "how long a server may keep running after its logs end before it isn't considered crashed")
+	flag.StringVar(&flagTemplate, "world-template", "", "world directory copied into each server instead of generating a new world")
+	flag.StringVar(&flagDataDir, "data-dir", "/data", "server directory in the container that holds the world")
+	flag.StringVar(&flagConfig, "config", "", "path to a JSON or YAML config file")
+	flag.StringVar(&flagRebuild, "rebuild-from", "", "rebuild state.json from this event log and exit")
+	flag.StringVar(&flagReplay, "replay", "", "run the state machine over this server log without Docker, print the attempts and exit")
+	flag.BoolVar(&flagRealtime, "replay-realtime", false, "replay the log at the pace of its timestamps")
+	flag.StringVar(&flagCategory, "category", "", "path to a JSON category rules file (any% if empty)")
+	flag.StringVar(&flagSeed, "seed", "", "world seed for every server, or \"random\" to generate and record one per world (image default if empty)")
+	flag.StringVar(&flagProxy, "proxy-addr", DefaultProxyAddr, "address the proxy listens on")
+	flag.IntVar(&flagPort, "proxy-port", DefaultProxyPort, "port the proxy listens on")
+	flag.IntVar(&flagSrvPort, "server-port", DefaultServerPort, "port the servers listen on inside their containers")
+	flag.BoolVar(&flagPROXY, "proxy-protocol", false, "send servers a PROXY protocol v2 header with each player's address")
+	flag.StringVar(&flagWebhook, "webhook-url", "", "Discord or Slack webhook to post splits and finished runs to (disabled if empty)")
+	flag.StringVar(&flagExport, "export-dir", "", "export the world of each completed run to a directory under this one (disabled if empty)")
+	flag.StringVar(&flagNetwork, "network", "", "Docker network to attach servers to, reaching them by container name (created if missing)")
+	flag.BoolVar(&flagIPv6, "ipv6", false, "connect to servers on their global IPv6 address")
+	flag.StringVar(&flagLevelEnv, "level-env", "", "container env var used to give each replica its own world name (e.g. LEVEL)")
+	flag.StringVar(&flagAPIAddr, "api-addr", "", "listen address for the HTTP API (disabled if empty)")
+	flag.StringVar(&flagDashAddr, "dashboard-addr", "", "listen address for the web dashboard and stream overlay (disabled if empty)")
+	flag.StringVar(&flagAPIToken, "api-token", "", "bearer token required by admin API endpoints")
+	flag.BoolVar(&flagPprof, "pprof", false, "serve net/http/pprof profiles on the HTTP API")
+	flag.StringVar(&flagSpectatorAddr, "spectator-addr", "", "second proxy listen address for spectators (disabled if empty)")
+	flag.StringVar(&flagProxyControl, "proxy-control", "", "unix socket for a standalone proxy's control channel")
+	flag.BoolVar(&flagProxyOnly, "proxy-only", false, "run only the proxy, taking upstream addresses from -proxy-control")
+	flag.StringVar(&flagProxyHosts, "proxy-hosts", "", "with -proxy-only, comma-separated host=socket pairs routing each server address players connect to to the session on that control socket")
+	flag.BoolVar(&flagStatus, "status", false, "answer server list pings and refuse logins with the MOTD while no server is ready")
+	flag.StringVar(&flagMOTD, "motd", "resetting...", "MOTD shown in the server list while no server is ready; {attempt} is replaced by the attempt number")
+	flag.DurationVar(&flagProxyIdle, "proxy-idle-timeout", 0, "close proxied connections idle for this long (disabled if 0)")
+	flag.DurationVar(&flagProxyGrace, "proxy-grace", 0, "hold connections made while no server is ready for up to this long")
+	flag.DurationVar(&flagDrainGrace, "proxy-drain-grace", 0, "after switching servers, leave connections to the old one open for this long")
+	flag.DurationVar(&flagReconnect, "reconnect-window", 0, "after a reset, hold the runner's reconnection for up to this long until the next server is ready")
+	flag.IntVar(&flagDialRetries, "proxy-dial-retries", 0, "retry connections to a server that refuses or drops them this many times")
+	flag.IntVar(&flagConnRate, "proxy-conn-rate", 0, "new connections allowed per client IP per -proxy-conn-interval (unlimited if 0)")
+	flag.DurationVar(&flagConnInterval, "proxy-conn-interval", time.Minute, "interval for -proxy-conn-rate")
+	flag.IntVar(&flagMaxConns, "proxy-max-conns", 0, "maximum number of connections proxied at once (unlimited if 0)")
+	flag.StringVar(&flagCaptureDir, "capture-dir", "", "write the raw traffic of every proxied connection to this directory (disabled if empty)")
+	flag.DurationVar(&flagIdlePause, "idle-pause", 0, "pause ready servers left unused for this long (disabled if 0)")
+	flag.DurationVar(&flagPauseEmpty, "pause-when-empty", 0, "pause ready servers other than the active one once nobody has been connected for this long (disabled if 0)")
+	flag.DurationVar(&flagHeartbeat, "heartbeat", 30*time.Second, "interval between heartbeat events on the event stream (disabled if 0)")
+	flag.StringVar(&flagStatsdAddr, "statsd-addr", "", "StatsD server address for metrics (disabled if empty)")
+	flag.BoolVar(&flagDogStatsD, "statsd-tags", false, "send DogStatsD-style tags to the StatsD server")
+	flag.BoolVar(&flagSplitCoords, "split-coords", false, "include the player's coordinates in nether and end splits")
+	flag.StringVar(&flagSplitDim, "split-dimension", "", "only announce splits to players in this dimension, or \"current\" for the run's dimension")
+	flag.StringVar(&flagShutdownCommands, "shutdown-commands", "", "comma-separated commands sent to ready servers on exit")
+	flag.DurationVar(&flagShutdownTimeout, "shutdown-timeout", 10*time.Second, "time allowed for shutdown commands")
+	flag.DurationVar(&flagStopTimeout, "stop-timeout", 0, "stop servers on reset and exit with SIGTERM, killing them only after this long (kill straight away if 0)")
+	flag.BoolVar(&flagStopOnExit, "stop-on-exit", false, "kill every server container on exit (leave them running if false)")
+	flag.StringVar(&flagBackupDir, "backup-dir", "", "directory for a state backup if it can't be saved on exit (temp dir if empty)")
+	flag.DurationVar(&flagAutoReset, "auto-reset-after-credits", 0, "reset the game this long after the credits (0 to disable)")
+	flag.DurationVar(&flagResetDebounce, "reset-debounce", 2*time.Second, "ignore reset commands this soon after a reset, until somebody logs in (0 to disable)")
+	flag.StringVar(&flagMetricsAddr, "metrics-addr", ":9090", "address to serve Prometheus metrics on at /metrics (disabled if empty)")
+	flag.StringVar(&flagLiveSplit, "livesplit-addr", "", "LiveSplit Server address to start, split and reset the timer (disabled if empty)")
+	flag.StringVar(&flagEventLog, "event-log", "", "append every game event to this file as JSON lines (disabled if empty)")
+	flag.BoolVar(&flagReissueSaveOff, "reissue-save-off", false, "send /save-off again if the server saves during a run")
+	flag.DurationVar(&flagDockerTimeout, "docker-timeout", DefaultDockerTimeout, "timeout for short Docker API calls such as starting or inspecting a container (unbounded if 0)")
+	flag.StringVar(&flagLogFormat, "log-format", LogFormatText, "log format: text or json")
+	flag.StringVar(&flagSwitchPolicy, "switch-policy", SwitchNever, "before login, switch to newly generated servers: never or newest")
+	flag.StringVar(&flagSelectPolicy, "select-policy", SelectLowest, "server to make active after a reset: lowest, round-robin or lru")
 	flag.Parse()
 
+	err := SetLogFormat(flagLogFormat, os.Stderr)
+	if err != nil {
+		panic(err)
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	defer func() {
 		signal.Stop(c)
 		cancel()
@@ -34,16 +181,319 @@ func main() {
 		}
 	}()
 
+	config := &Config{}
+	if flagConfig != "" {
+		var err error
+		config, err = LoadConfig(flagConfig)
+		if err != nil {
+			panic(err)
+		}
+	}
+	applyFlags(config)
+	err = config.Validate()
+	if err != nil {
+		panic(err)
+	}
+
+	if flagProxyOnly {
+		if (flagProxyControl == "") == (flagProxyHosts == "") {
+			panic("-proxy-only requires one of -proxy-control or -proxy-hosts")
+		}
+		hosts, err := parseHosts(flagProxyHosts)
+		if err != nil {
+			panic(err)
+		}
+		addrs := make(chan string)
+		p := &ProxyServer{
+			ListenAddr:      config.ProxyListenAddr(),
+			ServerPort:      config.ServerPort,
+			ProxyProtocol:   config.ProxyProtocol,
+			SpectatorAddr:   flagSpectatorAddr,
+			IdleTimeout:     flagProxyIdle,
+			Grace:           flagProxyGrace,
+			ReconnectWindow: flagReconnect,
+			Status:          flagStatus,
+			MOTD:            flagMOTD,
+			DialRetries:     flagDialRetries,
+			CaptureDir:      flagCaptureDir,
+			DrainGrace:      flagDrainGrace,
+			ConnRate:        flagConnRate,
+			ConnInterval:    flagConnInterval,
+			MaxConns:        flagMaxConns,
+		}
+		if len(hosts) == 0 {
+			go p.Run(ctx, addrs)
+			err = ServeControl(ctx, flagProxyControl, addrs)
+			if err != nil {
+				panic(err)
+			}
+			return
+		}
+
+		// each host's session has its own control socket
+		p.Hosts = make(map[string]<-chan string, len(hosts))
+		errc := make(chan error, len(hosts))
+		for host, path := range hosts {
+			hostAddrs := make(chan string)
+			p.Hosts[host] = hostAddrs
+			go func(path string, hostAddrs chan<- string) {
+				errc <- ServeControl(ctx, path, hostAddrs)
+			}(path, hostAddrs)
+		}
+		go p.Run(ctx, addrs)
+		for range hosts {
+			err = <-errc
+			if err != nil {
+				panic(err)
+			}
+		}
+		return
+	}
+
+	category := DefaultCategory()
+	if flagCategory != "" {
+		category, err = LoadCategory(flagCategory)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if flagRebuild != "" {
+		err = RebuildFile(flagRebuild, category, config.MilestoneSet())
+		if err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	if flagReplay != "" {
+		attempts, err := Replay(ctx, flagReplay, config, category, flagRealtime)
+		if err != nil {
+			panic(err)
+		}
+		PrintAttempts(attempts)
+		return
+	}
+
 	cli, err := client.NewClientWithOpts(client.FromEnv,
 		client.WithAPIVersionNegotiation())
 	if err != nil {
 		panic(err)
 	}
 
-	s, err := NewSession(cli, flagImage, flagReplicas)
+	if flagTemplate != "" {
+		err = CheckTemplate(flagTemplate)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if config.Network != "" {
+		err = EnsureNetwork(ctx, cli, config.Network)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if flagBench > 0 {
+		bench := *config
+		bench.Replicas = flagBench
+		bench.MaxReplicas = flagBench
+		s, err := NewSession(cli, &bench)
+		if err != nil {
+			panic(err)
+		}
+		s.KeepContainers = flagKeep
+		s.DockerTimeout = flagDockerTimeout
+		s.CrashGrace = flagCrash
+		s.WorldTemplate = flagTemplate
+		s.DataDir = flagDataDir
+		PrintBenchmark(s.Benchmark(ctx))
+		return
+	}
+
+	s, err := NewSession(cli, config)
 	if err != nil {
 		panic(err)
 	}
+	s.KeepContainers = flagKeep
+	s.DockerTimeout = flagDockerTimeout
+	s.StopTimeout = flagStopTimeout
+	s.CrashGrace = flagCrash
+	s.WorldTemplate = flagTemplate
+	s.DataDir = flagDataDir
+	s.APIAddr = flagAPIAddr
+	s.DashboardAddr = flagDashAddr
+	s.APIToken = flagAPIToken
+	s.Pprof = flagPprof
+	s.SpectatorAddr = flagSpectatorAddr
+	s.ProxyControl = flagProxyControl
+	s.ProxyStatus = flagStatus
+	s.ProxyMOTD = flagMOTD
+	s.ProxyIdleTimeout = flagProxyIdle
+	s.ProxyGrace = flagProxyGrace
+	s.ProxyDrainGrace = flagDrainGrace
+	s.ProxyReconnect = flagReconnect
+	s.ProxyDialRetries = flagDialRetries
+	s.ProxyConnRate = flagConnRate
+	s.ProxyConnInterval = flagConnInterval
+	s.ProxyMaxConns = flagMaxConns
+	s.CaptureDir = flagCaptureDir
+	s.IdlePause = flagIdlePause
+	s.PauseWhenEmpty = flagPauseEmpty
+	if flagPauseEmpty > 0 && flagProxyControl != "" {
+		panic("-pause-when-empty can't be used with -proxy-control")
+	}
+	s.Heartbeat = flagHeartbeat
+	s.SplitCoords = flagSplitCoords
+	s.SplitDimension = flagSplitDim
+	if flagSplitDim != "" && flagSplitDim != "current" {
+		s.SplitDimension, err = ParseDimension(flagSplitDim)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if flagStatsdAddr != "" {
+		statsd, err := NewStatsD(ctx, flagStatsdAddr)
+		if err != nil {
+			panic(err)
+		}
+		statsd.DogStatsD = flagDogStatsD
+		s.Metrics = append(s.Metrics, statsd)
+	}
+	if flagMetricsAddr != "" {
+		prom := NewPrometheus()
+		s.Metrics = append(s.Metrics, prom)
+		go prom.Serve(ctx, flagMetricsAddr)
+	}
+	if flagLiveSplit != "" {
+		s.Sinks.Register(ctx, "livesplit", NewLiveSplit(flagLiveSplit))
+	}
+	if config.WebhookURL != "" {
+		s.Sinks.Register(ctx, "webhook", NewWebhook(config.WebhookURL))
+	}
+	if flagEventLog != "" {
+		eventLog, err := OpenEventLog(flagEventLog)
+		if err != nil {
+			panic(err)
+		}
+		defer eventLog.Close()
+		s.Sinks.RegisterInline(ctx, "event log", eventLog)
+	}
+	s.ShutdownCommands = splitList(flagShutdownCommands)
+	s.ShutdownTimeout = flagShutdownTimeout
+	s.StopOnExit = flagStopOnExit
+	s.BackupDir = flagBackupDir
+	s.AutoReset = flagAutoReset
+	s.ResetDebounce = flagResetDebounce
+	s.ReissueSaveOff = flagReissueSaveOff
+	s.Category = category
+	if flagSwitchPolicy != SwitchNever && flagSwitchPolicy != SwitchNewest {
+		panic("-switch-policy must be never or newest")
+	}
+	s.SwitchPolicy = flagSwitchPolicy
+	if flagSelectPolicy != SelectLowest && flagSelectPolicy != SelectRoundRobin && flagSelectPolicy != SelectLRU {
+		panic("-select-policy must be lowest, round-robin or lru")
+	}
+	s.SelectPolicy = flagSelectPolicy
 	s.Init(ctx)
-	s.Loop(ctx)
+	err = s.Loop(ctx)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// applyFlags overrides config file values with the flags given on the
+// command line. Flags left at their defaults only fill in unset values.
+func applyFlags(config *Config) {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	if set["replicas"] || config.Replicas == 0 {
+		config.Replicas = flagReplicas
+	}
+	if set["image"] || config.Image == "" {
+		config.Image = flagImage
+	}
+	if set["max-concurrent-gen"] || config.MaxConcurrentGen == 0 {
+		config.MaxConcurrentGen = flagMaxGen
+	}
+	if set["warm"] {
+		config.Warm = flagWarm
+	}
+	if set["max-replicas"] {
+		config.MaxReplicas = flagMaxRepl
+	}
+	if set["replica-limit"] {
+		config.ReplicaLimit = flagLimit
+	}
+	if set["memory"] {
+		config.Memory = flagMemory
+	}
+	if set["memory-swap"] {
+		config.MemorySwap = flagMemSwap
+	}
+	if set["cpus"] {
+		config.CPUs = &flagCPUs
+	}
+	if set["proxy-addr"] {
+		config.ProxyAddr = flagProxy
+	}
+	if set["proxy-port"] {
+		config.ProxyPort = flagPort
+	}
+	if set["server-port"] {
+		config.ServerPort = flagSrvPort
+	}
+	if set["proxy-protocol"] {
+		config.ProxyProtocol = flagPROXY
+	}
+	if set["webhook-url"] {
+		config.WebhookURL = flagWebhook
+	}
+	if set["export-dir"] {
+		config.ExportDir = flagExport
+	}
+	if set["network"] {
+		config.Network = flagNetwork
+	}
+	if set["ipv6"] {
+		config.IPv6 = flagIPv6
+	}
+	if set["seed"] {
+		config.Seed = flagSeed
+	}
+	if set["level-env"] {
+		config.LevelEnv = flagLevelEnv
+	}
+}
+
+// parseHosts parses a comma-separated list of host=socket pairs.
+func parseHosts(value string) (map[string]string, error) {
+	hosts := make(map[string]string)
+	for _, item := range splitList(value) {
+		parts := strings.SplitN(item, "=", 2)
+		host := serverHost(strings.TrimSpace(parts[0]))
+		if len(parts) != 2 || host == "" || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("invalid proxy host %q, want host=socket", item)
+		}
+		if _, ok := hosts[host]; ok {
+			return nil, fmt.Errorf("duplicate proxy host %s", host)
+		}
+		hosts[host] = strings.TrimSpace(parts[1])
+	}
+	return hosts, nil
+}
+
+// splitList splits a comma-separated flag value, dropping empty items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }
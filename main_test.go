@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSplitList(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []string
+	}{
+		{"", nil},
+		{"/say bye", []string{"/say bye"}},
+		{"/say bye,/save-all", []string{"/say bye", "/save-all"}},
+		{" /say bye , ,/save-all, ", []string{"/say bye", "/save-all"}},
+		{",,", nil},
+	}
+	for _, tt := range tests {
+		if got := splitList(tt.value); fmt.Sprint(got) != fmt.Sprint(tt.want) || len(got) != len(tt.want) {
+			t.Errorf("splitList(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestParseHosts(t *testing.T) {
+	hosts, err := parseHosts("mc1.example.com=/run/mc1.sock, MC2.example.com=/run/mc2.sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"mc1.example.com": "/run/mc1.sock", "mc2.example.com": "/run/mc2.sock"}
+	if fmt.Sprint(hosts) != fmt.Sprint(want) {
+		t.Errorf("hosts %v, want %v", hosts, want)
+	}
+
+	for _, value := range []string{"mc1.example.com", "=/run/mc1.sock", "mc1.example.com=", "a=/x,A=/y"} {
+		if _, err := parseHosts(value); err == nil {
+			t.Errorf("parseHosts(%q) succeeded", value)
+		}
+	}
+}
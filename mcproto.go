@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf16"
+)
+
+// legacyPing is the first byte sent by pre-1.7 clients when pinging a server
+// from the multiplayer list.
+const legacyPing = 0xFE
+
+// writeLegacyStatus answers a legacy server list ping with a kick packet
+// carrying the MOTD and player counts, in the format understood by 1.4-1.6
+// clients.
+func writeLegacyStatus(w io.Writer, version string, motd string, online int, max int) error {
+	text := fmt.Sprintf("§1\x00127\x00%s\x00%s\x00%d\x00%d", version, motd, online, max)
+	chars := utf16.Encode([]rune(text))
+
+	buf := make([]byte, 3, 3+2*len(chars))
+	buf[0] = 0xFF
+	binary.BigEndian.PutUint16(buf[1:], uint16(len(chars)))
+	for _, c := range chars {
+		buf = append(buf, byte(c>>8), byte(c))
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// legacyPingHost reads a 1.6 client's legacy server list ping, which names
+// the server address it pinged in an MC|PingHost plugin message, and returns
+// that address. Older clients send no address, and an error is returned.
+func legacyPingHost(r io.ByteReader) (string, error) {
+	header := make([]byte, 3)
+	for i := range header {
+		b, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		header[i] = b
+	}
+	if !bytes.Equal(header, []byte{legacyPing, 0x01, 0xFA}) {
+		return "", fmt.Errorf("no ping host")
+	}
+	channel, err := readLegacyString(r)
+	if err != nil {
+		return "", err
+	}
+	if channel != "MC|PingHost" {
+		return "", fmt.Errorf("unexpected channel %q", channel)
+	}
+	// data length and protocol version
+	for i := 0; i < 3; i++ {
+		_, err = r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+	}
+	return readLegacyString(r)
+}
+
+// readLegacyString reads a string of UTF-16 characters prefixed with its
+// length, as used by pre-1.7 packets.
+func readLegacyString(r io.ByteReader) (string, error) {
+	n, err := readUint16(r)
+	if err != nil {
+		return "", err
+	}
+	if int(n) > maxPacketLength {
+		return "", fmt.Errorf("string too long: %d characters", n)
+	}
+	chars := make([]uint16, n)
+	for i := range chars {
+		chars[i], err = readUint16(r)
+		if err != nil {
+			return "", err
+		}
+	}
+	return string(utf16.Decode(chars)), nil
+}
+
+// readUint16 reads a big-endian unsigned short.
+func readUint16(r io.ByteReader) (uint16, error) {
+	hi, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	lo, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	return uint16(hi)<<8 | uint16(lo), nil
+}
+
+// Handshake next states.
+const (
+	nextStateStatus = 1
+	nextStateLogin  = 2
+)
+
+// maxPacketLength bounds packets read from clients, which before login are
+// only ever a handshake, a status request or a ping.
+const maxPacketLength = 1024
+
+// handshake is the first packet sent by 1.7+ clients.
+type handshake struct {
+	Protocol  int32
+	Address   string
+	Port      uint16
+	NextState int32
+}
+
+// serverHost normalizes the server address of a handshake for routing: it
+// drops anything after a NUL (which Forge clients append), a trailing dot and
+// letter case.
+func serverHost(address string) string {
+	if i := strings.IndexByte(address, 0); i >= 0 {
+		address = address[:i]
+	}
+	return strings.ToLower(strings.TrimSuffix(address, "."))
+}
+
+// readVarInt reads a VarInt: seven bits per byte, least significant group
+// first, with the high bit set on all but the last byte.
+func readVarInt(r io.ByteReader) (int32, error) {
+	var value uint32
+	for i := 0; i < 5; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		value |= uint32(b&0x7F) << (7 * i)
+		if b&0x80 == 0 {
+			return int32(value), nil
+		}
+	}
+	return 0, fmt.Errorf("varint is too long")
+}
+
+// appendVarInt appends v to buf as a VarInt.
+func appendVarInt(buf []byte, v int32) []byte {
+	u := uint32(v)
+	for u >= 0x80 {
+		buf = append(buf, byte(u)|0x80)
+		u >>= 7
+	}
+	return append(buf, byte(u))
+}
+
+// appendString appends a string prefixed with its length as a VarInt.
+func appendString(buf []byte, s string) []byte {
+	buf = appendVarInt(buf, int32(len(s)))
+	return append(buf, s...)
+}
+
+// readPacket reads an uncompressed packet and returns its ID and data.
+func readPacket(r io.ByteReader) (int32, []byte, error) {
+	length, err := readVarInt(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if length < 1 || length > maxPacketLength {
+		return 0, nil, fmt.Errorf("invalid packet length %d", length)
+	}
+	data := make([]byte, length)
+	for i := range data {
+		data[i], err = r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+	br := bytes.NewReader(data)
+	id, err := readVarInt(br)
+	if err != nil {
+		return 0, nil, err
+	}
+	return id, data[len(data)-br.Len():], nil
+}
+
+// writePacket writes an uncompressed packet with the given ID and data.
+func writePacket(w io.Writer, id int32, data []byte) error {
+	body := appendVarInt(nil, id)
+	body = append(body, data...)
+	buf := appendVarInt(nil, int32(len(body)))
+	_, err := w.Write(append(buf, body...))
+	return err
+}
+
+// parseHandshake decodes the data of a handshake packet.
+func parseHandshake(data []byte) (handshake, error) {
+	var h handshake
+	r := bytes.NewReader(data)
+	var err error
+	h.Protocol, err = readVarInt(r)
+	if err != nil {
+		return h, err
+	}
+	n, err := readVarInt(r)
+	if err != nil {
+		return h, err
+	}
+	if n < 0 || int(n) > r.Len() {
+		return h, fmt.Errorf("invalid server address length %d", n)
+	}
+	addr := make([]byte, n)
+	r.Read(addr)
+	h.Address = string(addr)
+	err = binary.Read(r, binary.BigEndian, &h.Port)
+	if err != nil {
+		return h, err
+	}
+	h.NextState, err = readVarInt(r)
+	return h, err
+}
+
+// statusResponse is the JSON sent in reply to a status request.
+type statusResponse struct {
+	Version struct {
+		Name     string `json:"name"`
+		Protocol int32  `json:"protocol"`
+	} `json:"version"`
+	Players struct {
+		Max    int `json:"max"`
+		Online int `json:"online"`
+	} `json:"players"`
+	Description Message `json:"description"`
+}
+
+// writeStatus answers a status request with the MOTD and no players. The
+// client's own protocol version is echoed so it isn't shown as incompatible.
+func writeStatus(w io.Writer, protocol int32, version string, motd string) error {
+	var status statusResponse
+	status.Version.Name = version
+	status.Version.Protocol = protocol
+	status.Description = Message{Text: motd, Color: "white"}
+	buf, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	return writePacket(w, 0x00, appendString(nil, string(buf)))
+}
+
+// writeDisconnect refuses a login with a chat message shown to the player.
+func writeDisconnect(w io.Writer, reason string) error {
+	buf, err := json.Marshal(Message{Text: reason, Color: "white"})
+	if err != nil {
+		return err
+	}
+	return writePacket(w, 0x00, appendString(nil, string(buf)))
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"unicode/utf16"
+)
+
+func TestWriteLegacyStatus(t *testing.T) {
+	tests := []struct {
+		version, motd string
+		online, max   int
+		want          string
+	}{
+		{"1.16.4", "Waiting for a world", 0, 1, "§1\x00127\x001.16.4\x00Waiting for a world\x000\x001"},
+		{"", "", 0, 0, "§1\x00127\x00\x00\x000\x000"},
+		{"1.16.4", "§aGenerating…", 3, 20, "§1\x00127\x001.16.4\x00§aGenerating…\x003\x0020"},
+	}
+	for _, tt := range tests {
+		var b bytes.Buffer
+		err := writeLegacyStatus(&b, tt.version, tt.motd, tt.online, tt.max)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := b.Bytes()
+		if buf[0] != 0xFF {
+			t.Errorf("%q: packet ID %#x, want 0xff", tt.motd, buf[0])
+			continue
+		}
+		n := int(binary.BigEndian.Uint16(buf[1:3]))
+		if len(buf) != 3+2*n {
+			t.Errorf("%q: %d bytes for %d characters", tt.motd, len(buf), n)
+			continue
+		}
+		chars := make([]uint16, n)
+		for i := range chars {
+			chars[i] = binary.BigEndian.Uint16(buf[3+2*i:])
+		}
+		if got := string(utf16.Decode(chars)); got != tt.want {
+			t.Errorf("writeLegacyStatus(%q, %q) = %q, want %q", tt.version, tt.motd, got, tt.want)
+		}
+	}
+}
+
+func TestVarInt(t *testing.T) {
+	tests := []struct {
+		value int32
+		enc   []byte
+	}{
+		{0, []byte{0x00}},
+		{1, []byte{0x01}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x80, 0x01}},
+		{25565, []byte{0xdd, 0xc7, 0x01}},
+		{2147483647, []byte{0xff, 0xff, 0xff, 0xff, 0x07}},
+		{-1, []byte{0xff, 0xff, 0xff, 0xff, 0x0f}},
+	}
+	for _, tt := range tests {
+		if enc := appendVarInt(nil, tt.value); !bytes.Equal(enc, tt.enc) {
+			t.Errorf("appendVarInt(%d) = % x, want % x", tt.value, enc, tt.enc)
+		}
+		v, err := readVarInt(bytes.NewReader(tt.enc))
+		if err != nil || v != tt.value {
+			t.Errorf("readVarInt(% x) = %d, %v, want %d", tt.enc, v, err, tt.value)
+		}
+	}
+	_, err := readVarInt(bytes.NewReader([]byte{0x80, 0x80, 0x80, 0x80, 0x80, 0x01}))
+	if err == nil {
+		t.Errorf("readVarInt() of six bytes succeeded")
+	}
+}
+
+// handshakeData builds the data of a handshake packet.
+func handshakeData(protocol int32, addr string, port uint16, next int32) []byte {
+	data := appendVarInt(nil, protocol)
+	data = appendString(data, addr)
+	data = append(data, byte(port>>8), byte(port))
+	return appendVarInt(data, next)
+}
+
+func TestReadPacket(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  []byte
+		id   int32
+		data []byte
+		ok   bool
+	}{
+		{"status request", []byte{0x01, 0x00}, 0x00, []byte{}, true},
+		{"ping", []byte{0x09, 0x01, 1, 2, 3, 4, 5, 6, 7, 8}, 0x01, []byte{1, 2, 3, 4, 5, 6, 7, 8}, true},
+		{"empty", []byte{0x00}, 0, nil, false},
+		{"too long", appendVarInt(nil, maxPacketLength+1), 0, nil, false},
+		{"truncated", []byte{0x05, 0x00, 0x01}, 0, nil, false},
+	}
+	for _, tt := range tests {
+		id, data, err := readPacket(bytes.NewReader(tt.raw))
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: readPacket() error %v, want ok %v", tt.name, err, tt.ok)
+			continue
+		}
+		if tt.ok && (id != tt.id || !bytes.Equal(data, tt.data)) {
+			t.Errorf("%s: readPacket() = %#x, % x, want %#x, % x", tt.name, id, data, tt.id, tt.data)
+		}
+	}
+
+	var b bytes.Buffer
+	writePacket(&b, 0x00, handshakeData(754, "localhost", 25565, nextStateLogin))
+	id, data, err := readPacket(&b)
+	if err != nil || id != 0x00 || !bytes.Equal(data, handshakeData(754, "localhost", 25565, nextStateLogin)) {
+		t.Errorf("readPacket() of a written handshake = %#x, % x, %v", id, data, err)
+	}
+}
+
+func TestParseHandshake(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want handshake
+		ok   bool
+	}{
+		{"status", handshakeData(754, "localhost", 25565, nextStateStatus), handshake{754, "localhost", 25565, nextStateStatus}, true},
+		{"login", handshakeData(47, "mc.example.com", 25566, nextStateLogin), handshake{47, "mc.example.com", 25566, nextStateLogin}, true},
+		{"modded", handshakeData(754, "localhost\x00FML2\x00", 25565, nextStateLogin), handshake{754, "localhost\x00FML2\x00", 25565, nextStateLogin}, true},
+		{"empty", nil, handshake{}, false},
+		{"address past the end", append(appendVarInt(nil, 754), 0x20, 'a'), handshake{}, false},
+		{"no port", appendString(appendVarInt(nil, 754), "localhost"), handshake{}, false},
+		{"no next state", handshakeData(754, "localhost", 25565, 1)[:14], handshake{}, false},
+	}
+	for _, tt := range tests {
+		h, err := parseHandshake(tt.data)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: parseHandshake() error %v, want ok %v", tt.name, err, tt.ok)
+			continue
+		}
+		if tt.ok && h != tt.want {
+			t.Errorf("%s: parseHandshake() = %+v, want %+v", tt.name, h, tt.want)
+		}
+	}
+}
+
+func TestServerHost(t *testing.T) {
+	tests := []struct {
+		address string
+		host    string
+	}{
+		{"mc1.example.com", "mc1.example.com"},
+		{"MC1.Example.com.", "mc1.example.com"},
+		{"mc1.example.com\x00FML2\x00", "mc1.example.com"},
+	}
+	for _, tt := range tests {
+		if host := serverHost(tt.address); host != tt.host {
+			t.Errorf("serverHost(%q) = %q, want %q", tt.address, host, tt.host)
+		}
+	}
+}
+
+// legacyPingData returns a 1.6 client's server list ping of host.
+func legacyPingData(host string) []byte {
+	str := func(buf []byte, s string) []byte {
+		chars := utf16.Encode([]rune(s))
+		buf = append(buf, byte(len(chars)>>8), byte(len(chars)))
+		for _, c := range chars {
+			buf = append(buf, byte(c>>8), byte(c))
+		}
+		return buf
+	}
+	data := str([]byte{74}, host)
+	data = append(data, 0, 0, 0x63, 0xDD)
+	buf := str([]byte{legacyPing, 0x01, 0xFA}, "MC|PingHost")
+	buf = append(buf, byte(len(data)>>8), byte(len(data)))
+	return append(buf, data...)
+}
+
+func TestLegacyPingHost(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  []byte
+		want string
+		err  bool
+	}{
+		{"1.6", legacyPingData("mc1.example.com"), "mc1.example.com", false},
+		{"1.5", []byte{legacyPing, 0x01}, "", true},
+		{"1.3", []byte{legacyPing}, "", true},
+		{"other channel", append([]byte{legacyPing, 0x01, 0xFA, 0, 1, 0, 'x'}, 0, 0), "", true},
+	}
+	for _, tt := range tests {
+		got, err := legacyPingHost(bytes.NewReader(tt.raw))
+		if got != tt.want || (err != nil) != tt.err {
+			t.Errorf("%s: %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
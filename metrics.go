@@ -0,0 +1,40 @@
+package main
+
+import (
+	"time"
+)
+
+// Tag is a dimension attached to a metric, such as the game ID.
+type Tag struct {
+	Key   string
+	Value string
+}
+
+// Metrics is a sink for session metrics. Implementations must not block the
+// caller, which is usually Loop().
+type Metrics interface {
+	Count(name string, value int64, tags ...Tag)
+	Gauge(name string, value float64, tags ...Tag)
+	Timing(name string, value time.Duration, tags ...Tag)
+}
+
+// MultiMetrics sends every metric to each of its sinks.
+type MultiMetrics []Metrics
+
+func (m MultiMetrics) Count(name string, value int64, tags ...Tag) {
+	for _, sink := range m {
+		sink.Count(name, value, tags...)
+	}
+}
+
+func (m MultiMetrics) Gauge(name string, value float64, tags ...Tag) {
+	for _, sink := range m {
+		sink.Gauge(name, value, tags...)
+	}
+}
+
+func (m MultiMetrics) Timing(name string, value time.Duration, tags ...Tag) {
+	for _, sink := range m {
+		sink.Timing(name, value, tags...)
+	}
+}
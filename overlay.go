@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// overlayInterval is how often the overlay feed checks for a new frame.
+const overlayInterval = 100 * time.Millisecond
+
+// OverlayState is a frame of the overlay feed: the timer and splits of the
+// current attempt, like DashboardState without the replicas.
+type OverlayState struct {
+	State     string  `json:"state"`
+	Attempt   int     `json:"attempt"`
+	ElapsedMs int64   `json:"elapsed_ms"`
+	Paused    bool    `json:"paused"`
+	Splits    []Split `json:"splits"`
+}
+
+// OverlayState returns a snapshot of the timer.
+func (s *Session) OverlayState() OverlayState {
+	status := s.Status()
+	state := OverlayState{
+		State:   status.State,
+		Attempt: status.Attempt,
+		Paused:  status.Paused,
+		Splits:  []Split{},
+	}
+	if attempt, ok := s.Attempt(status.Attempt); ok && attempt.Splits != nil {
+		state.Splits = attempt.Splits
+	}
+	state.ElapsedMs = s.elapsedMs(status.State, state.Splits)
+	return state
+}
+
+// elapsedMs is the run's elapsed time as shown by the dashboard and overlay:
+// running while in progress, the final time after the credits and zero
+// before login.
+func (s *Session) elapsedMs(state string, splits []Split) int64 {
+	switch state {
+	case "":
+		return 0
+	case "credits":
+		if n := len(splits); n > 0 {
+			return splits[n-1].Time.Milliseconds()
+		}
+		return 0
+	}
+	return s.Elapsed(time.Now()).Milliseconds()
+}
+
+// overlayFeed serves the overlay feed, pushing OverlayState frames as JSON
+// text messages to each WebSocket client every overlayInterval. Frames that
+// haven't changed are skipped, so the feed goes quiet between a reset and
+// the next login. A client is served until it disconnects or the context is
+// cancelled.
+func (s *Session) overlayFeed(ctx context.Context) http.Handler {
+	// websocket.Server, unlike websocket.Handler, doesn't check the Origin
+	// header, which browser sources may leave empty or set to "null"
+	return websocket.Server{Handler: func(ws *websocket.Conn) {
+		closed := make(chan struct{})
+		go func() {
+			io.Copy(ioutil.Discard, ws)
+			close(closed)
+		}()
+		ticker := time.NewTicker(overlayInterval)
+		defer ticker.Stop()
+		var last []byte
+		for {
+			frame, err := json.Marshal(s.OverlayState())
+			if err != nil {
+				return
+			}
+			if !bytes.Equal(frame, last) {
+				err = websocket.Message.Send(ws, string(frame))
+				if err != nil {
+					return
+				}
+				last = frame
+			}
+			select {
+			case <-ticker.C:
+			case <-closed:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}}
+}
+
+// overlayPage connects to the overlay feed and shows the timer and latest
+// split on a transparent background, for use as an OBS browser source. The
+// timer ticks locally between frames, and the page reconnects if the feed
+// drops.
+const overlayPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>mcspeedrun overlay</title>
+<style>
+body { font-family: monospace; background: transparent; color: #fff; margin: 0.5em; text-shadow: 0 0 4px #000, 0 0 2px #000; }
+#timer { font-size: 4em; }
+#timer.paused { color: #aaa; }
+#timer.done { color: #5f5; }
+#split { font-size: 1.5em; }
+</style>
+</head>
+<body>
+<div id="timer">0:00.000</div>
+<div id="split"></div>
+<script>
+var state = null, received = 0;
+
+function fmt(ms) {
+	var h = Math.floor(ms / 3600000), m = Math.floor(ms / 60000) % 60;
+	var s = Math.floor(ms / 1000) % 60, f = ms % 1000;
+	var t = (m < 10 && h ? "0" : "") + m + ":" + (s < 10 ? "0" : "") + s + "." + ("00" + f).slice(-3);
+	return h ? h + ":" + t : t;
+}
+
+function running() {
+	return state && state.state && state.state !== "credits" && !state.paused;
+}
+
+function render() {
+	if (!state) return;
+	var elapsed = state.elapsed_ms;
+	if (running()) elapsed += Date.now() - received;
+	var timer = document.getElementById("timer");
+	timer.textContent = fmt(elapsed);
+	timer.className = state.paused ? "paused" : state.state === "credits" ? "done" : "";
+}
+
+function connect() {
+	var ws = new WebSocket((location.protocol === "https:" ? "wss://" : "ws://") + location.host + "/overlay/ws");
+	ws.onmessage = function(msg) {
+		state = JSON.parse(msg.data);
+		received = Date.now();
+		var n = state.splits.length;
+		document.getElementById("split").textContent =
+			n ? state.splits[n - 1].name + " " + fmt(Math.floor(state.splits[n - 1].time / 1e6)) : "";
+		render();
+	};
+	ws.onclose = function() { setTimeout(connect, 1000); };
+}
+
+connect();
+setInterval(render, 30);
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestOverlayFeed(t *testing.T) {
+	s, _ := newTestSession(t, 2)
+	runLoop(t, s)
+	send(t, s, ready(0), ready(1))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv := httptest.NewServer(s.overlayFeed(ctx))
+	defer srv.Close()
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), "", "http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	// next waits for a frame that satisfies ok
+	next := func(what string, ok func(OverlayState) bool) OverlayState {
+		t.Helper()
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			var msg string
+			err := websocket.Message.Receive(ws, &msg)
+			if err != nil {
+				t.Fatalf("waiting for %s: %s", what, err)
+			}
+			var state OverlayState
+			err = json.Unmarshal([]byte(msg), &state)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok(state) {
+				return state
+			}
+		}
+	}
+
+	next("the waiting timer", func(st OverlayState) bool { return st.State == "" && st.ElapsedMs == 0 })
+
+	send(t, s, Event{GameID: 0, Timestamp: time.Now().Add(-time.Minute), Type: "login", Payload: "alice joined the game"})
+	first := next("the running timer", func(st OverlayState) bool { return st.State == "overworld" })
+	if first.ElapsedMs < time.Minute.Milliseconds() {
+		t.Errorf("elapsed %dms, want at least a minute", first.ElapsedMs)
+	}
+	next("the timer to tick", func(st OverlayState) bool { return st.ElapsedMs > first.ElapsedMs })
+
+	send(t, s, Event{GameID: 0, Timestamp: time.Now(), Type: "cmd.reset"})
+	st := next("the reset timer", func(st OverlayState) bool { return st.State == "" })
+	if st.ElapsedMs != 0 || st.Attempt != 1 {
+		t.Errorf("after reset: elapsed %dms, attempt %d, want 0ms, 1", st.ElapsedMs, st.Attempt)
+	}
+
+	// the feed is quiet until the next login
+	ws.SetReadDeadline(time.Now().Add(3 * overlayInterval))
+	var msg string
+	err = websocket.Message.Receive(ws, &msg)
+	if err == nil {
+		t.Errorf("frame %s after reset, want none", msg)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// PaceColor is a split color chosen by pace: a split up to Behind slower
+// than the personal best's (negative for ahead) is shown in Color.
+type PaceColor struct {
+	Behind string `json:"behind"`
+	Color  string `json:"color"`
+
+	behind time.Duration
+}
+
+// SlowColor is used for splits slower than every PaceColor threshold.
+const SlowColor = "red"
+
+// defaultPace shows splits ahead of PB in green and up to 10s behind in
+// yellow.
+var defaultPace = []PaceColor{
+	{Behind: "0s", Color: "green"},
+	{Behind: "10s", Color: "yellow"},
+}
+
+// textColors are the named colors of Minecraft text components.
+var textColors = []string{
+	"black", "dark_blue", "dark_green", "dark_aqua", "dark_red", "dark_purple",
+	"gold", "gray", "dark_gray", "blue", "green", "aqua", "red",
+	"light_purple", "yellow", "white",
+}
+
+// validatePace parses the thresholds and sorts them from fastest to slowest.
+func validatePace(pace []PaceColor) error {
+	for i := range pace {
+		d, err := time.ParseDuration(pace[i].Behind)
+		if err != nil {
+			return fmt.Errorf("pace %d: %s", i, err)
+		}
+		if !contains(textColors, pace[i].Color) {
+			return fmt.Errorf("pace %d: unknown color %q", i, pace[i].Color)
+		}
+		pace[i].behind = d
+	}
+	sort.Slice(pace, func(i, j int) bool {
+		return pace[i].behind < pace[j].behind
+	})
+	return nil
+}
+
+// PaceSet returns the configured pace thresholds, or the defaults.
+func (c *Config) PaceSet() []PaceColor {
+	if len(c.Pace) > 0 {
+		return c.Pace
+	}
+	pace := append([]PaceColor(nil), defaultPace...)
+	validatePace(pace)
+	return pace
+}
+
+// personalBest returns the fastest completed attempt in the history, or nil.
+func (s *Session) personalBest() *Attempt {
+	var best *Attempt
+	var bestTime time.Duration
+	for i := range s.Data.History {
+		attempt := &s.Data.History[i]
+		if attempt.Result != "credits" {
+			continue
+		}
+		for _, split := range attempt.Splits {
+			if split.Name == "Credits" && (best == nil || split.Time < bestTime) {
+				best, bestTime = attempt, split.Time
+			}
+		}
+	}
+	return best
+}
+
+// splitDelta returns how far a split is behind the same split of the
+// personal best (negative for ahead). It reports false if there is no
+// personal best or it lacks the split.
+func (s *Session) splitDelta(split Split) (time.Duration, bool) {
+	best := s.personalBest()
+	if best == nil {
+		return 0, false
+	}
+	for _, pb := range best.Splits {
+		if pb.Name == split.Name {
+			return split.Time - pb.Time, true
+		}
+	}
+	return 0, false
+}
+
+// splitColor picks the announcement color for a split by comparing it with
+// the same split of the personal best. Without one, splits are green.
+func (s *Session) splitColor(split Split) string {
+	delta, ok := s.splitDelta(split)
+	if !ok {
+		return "green"
+	}
+	return paceColor(s.Pace, delta)
+}
+
+// formatDelta formats a split delta to a tenth of a second with its sign,
+// e.g. "-4.2s" or "+1m3s".
+func formatDelta(d time.Duration) string {
+	d = d.Round(100 * time.Millisecond)
+	if d < 0 {
+		return d.String()
+	}
+	return "+" + d.String()
+}
+
+// paceColor returns the color for a split delta behind PB, given thresholds
+// sorted from fastest to slowest.
+func paceColor(pace []PaceColor, delta time.Duration) string {
+	for _, p := range pace {
+		if delta <= p.behind {
+			return p.Color
+		}
+	}
+	return SlowColor
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidatePace(t *testing.T) {
+	tests := []struct {
+		name string
+		pace []PaceColor
+		err  string
+	}{
+		{"valid", []PaceColor{{Behind: "30s", Color: "gold"}, {Behind: "-5s", Color: "aqua"}}, ""},
+		{"bad duration", []PaceColor{{Behind: "soon", Color: "gold"}}, "pace 0: time: invalid duration"},
+		{"bad color", []PaceColor{{Behind: "0s", Color: "orange"}}, `pace 0: unknown color "orange"`},
+	}
+	for _, tt := range tests {
+		err := validatePace(tt.pace)
+		if tt.err == "" && err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+		}
+		if tt.err != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.err)) {
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestPaceColor(t *testing.T) {
+	// out of order, to be sorted by validatePace
+	pace := []PaceColor{
+		{Behind: "30s", Color: "gold"},
+		{Behind: "-5s", Color: "aqua"},
+		{Behind: "0s", Color: "green"},
+	}
+	err := validatePace(pace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		delta time.Duration
+		color string
+	}{
+		{-time.Minute, "aqua"},
+		{-5 * time.Second, "aqua"},
+		{-time.Second, "green"},
+		{0, "green"},
+		{10 * time.Second, "gold"},
+		{31 * time.Second, SlowColor},
+	}
+	for _, tt := range tests {
+		if color := paceColor(pace, tt.delta); color != tt.color {
+			t.Errorf("paceColor(%s) = %q, want %q", tt.delta, color, tt.color)
+		}
+	}
+	if color := paceColor((&Config{}).PaceSet(), 5*time.Second); color != "yellow" {
+		t.Errorf("default pace color %q, want yellow", color)
+	}
+}
+
+func TestFormatDelta(t *testing.T) {
+	tests := []struct {
+		delta time.Duration
+		text  string
+	}{
+		{-4230 * time.Millisecond, "-4.2s"},
+		{63 * time.Second, "+1m3s"},
+		{0, "+0s"},
+	}
+	for _, tt := range tests {
+		if text := formatDelta(tt.delta); text != tt.text {
+			t.Errorf("formatDelta(%s) = %q, want %q", tt.delta, text, tt.text)
+		}
+	}
+}
+
+func TestSplitColor(t *testing.T) {
+	s, _ := newTestSession(t, 1)
+	s.Pace = (&Config{}).PaceSet()
+	run := func(nether, credits time.Duration, result string) Attempt {
+		return Attempt{Result: result, Splits: []Split{{"Nether", nether}, {"Credits", credits}}}
+	}
+	s.Data.History = []Attempt{
+		run(3*time.Minute, 20*time.Minute, "credits"),
+		// the personal best
+		run(4*time.Minute, 15*time.Minute, "credits"),
+		// faster, but not finished
+		run(time.Minute, 10*time.Minute, "nether"),
+	}
+
+	tests := []struct {
+		split Split
+		color string
+	}{
+		{Split{"Nether", 3 * time.Minute}, "green"},
+		{Split{"Nether", 4*time.Minute + 5*time.Second}, "yellow"},
+		{Split{"Nether", 5 * time.Minute}, SlowColor},
+		{Split{"Stronghold", time.Hour}, "green"},
+	}
+	for _, tt := range tests {
+		if color := s.splitColor(tt.split); color != tt.color {
+			t.Errorf("splitColor(%s at %s) = %q, want %q", tt.split.Name, tt.split.Time, color, tt.color)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+)
+
+// Patterns are the log patterns matched by HandleLog() after the built-in
+// events: Milestones first, then Events. Lines matching an Ignore regexp are
+// dropped before anything else, without being echoed.
+type Patterns struct {
+	Milestones []Milestone   `json:"milestones"`
+	Events     []CustomEvent `json:"events"`
+	Ignore     []string      `json:"ignore"`
+
+	ignore []*regexp.Regexp
+}
+
+// Validate checks the patterns and compiles the regexps.
+func (p *Patterns) Validate() error {
+	err := validateMilestones(p.Milestones)
+	if err != nil {
+		return err
+	}
+	err = validateEvents(p.Events)
+	if err != nil {
+		return err
+	}
+	p.ignore, err = compileIgnore(p.Ignore)
+	return err
+}
+
+// Ignored reports whether a log line matches an ignore pattern.
+func (p *Patterns) Ignored(line string) bool {
+	for _, re := range p.ignore {
+		if re.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
+
+// compileIgnore compiles a list of ignore patterns.
+func compileIgnore(patterns []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, 0, len(patterns))
+	for i, pattern := range patterns {
+		if pattern == "" {
+			return nil, fmt.Errorf("ignore pattern %d is empty", i)
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("ignore pattern %d: %s", i, err)
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// PatternSet holds the patterns shared by every replica, so that they can be
+// replaced at runtime through the API.
+type PatternSet struct {
+	mu       sync.RWMutex
+	patterns Patterns
+}
+
+// Get returns the current patterns. The slices must not be modified.
+func (p *PatternSet) Get() Patterns {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.patterns
+}
+
+// Set replaces the patterns. They must already be validated.
+func (p *PatternSet) Set(patterns Patterns) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.patterns = patterns
+}
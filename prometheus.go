@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prometheus reports metrics to a client_golang registry and serves them at
+// /metrics. Metric names are prefixed with "mcspeedrun_" and dots become
+// underscores; counters get a "_total" suffix and timings are gauges in
+// seconds with a "_seconds" suffix. Tags become labels.
+//
+// Each metric is registered the first time it is reported, with the keys of
+// its tags as label names, so the session reports the same metrics to StatsD
+// and Prometheus from one call.
+type Prometheus struct {
+	registry *prometheus.Registry
+	handler  http.Handler
+
+	mu       sync.Mutex
+	counters map[string]*prometheus.CounterVec
+	gauges   map[string]*prometheus.GaugeVec
+}
+
+// NewPrometheus returns an empty set of metrics.
+func NewPrometheus() *Prometheus {
+	registry := prometheus.NewRegistry()
+	return &Prometheus{
+		registry: registry,
+		handler:  promhttp.HandlerFor(registry, promhttp.HandlerOpts{}),
+		counters: make(map[string]*prometheus.CounterVec),
+		gauges:   make(map[string]*prometheus.GaugeVec),
+	}
+}
+
+func (p *Prometheus) Count(name string, value int64, tags ...Tag) {
+	name = promName(name) + "_total"
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	vec, ok := p.counters[name]
+	if !ok {
+		vec = prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: promHelp(name)}, promLabelNames(tags))
+		if !p.register(name, vec) {
+			vec = nil
+		}
+		p.counters[name] = vec
+	}
+	if vec == nil {
+		return
+	}
+	counter, err := vec.GetMetricWith(promLabels(tags))
+	if err != nil {
+		log.Printf("[metrics] error counting %s: %s", name, err)
+		return
+	}
+	counter.Add(float64(value))
+}
+
+func (p *Prometheus) Gauge(name string, value float64, tags ...Tag) {
+	p.set(promName(name), value, tags)
+}
+
+func (p *Prometheus) Timing(name string, value time.Duration, tags ...Tag) {
+	p.set(promName(name)+"_seconds", value.Seconds(), tags)
+}
+
+// set sets the value of a gauge with the given labels.
+func (p *Prometheus) set(name string, value float64, tags []Tag) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	vec, ok := p.gauges[name]
+	if !ok {
+		vec = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: promHelp(name)}, promLabelNames(tags))
+		if !p.register(name, vec) {
+			vec = nil
+		}
+		p.gauges[name] = vec
+	}
+	if vec == nil {
+		return
+	}
+	gauge, err := vec.GetMetricWith(promLabels(tags))
+	if err != nil {
+		log.Printf("[metrics] error setting %s: %s", name, err)
+		return
+	}
+	gauge.Set(value)
+}
+
+// register adds a metric to the registry. A metric that can't be registered
+// is logged once and dropped from then on.
+func (p *Prometheus) register(name string, c prometheus.Collector) bool {
+	err := p.registry.Register(c)
+	if err != nil {
+		log.Printf("[metrics] error registering %s: %s", name, err)
+		return false
+	}
+	return true
+}
+
+func (p *Prometheus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.handler.ServeHTTP(w, r)
+}
+
+// Serve serves the metrics on addr at /metrics until the context is
+// cancelled.
+func (p *Prometheus) Serve(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", p)
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	log.Printf("[metrics] listening on %s", addr)
+	err := srv.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		log.Printf("[metrics] error serving: %s", err)
+	}
+}
+
+// promName converts a metric name to a Prometheus metric name.
+func promName(name string) string {
+	return "mcspeedrun_" + strings.NewReplacer(".", "_", "-", "_").Replace(name)
+}
+
+// promHelp is the help text of a metric, which is documented in the README.
+func promHelp(name string) string {
+	return "mcspeedrun metric " + name
+}
+
+// promLabelNames returns the label names of a metric reported with tags.
+func promLabelNames(tags []Tag) []string {
+	names := make([]string, len(tags))
+	for i, tag := range tags {
+		names[i] = tag.Key
+	}
+	return names
+}
+
+// promLabels converts tags to labels.
+func promLabels(tags []Tag) prometheus.Labels {
+	labels := make(prometheus.Labels, len(tags))
+	for _, tag := range tags {
+		labels[tag.Key] = tag.Value
+	}
+	return labels
+}
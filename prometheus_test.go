@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrometheus(t *testing.T) {
+	prom := NewPrometheus()
+	s, _ := newTestSession(t, 2)
+	s.Metrics = MultiMetrics{prom}
+	runLoop(t, s)
+	start := time.Now().Add(-time.Hour)
+	send(t, s,
+		ready(0), ready(1),
+		Event{GameID: 0, Timestamp: start, Type: "login", Payload: "alice joined the game"},
+		Event{GameID: 0, Timestamp: start.Add(time.Minute), Type: "nether"},
+		Event{GameID: 0, Timestamp: start.Add(2 * time.Minute), Type: "cmd.reset"},
+	)
+	prom.Count("proxy.rejected", 2, Tag{"reason", `max "conns"`})
+	// a metric reported with other labels than it was registered with is
+	// dropped rather than breaking the scrape
+	prom.Count("proxy.rejected", 1)
+
+	srv := httptest.NewServer(prom)
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("content type %q", ct)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(string(body), "\n")
+	for _, want := range []string{
+		"# TYPE mcspeedrun_attempt_total counter",
+		"mcspeedrun_attempt_total 1",
+		"# TYPE mcspeedrun_split_seconds gauge",
+		`mcspeedrun_split_seconds{split="nether"} 60`,
+		"# TYPE mcspeedrun_replica_ready gauge",
+		`mcspeedrun_replica_ready{game="0"} 0`,
+		`mcspeedrun_replica_ready{game="1"} 1`,
+		"# TYPE mcspeedrun_active_game gauge",
+		"mcspeedrun_active_game 1",
+		"# TYPE mcspeedrun_events_total counter",
+		`mcspeedrun_events_total{type="nether"} 1`,
+		`mcspeedrun_proxy_rejected_total{reason="max \"conns\""} 2`,
+	} {
+		if !contains(lines, want) {
+			t.Errorf("missing %q in:\n%s", want, body)
+		}
+	}
+}
@@ -0,0 +1,894 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// upstream holds the address of the replica that new connections are
+// proxied to. It is shared by every proxy listener.
+type upstream struct {
+	mu   sync.RWMutex
+	addr string
+
+	// changed is closed and replaced whenever addr is set.
+	changed chan struct{}
+
+	// cleared is when addr last went from a replica to "", i.e. a reset.
+	cleared time.Time
+
+	// last is the latest replica address, kept while addr is "".
+	last string
+}
+
+// Get returns the current upstream address, or "" if no replica is active.
+func (u *upstream) Get() string {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.addr
+}
+
+// Set updates the upstream address, returning the replica address it had
+// before, even if it has been cleared since.
+func (u *upstream) Set(addr string) string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if addr == "" && u.addr != "" {
+		u.cleared = time.Now()
+	}
+	last := u.last
+	if addr != "" {
+		u.last = addr
+	}
+	u.addr = addr
+	if u.changed != nil {
+		close(u.changed)
+	}
+	u.changed = make(chan struct{})
+	return last
+}
+
+// Cleared returns when the upstream address was last cleared.
+func (u *upstream) Cleared() time.Time {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.cleared
+}
+
+// Wait returns the current upstream address, waiting up to timeout for one
+// to be set if no replica is active. It returns "" if none is set in time.
+func (u *upstream) Wait(timeout time.Duration) string {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		u.mu.Lock()
+		addr := u.addr
+		if u.changed == nil {
+			u.changed = make(chan struct{})
+		}
+		changed := u.changed
+		u.mu.Unlock()
+		if addr != "" {
+			return addr
+		}
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return ""
+		}
+	}
+}
+
+// ProxyServer accepts Minecraft connections and forwards them to the current
+// upstream replica. It runs inside the session process by default, but can
+// also run standalone (-proxy-only) with upstream addresses fed over a
+// control socket, so players stay connected across session restarts.
+type ProxyServer struct {
+	// ListenAddr is the main listen address. If SpectatorAddr is set, a
+	// second listener on that address is proxied to the same replica,
+	// giving spectators a stable endpoint.
+	ListenAddr    string
+	SpectatorAddr string
+
+	// ServerPort is the port replicas are connected to.
+	ServerPort int
+
+	// ProxyProtocol sends a PROXY protocol v2 header to the replica on each
+	// connection, carrying the client's address.
+	ProxyProtocol bool
+
+	// IdleTimeout closes proxied connections with no traffic in either
+	// direction for this long. Zero disables it.
+	IdleTimeout time.Duration
+
+	// Grace holds connections made while no replica is active for up to
+	// this long, proxying them if a replica becomes active in time instead
+	// of closing them (or answering with the status) straight away.
+	Grace time.Duration
+
+	// ReconnectWindow holds the runner's reconnection for up to this long
+	// after a reset, until the next replica becomes active. The runner is
+	// the client host that last connected to the main listener.
+	ReconnectWindow time.Duration
+
+	// Status enables answering server list pings while no replica is
+	// active or the active one can't be reached, showing MOTD instead of an
+	// unreachable server. Logins are refused with MOTD as the reason.
+	// Attempt, if set, fills in {attempt} in the MOTD. Otherwise pings are
+	// relayed to the replica like any connection, so its own MOTD and player
+	// counts are shown.
+	Status  bool
+	MOTD    string
+	Attempt func() int
+
+	// DialRetries is how many more times to connect to a replica that
+	// refuses the connection or closes it straight away, as a server that
+	// is just coming up may do.
+	DialRetries int
+
+	// CaptureDir, if set, is where the raw traffic of each proxied
+	// connection is written, one file per direction.
+	CaptureDir string
+
+	// DrainGrace is how long connections to a replica are left open after
+	// switching away from it before they are closed.
+	DrainGrace time.Duration
+
+	// ConnRate, if set, limits each client host to ConnRate new connections
+	// per ConnInterval, and MaxConns limits how many connections are
+	// proxied at once. Connections over either limit are closed as soon as
+	// they are accepted. Rejections are counted in Metrics and logged every
+	// rejectReportInterval.
+	ConnRate     int
+	ConnInterval time.Duration
+	MaxConns     int
+	Metrics      MultiMetrics
+
+	// Hosts, if set, routes each connection by the server address the
+	// client connected to, as sent in its handshake, to the upstream fed by
+	// that host's channel instead of the one given to Run. This lets one
+	// port serve several sessions. Connections for any other host are
+	// disconnected.
+	Hosts map[string]<-chan string
+
+	// Empty, if set, is sent true once no connection has been open for
+	// EmptyAfter, and false as soon as a client connects again.
+	Empty      chan<- bool
+	EmptyAfter time.Duration
+
+	upstream upstream
+	hosts    map[string]*upstream
+	conns    counter
+	tracked  connTracker
+	limiter  rateLimiter
+
+	rejectedRate int64 // accessed atomically
+	rejectedMax  int64 // accessed atomically
+
+	lastConn int64 // unix nanoseconds, accessed atomically
+	emptyMu  sync.Mutex
+	empty    int32 // accessed atomically, written under emptyMu
+
+	runnerMu sync.Mutex
+	runner   string
+}
+
+// Proxy proxies all traffic on the standard Minecraft port to the active
+// replica. The replica address is updated via the ProxyAddr channel. If
+// ProxyControl is set, the addresses are instead forwarded to a standalone
+// proxy over its control socket.
+func (s *Session) Proxy(ctx context.Context) {
+	if s.ProxyControl != "" {
+		SendUpstreams(ctx, s.ProxyControl, s.ProxyAddr)
+		return
+	}
+	s.proxy.Run(ctx, s.ProxyAddr)
+}
+
+// newProxyServer creates the in-process proxy from the session's settings.
+func (s *Session) newProxyServer() *ProxyServer {
+	return &ProxyServer{
+		ListenAddr:      s.config.ProxyListenAddr(),
+		ServerPort:      s.config.ServerPort,
+		ProxyProtocol:   s.config.ProxyProtocol,
+		SpectatorAddr:   s.SpectatorAddr,
+		IdleTimeout:     s.ProxyIdleTimeout,
+		Grace:           s.ProxyGrace,
+		ReconnectWindow: s.ProxyReconnect,
+		Status:          s.ProxyStatus,
+		MOTD:            s.ProxyMOTD,
+		Attempt: func() int {
+			return s.Status().Attempt
+		},
+		DialRetries: s.ProxyDialRetries,
+		CaptureDir:  s.CaptureDir,
+		DrainGrace:  s.ProxyDrainGrace,
+
+		ConnRate:     s.ProxyConnRate,
+		ConnInterval: s.ProxyConnInterval,
+		MaxConns:     s.ProxyMaxConns,
+		Metrics:      s.Metrics,
+
+		Empty:      s.ProxyEmpty,
+		EmptyAfter: s.PauseWhenEmpty,
+	}
+}
+
+// Run starts the listeners and applies upstream addresses received on addrs
+// to all of them until the context is cancelled.
+func (p *ProxyServer) Run(ctx context.Context, addrs <-chan string) {
+	if p.CaptureDir != "" {
+		log.Printf("[proxy] capturing all traffic to %s; captures grow with every connection and include login handshakes", p.CaptureDir)
+	}
+	p.limiter.Burst = p.ConnRate
+	p.limiter.Interval = p.ConnInterval
+	if len(p.Hosts) > 0 {
+		p.hosts = make(map[string]*upstream, len(p.Hosts))
+		for host, hostAddrs := range p.Hosts {
+			u := &upstream{}
+			p.hosts[serverHost(host)] = u
+			go p.follow(ctx, host, u, hostAddrs)
+		}
+	}
+	if p.Empty != nil && p.EmptyAfter > 0 {
+		p.touch()
+		go p.watchEmpty(ctx)
+	}
+	go p.listen(ctx, "proxy", p.ListenAddr)
+	if p.SpectatorAddr != "" {
+		go p.listen(ctx, "spectator", p.SpectatorAddr)
+	}
+
+	report := time.NewTicker(rejectReportInterval)
+	defer report.Stop()
+	for {
+		select {
+		case <-report.C:
+			p.reportRejected()
+		case proxyAddr := <-addrs:
+			log.Printf("[proxy] switching to %s", proxyAddr)
+			p.switchTo(&p.upstream, proxyAddr)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// follow applies the upstream addresses received on addrs to a host's
+// upstream until the context is cancelled.
+func (p *ProxyServer) follow(ctx context.Context, host string, u *upstream, addrs <-chan string) {
+	for {
+		select {
+		case proxyAddr := <-addrs:
+			log.Printf("[proxy] switching %s to %s", host, proxyAddr)
+			p.switchTo(u, proxyAddr)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// switchTo points an upstream at proxyAddr, draining the connections to the
+// previous replica after DrainGrace once another replica is active. Clearing
+// the upstream drains nothing, as a session (re)connecting to a standalone
+// proxy clears it before sending the replica that is still active.
+func (p *ProxyServer) switchTo(u *upstream, proxyAddr string) {
+	old := u.Set(proxyAddr)
+	if old != "" && proxyAddr != "" && old != proxyAddr {
+		time.AfterFunc(p.DrainGrace, func() { p.drain(u, old) })
+	}
+}
+
+// touch records that a connection was just accepted or closed.
+func (p *ProxyServer) touch() {
+	atomic.StoreInt64(&p.lastConn, time.Now().UnixNano())
+}
+
+// watchEmpty reports on Empty whether the proxy has had no connections for
+// EmptyAfter, until the context is cancelled.
+func (p *ProxyServer) watchEmpty(ctx context.Context) {
+	ticker := time.NewTicker(p.EmptyAfter / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			last := time.Unix(0, atomic.LoadInt64(&p.lastConn))
+			p.setEmpty(ctx, p.conns.Get() == 0 && time.Since(last) >= p.EmptyAfter)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// isEmpty reports whether the proxy last reported itself empty.
+func (p *ProxyServer) isEmpty() bool {
+	return atomic.LoadInt32(&p.empty) == 1
+}
+
+// setEmpty sends empty on Empty if it differs from what was last sent.
+func (p *ProxyServer) setEmpty(ctx context.Context, empty bool) {
+	p.emptyMu.Lock()
+	defer p.emptyMu.Unlock()
+	if p.isEmpty() == empty {
+		return
+	}
+	select {
+	case p.Empty <- empty:
+	case <-ctx.Done():
+		return
+	}
+	if empty {
+		atomic.StoreInt32(&p.empty, 1)
+	} else {
+		atomic.StoreInt32(&p.empty, 0)
+	}
+}
+
+// Retry delays for a proxy listener that fails to listen.
+const (
+	listenRetryMin = time.Second
+	listenRetryMax = 30 * time.Second
+)
+
+// listenConfig is used for the proxy listeners, reusing addresses so that a
+// listener can be reopened straight away.
+var listenConfig = net.ListenConfig{Control: reuseAddr}
+
+// listen accepts connections on addr and hands them to proxyConn until the
+// context is cancelled. If listening fails, it retries with a growing delay.
+func (p *ProxyServer) listen(ctx context.Context, name string, addr string) {
+	retry := listenRetryMin
+	for {
+		l, err := listenConfig.Listen(ctx, "tcp", addr)
+		if err != nil {
+			log.Printf("[%s] error listening on %s, retrying in %s: %s", name, addr, retry, err)
+			select {
+			case <-time.After(retry):
+			case <-ctx.Done():
+				return
+			}
+			retry *= 2
+			if retry > listenRetryMax {
+				retry = listenRetryMax
+			}
+			continue
+		}
+		retry = listenRetryMin
+
+		go func(l net.Listener) {
+			<-ctx.Done()
+			l.Close()
+		}(l)
+
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				log.Printf("[%s] error accepting connection: %s", name, err)
+				break
+			}
+			if !p.admit(conn) {
+				conn.Close()
+				continue
+			}
+			p.touch()
+			if p.isEmpty() {
+				go p.setEmpty(ctx, false)
+			}
+			if p.hosts != nil {
+				go p.route(name, conn, addr == p.ListenAddr)
+				continue
+			}
+			p.forward(name, conn, &p.upstream, addr == p.ListenAddr)
+		}
+
+		l.Close()
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+	}
+}
+
+// forward proxies a connection to an upstream's replica, or holds it if no
+// replica is active. Clients of the main listener are taken for the runner.
+func (p *ProxyServer) forward(name string, c net.Conn, u *upstream, main bool) {
+	proxyAddr := u.Get()
+	if proxyAddr == "" {
+		go p.hold(name, c, u)
+		return
+	}
+	log.Printf("[%s] %s -> %s", name, c.RemoteAddr(), proxyAddr)
+	if main {
+		p.setRunner(c)
+	}
+
+	// Handle the connection in a new goroutine.
+	go p.proxyConn(c, proxyAddr)
+}
+
+// route reads a connection's handshake and forwards it to the upstream of the
+// host it names. The handshake is replayed to the replica. Logins for an
+// unknown host are refused with a message; anything else is closed.
+func (p *ProxyServer) route(name string, c net.Conn, main bool) {
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := &recordingReader{r: bufio.NewReader(c)}
+	first, err := r.r.Peek(1)
+	if err != nil {
+		c.Close()
+		return
+	}
+	var h handshake
+	if first[0] == legacyPing {
+		// only 1.6 clients name the host they pinged
+		h.Address, err = legacyPingHost(r)
+		if err != nil {
+			c.Close()
+			return
+		}
+		h.NextState = nextStateStatus
+	} else {
+		id, data, err := readPacket(r)
+		if err != nil || id != 0x00 {
+			c.Close()
+			return
+		}
+		h, err = parseHandshake(data)
+		if err != nil {
+			log.Printf("[%s] invalid handshake from %s: %s", name, c.RemoteAddr(), err)
+			c.Close()
+			return
+		}
+	}
+	host := serverHost(h.Address)
+	u, ok := p.hosts[host]
+	if !ok {
+		log.Printf("[%s] %s connected to unknown host %q", name, c.RemoteAddr(), host)
+		if h.NextState == nextStateLogin {
+			err = writeDisconnect(c, "unknown server "+host)
+			if err != nil {
+				log.Printf("[%s] error writing disconnect: %s", name, err)
+			}
+		}
+		c.Close()
+		return
+	}
+	c.SetReadDeadline(time.Time{})
+	replay := io.MultiReader(bytes.NewReader(r.read), r.r)
+	p.forward(name+" "+host, &peekedConn{c, replay}, u, main)
+}
+
+// recordingReader keeps the bytes read from r, so that they can be replayed.
+type recordingReader struct {
+	r    *bufio.Reader
+	read []byte
+}
+
+func (r *recordingReader) ReadByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err == nil {
+		r.read = append(r.read, b)
+	}
+	return b, err
+}
+
+// rejectReportInterval is how often rejected connections are logged.
+const rejectReportInterval = time.Minute
+
+// admit reports whether a new connection is within the connection limits,
+// counting it as rejected if not.
+func (p *ProxyServer) admit(c net.Conn) bool {
+	if p.MaxConns > 0 && p.conns.Get() >= int64(p.MaxConns) {
+		atomic.AddInt64(&p.rejectedMax, 1)
+		p.Metrics.Count("proxy.rejected", 1, Tag{"reason", "max_conns"})
+		return false
+	}
+	if p.ConnRate > 0 && p.ConnInterval > 0 {
+		host, _, err := net.SplitHostPort(c.RemoteAddr().String())
+		if err == nil && !p.limiter.Allow(host, time.Now()) {
+			atomic.AddInt64(&p.rejectedRate, 1)
+			p.Metrics.Count("proxy.rejected", 1, Tag{"reason", "rate"})
+			return false
+		}
+	}
+	return true
+}
+
+// reportRejected logs the connections rejected since the last report, if
+// any.
+func (p *ProxyServer) reportRejected() {
+	rate := atomic.SwapInt64(&p.rejectedRate, 0)
+	max := atomic.SwapInt64(&p.rejectedMax, 0)
+	if rate == 0 && max == 0 {
+		return
+	}
+	log.Printf("[proxy] rejected %d connections over the rate limit and %d over the connection limit in the last %s (%d open)",
+		rate, max, rejectReportInterval, p.conns.Get())
+}
+
+// drain closes the connections to a replica that is no longer the upstream.
+func (p *ProxyServer) drain(u *upstream, proxyAddr string) {
+	if u.Get() == proxyAddr {
+		return
+	}
+	closers := p.tracked.Take(proxyAddr)
+	for _, close := range closers {
+		close()
+	}
+	if len(closers) > 0 {
+		log.Printf("[proxy] closed %d connections to %s", len(closers), proxyAddr)
+	}
+}
+
+// hold handles a connection made while no replica of an upstream is active. It waits out
+// the grace period for a replica, then falls back to the status responder
+// or closes the connection.
+func (p *ProxyServer) hold(name string, c net.Conn, u *upstream) {
+	wait := p.Grace
+	if p.ReconnectWindow > 0 && p.isRunner(c) {
+		remaining := p.ReconnectWindow - time.Since(u.Cleared())
+		if remaining > wait {
+			wait = remaining
+		}
+	}
+	if wait > 0 {
+		proxyAddr := u.Wait(wait)
+		if proxyAddr != "" {
+			log.Printf("[%s] %s -> %s (held)", name, c.RemoteAddr(), proxyAddr)
+			p.proxyConn(c, proxyAddr)
+			return
+		}
+	}
+	if p.Status {
+		p.serveStatus(c)
+	} else {
+		c.Close()
+	}
+}
+
+// setRunner records the host of a client connected to the main listener.
+func (p *ProxyServer) setRunner(c net.Conn) {
+	host, _, err := net.SplitHostPort(c.RemoteAddr().String())
+	if err != nil {
+		return
+	}
+	p.runnerMu.Lock()
+	defer p.runnerMu.Unlock()
+	p.runner = host
+}
+
+// isRunner reports whether a client is from the runner's host.
+func (p *ProxyServer) isRunner(c net.Conn) bool {
+	host, _, err := net.SplitHostPort(c.RemoteAddr().String())
+	if err != nil {
+		return false
+	}
+	p.runnerMu.Lock()
+	defer p.runnerMu.Unlock()
+	return host == p.runner
+}
+
+// serveStatus answers a client while no replica is active. Server list pings
+// are answered with the MOTD and logins are refused with it as the reason;
+// anything else is closed.
+func (p *ProxyServer) serveStatus(c net.Conn) {
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(c)
+	motd := p.motd()
+
+	first, err := r.Peek(1)
+	if err != nil {
+		return
+	}
+	if first[0] == legacyPing {
+		err = writeLegacyStatus(c, "mcspeedrun", motd, 0, 0)
+		if err != nil {
+			log.Printf("[proxy] error writing legacy status: %s", err)
+		}
+		return
+	}
+
+	id, data, err := readPacket(r)
+	if err != nil || id != 0x00 {
+		return
+	}
+	h, err := parseHandshake(data)
+	if err != nil {
+		log.Printf("[proxy] invalid handshake from %s: %s", c.RemoteAddr(), err)
+		return
+	}
+
+	switch h.NextState {
+	case nextStateStatus:
+		for {
+			id, data, err := readPacket(r)
+			if err != nil {
+				return
+			}
+			switch id {
+			case 0x00:
+				err = writeStatus(c, h.Protocol, "mcspeedrun", motd)
+			case 0x01:
+				// ping: echo the payload back as the pong
+				err = writePacket(c, 0x01, data)
+				if err == nil {
+					return
+				}
+			default:
+				return
+			}
+			if err != nil {
+				log.Printf("[proxy] error writing status: %s", err)
+				return
+			}
+		}
+	case nextStateLogin:
+		log.Printf("[proxy] refusing login from %s: no server is ready", c.RemoteAddr())
+		err = writeDisconnect(c, motd)
+		if err != nil {
+			log.Printf("[proxy] error writing disconnect: %s", err)
+		}
+	}
+}
+
+// motd returns the MOTD with {attempt} replaced by the upcoming attempt
+// number, if known.
+func (p *ProxyServer) motd() string {
+	if p.Attempt == nil {
+		return p.MOTD
+	}
+	return strings.ReplaceAll(p.MOTD, "{attempt}", strconv.Itoa(p.Attempt()))
+}
+
+// proxyConn connects to the replica at proxyAddr and copies traffic in both
+// directions until either side closes.
+func (p *ProxyServer) proxyConn(c net.Conn, proxyAddr string) {
+	var proxy net.Conn
+	var err error
+
+	// connect to proxy address, answering server list pings ourselves if
+	// the replica can't be reached
+	proxy, err = p.dialUpstream(proxyAddr)
+	if err != nil {
+		log.Printf("[proxy] error connecting to proxy: %s", err)
+		if p.Status {
+			p.serveStatus(c)
+		} else {
+			c.Close()
+		}
+		return
+	}
+	if p.ProxyProtocol {
+		err = writeProxyHeader(proxy, c.RemoteAddr(), c.LocalAddr())
+		if err != nil {
+			log.Printf("[proxy] error writing PROXY header: %s", err)
+			c.Close()
+			proxy.Close()
+			return
+		}
+	}
+
+	// Close the connection once, whether it ends or is drained.
+	var once sync.Once
+	id := p.tracked.NewID()
+	p.conns.Inc()
+	p.Metrics.Gauge("proxy.conns", float64(p.conns.Get()))
+	onceBody := func() {
+		c.Close()
+		proxy.Close()
+		p.touch()
+		p.conns.Dec()
+		p.Metrics.Gauge("proxy.conns", float64(p.conns.Get()))
+		p.tracked.Remove(proxyAddr, id)
+	}
+	p.tracked.Add(proxyAddr, id, func() { once.Do(onceBody) })
+
+	// Tee each direction into its own capture file, closed once that
+	// direction is done.
+	var toProxy, toClient net.Conn = proxy, c
+	closeUp, closeDown := func() {}, func() {}
+	if p.CaptureDir != "" {
+		up, down, err := createCaptures(p.CaptureDir, c.RemoteAddr())
+		if err != nil {
+			log.Printf("[proxy] error creating capture files: %s", err)
+		} else {
+			toProxy = &captureConn{proxy, up}
+			toClient = &captureConn{c, down}
+			closeUp = func() { up.Close() }
+			closeDown = func() { down.Close() }
+		}
+	}
+
+	// Pick the copy function, reaping connections idle in both directions
+	// if an idle timeout is configured.
+	copyFn := func(dst, src net.Conn) error {
+		_, err := io.Copy(dst, src)
+		return err
+	}
+	if p.IdleTimeout > 0 {
+		idle := newIdleTracker(p.IdleTimeout)
+		copyFn = func(dst, src net.Conn) error {
+			err := idle.Copy(dst, src)
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				log.Printf("[proxy] closing idle connection from %s", c.RemoteAddr())
+			}
+			return err
+		}
+	}
+
+	// Read from conn, send to proxy.
+	go func(c net.Conn) {
+		copyFn(toProxy, c)
+		once.Do(onceBody)
+		closeUp()
+	}(c)
+
+	// Read from proxy, send to conn.
+	go func(c net.Conn) {
+		copyFn(toClient, proxy)
+		once.Do(onceBody)
+		closeDown()
+	}(c)
+}
+
+// connTracker records the open proxied connections to each replica, so that
+// they can be closed when the proxy switches away from it.
+type connTracker struct {
+	nextID uint64 // accessed atomically
+
+	mu    sync.Mutex
+	conns map[string]map[uint64]func()
+}
+
+// NewID returns a unique ID for a connection.
+func (t *connTracker) NewID() uint64 {
+	return atomic.AddUint64(&t.nextID, 1)
+}
+
+// Add tracks a connection to proxyAddr, closed by calling close.
+func (t *connTracker) Add(proxyAddr string, id uint64, close func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conns == nil {
+		t.conns = make(map[string]map[uint64]func())
+	}
+	if t.conns[proxyAddr] == nil {
+		t.conns[proxyAddr] = make(map[uint64]func())
+	}
+	t.conns[proxyAddr][id] = close
+}
+
+// Remove stops tracking a connection.
+func (t *connTracker) Remove(proxyAddr string, id uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.conns[proxyAddr], id)
+	if len(t.conns[proxyAddr]) == 0 {
+		delete(t.conns, proxyAddr)
+	}
+}
+
+// Take stops tracking every connection to proxyAddr and returns the functions
+// that close them.
+func (t *connTracker) Take(proxyAddr string) []func() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var closers []func()
+	for _, close := range t.conns[proxyAddr] {
+		closers = append(closers, close)
+	}
+	delete(t.conns, proxyAddr)
+	return closers
+}
+
+const (
+	// dialSettle is how long a new upstream connection must stay open
+	// before it is used, when retries are enabled.
+	dialSettle = 200 * time.Millisecond
+
+	dialRetryDelay = 500 * time.Millisecond
+)
+
+// dialUpstream connects to the replica at proxyAddr, retrying up to
+// DialRetries times if the connection is refused or closed by the replica
+// within dialSettle.
+func (p *ProxyServer) dialUpstream(proxyAddr string) (net.Conn, error) {
+	for attempt := 0; ; attempt++ {
+		conn, err := net.Dial("tcp", net.JoinHostPort(proxyAddr, strconv.Itoa(p.ServerPort)))
+		if err == nil && p.DialRetries > 0 {
+			conn, err = settle(conn)
+		}
+		if err == nil || attempt >= p.DialRetries {
+			return conn, err
+		}
+		log.Printf("[proxy] retrying connection to %s: %s", proxyAddr, err)
+		time.Sleep(dialRetryDelay)
+	}
+}
+
+// settle waits up to dialSettle for the replica to close a new connection.
+// The replica speaks only after the client, so a read normally times out;
+// anything it does send is kept for the client.
+func settle(conn net.Conn) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(dialSettle))
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	conn.SetReadDeadline(time.Time{})
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return conn, nil
+	}
+	if n > 0 {
+		return &peekedConn{conn, io.MultiReader(bytes.NewReader(buf[:n]), conn)}, nil
+	}
+	conn.Close()
+	if err == io.EOF {
+		err = errors.New("connection closed by server")
+	}
+	return nil, err
+}
+
+// peekedConn is a connection whose first bytes have already been read.
+type peekedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// idleTracker records the last time bytes flowed in either direction of a
+// proxied connection pair.
+type idleTracker struct {
+	timeout time.Duration
+	last    int64 // unix nanoseconds, accessed atomically
+}
+
+func newIdleTracker(timeout time.Duration) *idleTracker {
+	return &idleTracker{
+		timeout: timeout,
+		last:    time.Now().UnixNano(),
+	}
+}
+
+// Expired reports whether no bytes have flowed for the idle timeout.
+func (t *idleTracker) Expired() bool {
+	last := time.Unix(0, atomic.LoadInt64(&t.last))
+	return time.Since(last) >= t.timeout
+}
+
+// Copy copies from src to dst like io.Copy, but gives up once the pair has
+// been idle in both directions for the timeout. A read deadline that expires
+// while the other direction is still active is simply extended.
+func (t *idleTracker) Copy(dst net.Conn, src net.Conn) error {
+	buf := make([]byte, 32*1024)
+	for {
+		src.SetReadDeadline(time.Now().Add(t.timeout))
+		n, err := src.Read(buf)
+		if n > 0 {
+			atomic.StoreInt64(&t.last, time.Now().UnixNano())
+			_, werr := dst.Write(buf[:n])
+			if werr != nil {
+				return werr
+			}
+		}
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && !t.Expired() {
+				continue
+			}
+			return err
+		}
+	}
+}
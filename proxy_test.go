@@ -0,0 +1,688 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestServeStatus(t *testing.T) {
+	p := &ProxyServer{MOTD: "attempt #{attempt} is loading", Attempt: func() int { return 7 }}
+	const motd = "attempt #7 is loading"
+
+	tests := []struct {
+		name    string
+		packets [][]byte
+		id      int32
+		want    string
+	}{
+		{
+			"status",
+			[][]byte{handshakeData(754, "localhost", 25565, nextStateStatus), {}},
+			0x00,
+			`{"version":{"name":"mcspeedrun","protocol":754},"players":{"max":0,"online":0},"description":{"text":"` + motd + `","color":"white"}}`,
+		},
+		{
+			"login",
+			[][]byte{handshakeData(754, "localhost", 25565, nextStateLogin), appendString(nil, "alice")},
+			0x00,
+			`{"text":"` + motd + `","color":"white"}`,
+		},
+	}
+	for _, tt := range tests {
+		c, server := net.Pipe()
+		go p.serveStatus(server)
+		go func() {
+			for _, data := range tt.packets {
+				writePacket(c, 0x00, data)
+			}
+		}()
+		id, data, err := readPacket(bufio.NewReader(c))
+		c.Close()
+		if err != nil || id != tt.id {
+			t.Errorf("%s: response %#x, %v", tt.name, id, err)
+			continue
+		}
+		n, err := readVarInt(bytes.NewReader(data))
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		got := string(data[len(appendVarInt(nil, n)):])
+		if !json.Valid([]byte(got)) || got != tt.want {
+			t.Errorf("%s: response %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestServeStatusPing(t *testing.T) {
+	p := &ProxyServer{MOTD: "loading"}
+	c, server := net.Pipe()
+	defer c.Close()
+	go p.serveStatus(server)
+	go func() {
+		writePacket(c, 0x00, handshakeData(754, "localhost", 25565, nextStateStatus))
+		writePacket(c, 0x01, []byte{1, 2, 3, 4, 5, 6, 7, 8})
+	}()
+	id, data, err := readPacket(bufio.NewReader(c))
+	if err != nil || id != 0x01 || !bytes.Equal(data, []byte{1, 2, 3, 4, 5, 6, 7, 8}) {
+		t.Errorf("pong %#x, % x, %v", id, data, err)
+	}
+}
+
+// echoServer echoes everything sent to it on host until the test ends,
+// returning its port.
+func echoServer(t *testing.T, host string) int {
+	l, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// freeAddr returns an address on host that nothing is listening on.
+func freeAddr(t *testing.T, host string) string {
+	l, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// runProxy runs p until the test ends, returning the channel feeding it
+// upstream addresses once its listener is up. An IPv4 listener is probed
+// from another loopback address than the test's clients, so that the probe
+// is never taken for the runner.
+func runProxy(t *testing.T, p *ProxyServer) chan<- string {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	addrs := make(chan string)
+	go p.Run(ctx, addrs)
+	var probe net.Dialer
+	host, _, _ := net.SplitHostPort(p.ListenAddr)
+	if net.ParseIP(host).To4() != nil {
+		probe.LocalAddr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2)}
+	}
+	for i := 0; ; i++ {
+		c, err := probe.Dial("tcp", p.ListenAddr)
+		if err == nil {
+			c.Close()
+			return addrs
+		}
+		if i == 100 {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// setUpstream points the proxy at addr, waiting until it has switched.
+func setUpstream(t *testing.T, p *ProxyServer, addrs chan<- string, addr string) {
+	addrs <- addr
+	for i := 0; p.upstream.Get() != addr; i++ {
+		if i == 100 {
+			t.Fatalf("proxy didn't switch to %q", addr)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// echo checks that a message sent over c comes back.
+func echo(t *testing.T, c net.Conn, msg string) {
+	t.Helper()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err := io.WriteString(c, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	_, err = io.ReadFull(c, buf)
+	if err != nil || string(buf) != msg {
+		t.Fatalf("echoed %q, %v, want %q", buf, err, msg)
+	}
+}
+
+func TestProxySpectator(t *testing.T) {
+	p := &ProxyServer{
+		ListenAddr:    freeAddr(t, "127.0.0.1"),
+		SpectatorAddr: freeAddr(t, "127.0.0.1"),
+		ServerPort:    echoServer(t, "127.0.0.1"),
+	}
+	addrs := runProxy(t, p)
+	setUpstream(t, p, addrs, "127.0.0.1")
+
+	for _, addr := range []string{p.ListenAddr, p.SpectatorAddr} {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		echo(t, c, "hello from "+addr)
+		c.Close()
+	}
+}
+
+func TestProxyHosts(t *testing.T) {
+	mc1 := make(chan string)
+	p := &ProxyServer{
+		ListenAddr: freeAddr(t, "127.0.0.1"),
+		ServerPort: echoServer(t, "127.0.0.1"),
+		Hosts: map[string]<-chan string{
+			"mc1.example.com": mc1,
+			"mc2.example.com": make(chan string),
+		},
+	}
+	runProxy(t, p)
+	mc1 <- "127.0.0.1"
+	for i := 0; p.hosts["mc1.example.com"].Get() != "127.0.0.1"; i++ {
+		if i == 100 {
+			t.Fatal("proxy didn't switch mc1.example.com")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	tests := []struct {
+		name string
+		host string
+		want []byte
+	}{
+		// the echo server sends the replayed handshake back
+		{"known host", "MC1.example.com.", handshakeData(754, "MC1.example.com.", 25565, nextStateLogin)},
+		{"unknown host", "mc3.example.com", appendString(nil, `{"text":"unknown server mc3.example.com","color":"white"}`)},
+	}
+	for _, tt := range tests {
+		c, err := net.Dial("tcp", p.ListenAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		writePacket(c, 0x00, handshakeData(754, tt.host, 25565, nextStateLogin))
+		id, data, err := readPacket(bufio.NewReader(c))
+		c.Close()
+		if err != nil || id != 0x00 || !bytes.Equal(data, tt.want) {
+			t.Errorf("%s: response %#x %q, %v, want %q", tt.name, id, data, err, tt.want)
+		}
+	}
+
+	// 1.6 clients name the host in their legacy ping
+	ping := legacyPingData("mc1.example.com")
+	c, err := net.Dial("tcp", p.ListenAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	c.Write(ping)
+	got := make([]byte, len(ping))
+	_, err = io.ReadFull(c, got)
+	if err != nil || !bytes.Equal(got, ping) {
+		t.Errorf("legacy ping: response % x, %v, want % x", got, err, ping)
+	}
+}
+
+// statusServer answers status requests on host with a status naming the
+// player count until the test ends, returning its port.
+func statusServer(t *testing.T, host string, online int) int {
+	l, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				r := bufio.NewReader(c)
+				readPacket(r) // handshake
+				readPacket(r) // status request
+				status := fmt.Sprintf(`{"players":{"max":20,"online":%d}}`, online)
+				writePacket(c, 0x00, appendString(nil, status))
+			}()
+		}
+	}()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestProxyStatus(t *testing.T) {
+	p := &ProxyServer{
+		ListenAddr: freeAddr(t, "127.0.0.1"),
+		ServerPort: statusServer(t, "127.0.0.1", 3),
+		Status:     true,
+		MOTD:       "loading",
+	}
+	addrs := runProxy(t, p)
+
+	tests := []struct {
+		name     string
+		upstream string
+		want     string
+	}{
+		{"relayed", "127.0.0.1", `{"players":{"max":20,"online":3}}`},
+		// nothing listens on the server port there
+		{"unreachable", "127.0.0.3", `{"version":{"name":"mcspeedrun","protocol":754},"players":{"max":0,"online":0},"description":{"text":"loading","color":"white"}}`},
+	}
+	for _, tt := range tests {
+		setUpstream(t, p, addrs, tt.upstream)
+		c, err := net.Dial("tcp", p.ListenAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		writePacket(c, 0x00, handshakeData(754, "localhost", 25565, nextStateStatus))
+		writePacket(c, 0x00, nil)
+		id, data, err := readPacket(bufio.NewReader(c))
+		c.Close()
+		if err != nil || id != 0x00 || !bytes.Equal(data, appendString(nil, tt.want)) {
+			t.Errorf("%s: response %#x %q, %v, want %s", tt.name, id, data, err, tt.want)
+		}
+	}
+}
+
+func TestProxyIdleTimeout(t *testing.T) {
+	p := &ProxyServer{
+		ListenAddr:  freeAddr(t, "127.0.0.1"),
+		ServerPort:  echoServer(t, "127.0.0.1"),
+		IdleTimeout: 100 * time.Millisecond,
+	}
+	addrs := runProxy(t, p)
+	setUpstream(t, p, addrs, "127.0.0.1")
+
+	tests := []struct {
+		name     string
+		interval time.Duration
+		open     bool
+	}{
+		{"active", 20 * time.Millisecond, true},
+		{"idle", 300 * time.Millisecond, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := net.Dial("tcp", p.ListenAddr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			for elapsed := time.Duration(0); elapsed < 300*time.Millisecond; elapsed += tt.interval {
+				echo(t, c, "ping")
+				time.Sleep(tt.interval)
+			}
+
+			c.SetDeadline(time.Now().Add(5 * time.Second))
+			io.WriteString(c, "ping")
+			_, err = io.ReadFull(c, make([]byte, 4))
+			if open := err == nil; open != tt.open {
+				t.Errorf("connection open %t, want %t: %v", open, tt.open, err)
+			}
+		})
+	}
+}
+
+func TestProxyEmpty(t *testing.T) {
+	empty := make(chan bool)
+	p := &ProxyServer{
+		ListenAddr: freeAddr(t, "127.0.0.1"),
+		ServerPort: echoServer(t, "127.0.0.1"),
+		Empty:      empty,
+		EmptyAfter: 100 * time.Millisecond,
+	}
+	addrs := runProxy(t, p)
+	setUpstream(t, p, addrs, "127.0.0.1")
+	expect := func(want bool) {
+		t.Helper()
+		select {
+		case got := <-empty:
+			if got != want {
+				t.Fatalf("empty %t, want %t", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no report, want empty %t", want)
+		}
+	}
+
+	expect(true)
+	c, err := net.Dial("tcp", p.ListenAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(false)
+	echo(t, c, "hello")
+	// an open connection keeps the proxy from being empty
+	select {
+	case got := <-empty:
+		t.Fatalf("empty %t with a connection open", got)
+	case <-time.After(300 * time.Millisecond):
+	}
+	c.Close()
+	expect(true)
+}
+
+func TestProxyCapture(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "captures")
+	p := &ProxyServer{
+		ListenAddr: freeAddr(t, "127.0.0.1"),
+		ServerPort: echoServer(t, "127.0.0.1"),
+		CaptureDir: dir,
+	}
+	addrs := runProxy(t, p)
+	setUpstream(t, p, addrs, "127.0.0.1")
+
+	c, err := net.Dial("tcp", p.ListenAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, c, "hello")
+	echo(t, c, " world")
+	c.Close()
+
+	for _, suffix := range []string{"_up.bin", "_down.bin"} {
+		var data []byte
+		for i := 0; i < 100 && string(data) != "hello world"; i++ {
+			time.Sleep(10 * time.Millisecond)
+			// the runProxy probe leaves empty captures behind
+			files, _ := filepath.Glob(filepath.Join(dir, "*"+suffix))
+			for _, file := range files {
+				if b, _ := ioutil.ReadFile(file); len(b) > 0 {
+					data = b
+					fi, err := os.Stat(file)
+					if err != nil || fi.Mode().Perm() != 0600 {
+						t.Errorf("%s: mode %v, %v, want 0600", file, fi.Mode(), err)
+					}
+				}
+			}
+		}
+		if string(data) != "hello world" {
+			t.Errorf("%s capture is %q, want %q", suffix, data, "hello world")
+		}
+	}
+}
+
+// startingServer is a replica coming up: it closes its first connections
+// straight away, then greets and echoes. It returns its port.
+func startingServer(t *testing.T, closeFirst int, greeting string) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for i := 0; ; i++ {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if i < closeFirst {
+				c.Close()
+				continue
+			}
+			go func() {
+				io.WriteString(c, greeting)
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestDialUpstream(t *testing.T) {
+	tests := []struct {
+		name       string
+		retries    int
+		closeFirst int
+		greeting   string
+		err        string
+	}{
+		{"up", 1, 0, "", ""},
+		{"closed once", 2, 1, "", ""},
+		{"closed too often", 1, 2, "", "connection closed by server"},
+		{"greeting kept", 1, 0, "hi", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &ProxyServer{
+				ServerPort:  startingServer(t, tt.closeFirst, tt.greeting),
+				DialRetries: tt.retries,
+			}
+			c, err := p.dialUpstream("127.0.0.1")
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Errorf("error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			if tt.greeting != "" {
+				buf := make([]byte, len(tt.greeting))
+				_, err := io.ReadFull(c, buf)
+				if err != nil || string(buf) != tt.greeting {
+					t.Errorf("greeting %q, %v, want %q", buf, err, tt.greeting)
+				}
+			}
+			echo(t, c, "hello")
+		})
+	}
+}
+
+func TestUpstreamWait(t *testing.T) {
+	tests := []struct {
+		name  string
+		set   []string
+		delay time.Duration
+		addr  string
+	}{
+		{"already set", []string{"10.0.0.1"}, 0, "10.0.0.1"},
+		{"set while waiting", []string{"10.0.0.1"}, 20 * time.Millisecond, "10.0.0.1"},
+		{"cleared while waiting", []string{""}, 20 * time.Millisecond, ""},
+		{"set after clearing", []string{"", "10.0.0.2"}, 20 * time.Millisecond, "10.0.0.2"},
+		{"never set", nil, 0, ""},
+	}
+	for _, tt := range tests {
+		var u upstream
+		set := func() {
+			for _, addr := range tt.set {
+				u.Set(addr)
+			}
+		}
+		if tt.delay == 0 {
+			set()
+		} else {
+			time.AfterFunc(tt.delay, set)
+		}
+		if addr := u.Wait(200 * time.Millisecond); addr != tt.addr {
+			t.Errorf("%s: waited for %q, want %q", tt.name, addr, tt.addr)
+		}
+	}
+}
+
+func TestProxyDrain(t *testing.T) {
+	tests := []struct {
+		name     string
+		switches []string
+		drained  bool
+	}{
+		{"cleared", []string{""}, false},
+		{"session reconnected", []string{"", "127.0.0.1"}, false},
+		{"switched", []string{"127.0.0.2"}, true},
+		{"switched after a reset", []string{"", "127.0.0.2"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &ProxyServer{
+				ListenAddr: freeAddr(t, "127.0.0.1"),
+				ServerPort: echoServer(t, "127.0.0.1"),
+			}
+			addrs := runProxy(t, p)
+			setUpstream(t, p, addrs, "127.0.0.1")
+			c, err := net.Dial("tcp", p.ListenAddr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			echo(t, c, "hello")
+
+			for _, addr := range tt.switches {
+				setUpstream(t, p, addrs, addr)
+			}
+			time.Sleep(50 * time.Millisecond)
+			c.SetDeadline(time.Now().Add(5 * time.Second))
+			_, err = io.WriteString(c, "again")
+			buf := make([]byte, 5)
+			if err == nil {
+				_, err = io.ReadFull(c, buf)
+			}
+			if drained := err != nil; drained != tt.drained {
+				t.Errorf("drained %t, want %t: read %q, %v", drained, tt.drained, buf, err)
+			}
+		})
+	}
+}
+
+func TestProxyGrace(t *testing.T) {
+	tests := []struct {
+		name  string
+		grace time.Duration
+		held  bool
+	}{
+		{"no grace", 0, false},
+		{"grace", 5 * time.Second, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &ProxyServer{
+				ListenAddr: freeAddr(t, "127.0.0.1"),
+				ServerPort: echoServer(t, "127.0.0.1"),
+				Grace:      tt.grace,
+			}
+			addrs := runProxy(t, p)
+
+			c, err := net.Dial("tcp", p.ListenAddr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			_, err = io.WriteString(c, "hello")
+			if err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(50 * time.Millisecond)
+			setUpstream(t, p, addrs, "127.0.0.1")
+
+			c.SetDeadline(time.Now().Add(5 * time.Second))
+			buf := make([]byte, 5)
+			_, err = io.ReadFull(c, buf)
+			if held := err == nil && string(buf) == "hello"; held != tt.held {
+				t.Errorf("held %t, want %t: read %q, %v", held, tt.held, buf, err)
+			}
+		})
+	}
+}
+
+func TestProxyReconnectWindow(t *testing.T) {
+	tests := []struct {
+		name      string
+		window    time.Duration
+		connected string // the listener connected to before the reset
+		wait      time.Duration
+		held      bool
+	}{
+		{"runner", 5 * time.Second, "proxy", 0, true},
+		{"never connected", 5 * time.Second, "", 0, false},
+		{"spectator", 5 * time.Second, "spectator", 0, false},
+		{"window over", 100 * time.Millisecond, "proxy", 200 * time.Millisecond, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &ProxyServer{
+				ListenAddr:      freeAddr(t, "127.0.0.1"),
+				SpectatorAddr:   freeAddr(t, "127.0.0.1"),
+				ServerPort:      echoServer(t, "127.0.0.1"),
+				ReconnectWindow: tt.window,
+			}
+			addrs := runProxy(t, p)
+			setUpstream(t, p, addrs, "127.0.0.1")
+			if tt.connected != "" {
+				addr := p.ListenAddr
+				if tt.connected == "spectator" {
+					addr = p.SpectatorAddr
+				}
+				c, err := net.Dial("tcp", addr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				echo(t, c, "hello")
+				c.Close()
+			}
+
+			// the run is reset, and the runner reconnects before the next
+			// world is up
+			setUpstream(t, p, addrs, "")
+			time.Sleep(tt.wait)
+			c, err := net.Dial("tcp", p.ListenAddr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			io.WriteString(c, "hello")
+			time.Sleep(50 * time.Millisecond)
+			setUpstream(t, p, addrs, "127.0.0.1")
+
+			c.SetDeadline(time.Now().Add(5 * time.Second))
+			buf := make([]byte, 5)
+			_, err = io.ReadFull(c, buf)
+			if held := err == nil && string(buf) == "hello"; held != tt.held {
+				t.Errorf("held %t, want %t: read %q, %v", held, tt.held, buf, err)
+			}
+		})
+	}
+}
+
+func TestProxyIPv6(t *testing.T) {
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %s", err)
+	}
+	l.Close()
+
+	p := &ProxyServer{
+		ListenAddr: freeAddr(t, "::1"),
+		ServerPort: echoServer(t, "::1"),
+	}
+	addrs := runProxy(t, p)
+	setUpstream(t, p, addrs, "::1")
+
+	c, err := net.Dial("tcp", p.ListenAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	echo(t, c, "hello")
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+)
+
+// proxyProtoSignature starts every PROXY protocol v2 header.
+var proxyProtoSignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// writeProxyHeader writes a PROXY protocol v2 header telling the server that
+// the connection is from src to dst. Addresses that aren't TCP are sent as a
+// LOCAL connection, which the server treats as its own.
+func writeProxyHeader(w io.Writer, src net.Addr, dst net.Addr) error {
+	var buf bytes.Buffer
+	buf.Write(proxyProtoSignature)
+
+	s, sok := src.(*net.TCPAddr)
+	d, dok := dst.(*net.TCPAddr)
+	switch {
+	case sok && dok && s.IP.To4() != nil && d.IP.To4() != nil:
+		buf.Write([]byte{0x21, 0x11})
+		binary.Write(&buf, binary.BigEndian, uint16(12))
+		buf.Write(s.IP.To4())
+		buf.Write(d.IP.To4())
+	case sok && dok && s.IP.To16() != nil && d.IP.To16() != nil:
+		buf.Write([]byte{0x21, 0x21})
+		binary.Write(&buf, binary.BigEndian, uint16(36))
+		buf.Write(s.IP.To16())
+		buf.Write(d.IP.To16())
+	default:
+		buf.Write([]byte{0x20, 0x00, 0x00, 0x00})
+		_, err := w.Write(buf.Bytes())
+		return err
+	}
+	binary.Write(&buf, binary.BigEndian, uint16(s.Port))
+	binary.Write(&buf, binary.BigEndian, uint16(d.Port))
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestWriteProxyHeader(t *testing.T) {
+	sig := string(proxyProtoSignature)
+	tests := []struct {
+		name     string
+		src, dst net.Addr
+		want     string
+	}{
+		{
+			"ipv4",
+			&net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 51234},
+			&net.TCPAddr{IP: net.ParseIP("172.17.0.2"), Port: 25565},
+			sig + "\x21\x11\x00\x0c" +
+				"\xcb\x00\x71\x07" + "\xac\x11\x00\x02" +
+				"\xc8\x22" + "\x63\xdd",
+		},
+		{
+			"ipv6",
+			&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 51234},
+			&net.TCPAddr{IP: net.ParseIP("fd00::2"), Port: 25565},
+			sig + "\x21\x21\x00\x24" +
+				"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01" +
+				"\xfd\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02" +
+				"\xc8\x22" + "\x63\xdd",
+		},
+		{
+			"ipv4 client to ipv6 server",
+			&net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 51234},
+			&net.TCPAddr{IP: net.ParseIP("fd00::2"), Port: 25565},
+			sig + "\x21\x21\x00\x24" +
+				"\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\xff\xff\xcb\x00\x71\x07" +
+				"\xfd\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02" +
+				"\xc8\x22" + "\x63\xdd",
+		},
+		{
+			"unix socket",
+			&net.UnixAddr{Name: "@", Net: "unix"},
+			&net.TCPAddr{IP: net.ParseIP("172.17.0.2"), Port: 25565},
+			sig + "\x20\x00\x00\x00",
+		},
+	}
+	for _, tt := range tests {
+		var b bytes.Buffer
+		err := writeProxyHeader(&b, tt.src, tt.dst)
+		if err != nil || b.String() != tt.want {
+			t.Errorf("%s: writeProxyHeader() = % x, %v, want % x", tt.name, b.Bytes(), err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter limits how often each client host may connect, with a token
+// bucket per host. A host may connect Burst times at once, and its bucket
+// refills at Burst connections per Interval. It is safe for concurrent use.
+type rateLimiter struct {
+	Burst    int
+	Interval time.Duration
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Allow takes a token from host's bucket, reporting false if it is empty.
+func (r *rateLimiter) Allow(host string, now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.buckets == nil {
+		r.buckets = make(map[string]*bucket)
+	}
+	r.sweep(now)
+
+	b := r.buckets[host]
+	if b == nil {
+		b = &bucket{tokens: float64(r.Burst), last: now}
+		r.buckets[host] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * float64(r.Burst) / r.Interval.Seconds()
+	if b.tokens > float64(r.Burst) {
+		b.tokens = float64(r.Burst)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sweep forgets hosts whose buckets have refilled, at most once per
+// Interval, so scanners can't grow the map without bound.
+func (r *rateLimiter) sweep(now time.Time) {
+	if now.Sub(r.lastSweep) < r.Interval {
+		return
+	}
+	r.lastSweep = now
+	for host, b := range r.buckets {
+		if now.Sub(b.last) >= r.Interval {
+			delete(r.buckets, host)
+		}
+	}
+}
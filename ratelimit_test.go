@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	type attempt struct {
+		host    string
+		after   time.Duration
+		allowed bool
+	}
+	tests := []struct {
+		name     string
+		attempts []attempt
+	}{
+		{"burst", []attempt{
+			{"a", 0, true},
+			{"a", 0, true},
+			{"a", 0, true},
+			{"a", 0, false},
+		}},
+		{"hosts are separate", []attempt{
+			{"a", 0, true},
+			{"a", 0, true},
+			{"a", 0, true},
+			{"b", 0, true},
+			{"a", 0, false},
+		}},
+		{"refill", []attempt{
+			{"a", 0, true},
+			{"a", 0, true},
+			{"a", 0, true},
+			{"a", 10 * time.Second, false},
+			// a third of Interval refills one token
+			{"a", 20 * time.Second, true},
+			{"a", 20 * time.Second, false},
+		}},
+		{"refill is capped at the burst", []attempt{
+			{"a", 0, true},
+			{"a", time.Hour, true},
+			{"a", time.Hour, true},
+			{"a", time.Hour, true},
+			{"a", time.Hour, false},
+		}},
+	}
+	for _, tt := range tests {
+		r := &rateLimiter{Burst: 3, Interval: time.Minute}
+		for i, a := range tt.attempts {
+			if got := r.Allow(a.host, start.Add(a.after)); got != a.allowed {
+				t.Errorf("%s: attempt %d by %s at +%s allowed %v, want %v", tt.name, i, a.host, a.after, got, a.allowed)
+			}
+		}
+	}
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	r := &rateLimiter{Burst: 1, Interval: time.Minute}
+	r.Allow("a", start)
+	r.Allow("b", start.Add(30*time.Second))
+	r.Allow("c", start.Add(70*time.Second))
+	if _, ok := r.buckets["a"]; ok {
+		t.Errorf("refilled bucket wasn't swept")
+	}
+	if _, ok := r.buckets["b"]; !ok {
+		t.Errorf("bucket still refilling was swept")
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// RconPort is the port servers are asked to listen on for RCON.
+const RconPort = "25575"
+
+// RCON packet types.
+const (
+	rconCommand = 2
+	rconLogin   = 3
+)
+
+// rconTimeout bounds each RCON exchange, so a wedged server can't hold up
+// Loop().
+const rconTimeout = 5 * time.Second
+
+// rconMaxPacket is the largest packet accepted from the server. Minecraft
+// splits responses into 4096 byte bodies.
+const rconMaxPacket = 4096 + 10
+
+var errRconAuth = errors.New("rcon authentication failed")
+
+// RconConn is a connection to a server's RCON port. It is not safe for
+// concurrent use.
+type RconConn struct {
+	conn net.Conn
+	id   int32
+}
+
+// DialRcon connects to the RCON port at addr and logs in with password.
+func DialRcon(addr string, password string) (*RconConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, rconTimeout)
+	if err != nil {
+		return nil, err
+	}
+	r := &RconConn{conn: conn}
+	_, err = r.exchange(rconLogin, password)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// Command runs a command and returns the server's response.
+func (r *RconConn) Command(command string) (string, error) {
+	return r.exchange(rconCommand, command)
+}
+
+// Close closes the connection.
+func (r *RconConn) Close() error {
+	return r.conn.Close()
+}
+
+// exchange sends a request and reads the response with the same ID.
+func (r *RconConn) exchange(typ int32, body string) (string, error) {
+	r.id++
+	id := r.id
+	r.conn.SetDeadline(time.Now().Add(rconTimeout))
+	defer r.conn.SetDeadline(time.Time{})
+
+	err := writeRconPacket(r.conn, id, typ, body)
+	if err != nil {
+		return "", err
+	}
+	for {
+		respID, _, resp, err := readRconPacket(r.conn)
+		if err != nil {
+			return "", err
+		}
+		if typ == rconLogin && respID == -1 {
+			return "", errRconAuth
+		}
+		if respID == id {
+			return resp, nil
+		}
+	}
+}
+
+// writeRconPacket writes a packet: its length, ID and type as little-endian
+// int32s, then the body followed by two null bytes.
+func writeRconPacket(w io.Writer, id int32, typ int32, body string) error {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, int32(len(body)+10))
+	binary.Write(&buf, binary.LittleEndian, id)
+	binary.Write(&buf, binary.LittleEndian, typ)
+	buf.WriteString(body)
+	buf.Write([]byte{0, 0})
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// readRconPacket reads a packet written in the format of writeRconPacket.
+func readRconPacket(r io.Reader) (id int32, typ int32, body string, err error) {
+	var length int32
+	err = binary.Read(r, binary.LittleEndian, &length)
+	if err != nil {
+		return
+	}
+	if length < 10 || length > rconMaxPacket {
+		err = fmt.Errorf("invalid rcon packet length %d", length)
+		return
+	}
+	buf := make([]byte, length)
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		return
+	}
+	id = int32(binary.LittleEndian.Uint32(buf[0:]))
+	typ = int32(binary.LittleEndian.Uint32(buf[4:]))
+	body = string(buf[8 : length-2])
+	return
+}
+
+// rconPassword generates a random password for a server's RCON port.
+func rconPassword() string {
+	buf := make([]byte, 16)
+	_, err := rand.Read(buf)
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
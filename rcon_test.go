@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestRconPacket(t *testing.T) {
+	tests := []struct {
+		id, typ int32
+		body    string
+		raw     []byte
+	}{
+		{1, rconLogin, "secret", []byte{
+			16, 0, 0, 0,
+			1, 0, 0, 0,
+			3, 0, 0, 0,
+			's', 'e', 'c', 'r', 'e', 't', 0, 0,
+		}},
+		{2, rconCommand, "", []byte{
+			10, 0, 0, 0,
+			2, 0, 0, 0,
+			2, 0, 0, 0,
+			0, 0,
+		}},
+		{-1, rconCommand, "x", []byte{
+			11, 0, 0, 0,
+			0xff, 0xff, 0xff, 0xff,
+			2, 0, 0, 0,
+			'x', 0, 0,
+		}},
+	}
+	for _, tt := range tests {
+		var b bytes.Buffer
+		err := writeRconPacket(&b, tt.id, tt.typ, tt.body)
+		if err != nil || !bytes.Equal(b.Bytes(), tt.raw) {
+			t.Errorf("writeRconPacket(%d, %d, %q) = % x, %v, want % x", tt.id, tt.typ, tt.body, b.Bytes(), err, tt.raw)
+		}
+		id, typ, body, err := readRconPacket(bytes.NewReader(tt.raw))
+		if err != nil || id != tt.id || typ != tt.typ || body != tt.body {
+			t.Errorf("readRconPacket(% x) = %d, %d, %q, %v", tt.raw, id, typ, body, err)
+		}
+	}
+}
+
+func TestReadRconPacketInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  []byte
+	}{
+		{"empty", nil},
+		{"too short", []byte{9, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 0}},
+		{"too long", []byte{0x0b, 0x10, 0, 0}},
+		{"truncated", []byte{16, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0}},
+	}
+	for _, tt := range tests {
+		_, _, _, err := readRconPacket(bytes.NewReader(tt.raw))
+		if err == nil {
+			t.Errorf("%s: readRconPacket() succeeded", tt.name)
+		}
+	}
+}
+
+// serveRcon answers RCON logins with password and echoes commands back, after
+// an empty packet with another ID, as servers may send.
+func serveRcon(t *testing.T, password string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				for {
+					id, typ, body, err := readRconPacket(c)
+					if err != nil {
+						return
+					}
+					switch {
+					case typ == rconLogin && body != password:
+						writeRconPacket(c, -1, rconCommand, "")
+					case typ == rconLogin:
+						writeRconPacket(c, id, rconCommand, "")
+					default:
+						writeRconPacket(c, id+100, 0, "")
+						writeRconPacket(c, id, 0, "ran "+body)
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestDialRcon(t *testing.T) {
+	addr := serveRcon(t, "secret")
+
+	_, err := DialRcon(addr, "wrong")
+	if err != errRconAuth {
+		t.Errorf("DialRcon() with the wrong password = %v, want %v", err, errRconAuth)
+	}
+
+	r, err := DialRcon(addr, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	for _, cmd := range []string{"time set 0", "save-off"} {
+		resp, err := r.Command(cmd)
+		if err != nil || resp != "ran "+cmd {
+			t.Errorf("Command(%q) = %q, %v", cmd, resp, err)
+		}
+	}
+}
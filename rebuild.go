@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Rebuild reconstructs the session history by replaying an event log
+// (see EventLog) through the state machine's transitions (see apply),
+// without any games. The attempt counter starts from zero, so it only counts
+// attempts in the log. Milestones give the splits of milestone events.
+func Rebuild(r io.Reader, category *Category, milestones []Milestone) (SessionData, error) {
+	s := &Session{Category: category}
+	s.Patterns.Set(Patterns{Milestones: milestones})
+	// game is the game the run is on, if known, and stale the game last
+	// reset, whose events Loop() ignores once it has moved on
+	game, stale := -1, -1
+	dec := json.NewDecoder(r)
+	for {
+		var evt Event
+		err := dec.Decode(&evt)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return s.Data, err
+		}
+		// like Loop(), skip events from games other than the active one,
+		// except logins, which start the next run
+		active := evt.GameID == game || game < 0 && evt.GameID != stale
+		if !active && evt.Type != "login" {
+			continue
+		}
+		s.recordEvent(evt)
+
+		switch evt.Type {
+		case "cmd.reset":
+			s.rebuildReset()
+			game, stale = -1, evt.GameID
+
+		case "crash":
+			// without a run, the log doesn't say which game was active
+			if evt.GameID == game {
+				s.rebuildReset()
+				game, stale = -1, evt.GameID
+			}
+
+		case "login":
+			// a login to another game after a run means it was reset
+			// without a command, e.g. by -auto-reset-after-credits
+			if s.state != "" && evt.GameID != game {
+				s.rebuildReset()
+			}
+			if _, ok := s.apply(evt); ok {
+				game = evt.GameID
+			}
+
+		case "credits":
+			_, ok := s.apply(evt)
+			if ok {
+				s.finishAttempt()
+			}
+
+		default:
+			if !isLifecycleEvent(evt.Type) {
+				s.apply(evt)
+			}
+		}
+	}
+	s.finishAttempt()
+	return s.Data, nil
+}
+
+// rebuildReset ends the run in progress like a reset in Loop().
+func (s *Session) rebuildReset() {
+	s.finishAttempt()
+	s.state = ""
+	s.Data.Attempt += 1
+}
+
+// RebuildFile rebuilds the session history from the event log at path and
+// saves it as a new state file. It refuses to overwrite an existing one.
+func RebuildFile(path string, category *Category, milestones []Milestone) error {
+	_, err := os.Stat(StateFile)
+	if err == nil {
+		return fmt.Errorf("%s already exists, move it away to rebuild it", StateFile)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	data, err := Rebuild(f, category, milestones)
+	if err != nil {
+		return fmt.Errorf("replaying %s: %s", path, err)
+	}
+	s := &Session{Data: data}
+	return s.Save()
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRebuild(t *testing.T) {
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+	tests := []struct {
+		name    string
+		events  []Event
+		attempt int
+		results []string
+		splits  []string
+	}{
+		{
+			"finished run",
+			[]Event{
+				{GameID: 0, Timestamp: at(0), Type: "login"},
+				{GameID: 0, Timestamp: at(time.Minute), Type: "nether"},
+				{GameID: 0, Timestamp: at(2 * time.Minute), Type: "end"},
+				{GameID: 0, Timestamp: at(3 * time.Minute), Type: "credits"},
+				// the end can't follow the credits
+				{GameID: 0, Timestamp: at(4 * time.Minute), Type: "end"},
+			},
+			0,
+			[]string{"credits"},
+			[]string{"Nether 1m0s, End 2m0s, Credits 3m0s"},
+		},
+		{
+			"reset by command",
+			[]Event{
+				{GameID: 0, Timestamp: at(0), Type: "login"},
+				{GameID: 0, Timestamp: at(time.Minute), Type: "nether"},
+				{GameID: 0, Timestamp: at(90 * time.Second), Type: "cmd.reset"},
+				{GameID: 1, Timestamp: at(2 * time.Minute), Type: "login"},
+			},
+			1,
+			[]string{"nether", "overworld"},
+			[]string{"Nether 1m0s", ""},
+		},
+		{
+			"reset by logging in to another game",
+			[]Event{
+				{GameID: 0, Timestamp: at(0), Type: "login"},
+				{GameID: 0, Timestamp: at(time.Minute), Type: "nether"},
+				{GameID: 1, Timestamp: at(4 * time.Minute), Type: "login"},
+			},
+			1,
+			[]string{"nether", "overworld"},
+			[]string{"Nether 1m0s", ""},
+		},
+		{
+			"events from a non-active game",
+			[]Event{
+				{GameID: 0, Timestamp: at(0), Type: "login"},
+				{GameID: 1, Timestamp: at(30 * time.Second), Type: "cmd.reset"},
+				{GameID: 1, Timestamp: at(40 * time.Second), Type: "cmd.split"},
+				{GameID: 0, Timestamp: at(time.Minute), Type: "nether"},
+				{GameID: 1, Timestamp: at(90 * time.Second), Type: "end"},
+			},
+			0,
+			[]string{"nether"},
+			[]string{"Nether 1m0s"},
+		},
+		{
+			"second reset from the reset game",
+			[]Event{
+				{GameID: 0, Timestamp: at(0), Type: "login"},
+				{GameID: 0, Timestamp: at(time.Minute), Type: "cmd.reset"},
+				{GameID: 0, Timestamp: at(time.Minute), Type: "cmd.reset"},
+				{GameID: 1, Timestamp: at(2 * time.Minute), Type: "login"},
+				{GameID: 0, Timestamp: at(3 * time.Minute), Type: "cmd.reset"},
+			},
+			1,
+			[]string{"overworld", "overworld"},
+			[]string{"", ""},
+		},
+		{
+			"crash of the active game",
+			[]Event{
+				{GameID: 0, Timestamp: at(0), Type: "login"},
+				{GameID: 1, Timestamp: at(30 * time.Second), Type: "crash"},
+				{GameID: 0, Timestamp: at(time.Minute), Type: "nether"},
+				{GameID: 0, Timestamp: at(2 * time.Minute), Type: "crash"},
+				{GameID: 1, Timestamp: at(3 * time.Minute), Type: "login"},
+			},
+			1,
+			[]string{"nether", "overworld"},
+			[]string{"Nether 1m0s", ""},
+		},
+		{
+			"lifecycle and session events skipped",
+			[]Event{
+				{GameID: 1, Timestamp: at(0), Type: "generated"},
+				{GameID: 0, Timestamp: at(0), Type: "login"},
+				{GameID: 0, Timestamp: at(0), Type: "timer.start"},
+				{GameID: 1, Timestamp: at(30 * time.Second), Type: "crash"},
+				{GameID: 0, Timestamp: at(time.Minute), Type: "nether"},
+				{GameID: 0, Timestamp: at(time.Minute), Type: "timer.split", Payload: "time=60000 split=Nether"},
+				{GameID: 0, Timestamp: at(time.Minute), Type: "heartbeat"},
+			},
+			0,
+			[]string{"nether"},
+			[]string{"Nether 1m0s"},
+		},
+	}
+	for _, tt := range tests {
+		var log bytes.Buffer
+		enc := json.NewEncoder(&log)
+		for _, evt := range tt.events {
+			enc.Encode(evt)
+		}
+		data, err := Rebuild(&log, DefaultCategory(), nil)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if data.Attempt != tt.attempt {
+			t.Errorf("%s: attempt %d, want %d", tt.name, data.Attempt, tt.attempt)
+		}
+		var results, splits []string
+		for _, a := range data.History {
+			results = append(results, a.Result)
+			var s []string
+			for _, split := range a.Splits {
+				s = append(s, fmt.Sprintf("%s %s", split.Name, split.Time))
+			}
+			splits = append(splits, strings.Join(s, ", "))
+		}
+		if fmt.Sprint(results) != fmt.Sprint(tt.results) {
+			t.Errorf("%s: results %q, want %q", tt.name, results, tt.results)
+		}
+		if fmt.Sprint(splits) != fmt.Sprint(tt.splits) {
+			t.Errorf("%s: splits %q, want %q", tt.name, splits, tt.splits)
+		}
+	}
+}
+
+func TestRebuildInvalidLog(t *testing.T) {
+	_, err := Rebuild(strings.NewReader(`{"type": "login"}`+"\nnot json\n"), DefaultCategory(), nil)
+	if err == nil {
+		t.Errorf("Rebuild() of a corrupt log succeeded")
+	}
+}
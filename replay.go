@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Replay runs the session state machine over a recorded server log, as if
+// it came from the active server, without Docker. With realtime set, lines
+// are fed at the pace of their timestamps; otherwise as fast as they are
+// handled. It returns the attempts recorded from the log; nothing is saved.
+func Replay(ctx context.Context, path string, config *Config, category *Category, realtime bool) ([]Attempt, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c := *config
+	c.Replicas, c.MaxReplicas, c.Warm = 1, 1, 0
+	s, err := NewSession(replayDocker{}, &c)
+	if err != nil {
+		return nil, err
+	}
+	s.Replay = true
+	s.Category = category
+	s.configureReplicas()
+	before := len(s.Data.History)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stopped := make(chan struct{})
+	var loopErr error
+	go func() {
+		loopErr = s.Loop(ctx)
+		close(stopped)
+	}()
+	go func() {
+		for {
+			select {
+			case <-s.ProxyAddr:
+			case <-stopped:
+				return
+			}
+		}
+	}()
+
+	// the log may start after the world was generated
+	replica := s.replicas[0]
+	s.Events <- Event{GameID: replica.ID, Timestamp: time.Now(), Type: "ready"}
+
+	// HandleLog returns once Loop has taken its event, so once every line
+	// is handed over, Loop can be stopped without losing any. If Loop stops
+	// first, the replay is abandoned.
+	lines := make(chan error, 1)
+	go func() {
+		lines <- replayLines(ctx, f, replica, realtime)
+	}()
+	select {
+	case err = <-lines:
+	case <-stopped:
+	}
+	cancel()
+	<-stopped
+	if err == nil {
+		err = loopErr
+	}
+	return s.Data.History[before:], err
+}
+
+// replayLines feeds each line of r to the game's HandleLog until r is
+// exhausted or the context is cancelled.
+func replayLines(ctx context.Context, r io.Reader, g *Game, realtime bool) error {
+	var last time.Time
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if realtime {
+			t, _, ok := parseLogLine(line)
+			if ok && !last.IsZero() {
+				wait := t.Sub(last)
+				if wait < 0 {
+					// clock times roll over at midnight
+					wait += 24 * time.Hour
+				}
+				select {
+				case <-time.After(wait):
+				case <-ctx.Done():
+				}
+			}
+			if ok {
+				last = t
+			}
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		g.HandleLog(line)
+	}
+	return scanner.Err()
+}
+
+// PrintAttempts prints the result and splits of each attempt.
+func PrintAttempts(attempts []Attempt) {
+	if len(attempts) == 0 {
+		fmt.Println("no attempts")
+		return
+	}
+	for _, a := range attempts {
+		result := a.Result
+		if result == "" {
+			result = "reset"
+		}
+		fmt.Printf("attempt #%d: %s\n", a.Number, result)
+		for _, split := range a.Splits {
+			fmt.Printf("  %-12s %s\n", split.Name, split.Time.Round(time.Millisecond))
+		}
+	}
+}
+
+// replayDocker is a DockerClient for replays, with no containers. Commands
+// written to a container are logged instead.
+type replayDocker struct{}
+
+var _ DockerClient = replayDocker{}
+
+func (replayDocker) ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, platform *specs.Platform, containerName string) (container.ContainerCreateCreatedBody, error) {
+	return container.ContainerCreateCreatedBody{ID: containerName}, nil
+}
+
+func (replayDocker) ImagePull(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+	return ioutil.NopCloser(strings.NewReader("")), nil
+}
+
+func (replayDocker) ContainerStart(ctx context.Context, container string, options types.ContainerStartOptions) error {
+	return nil
+}
+
+func (replayDocker) ContainerWait(ctx context.Context, name string, condition container.WaitCondition) (<-chan container.ContainerWaitOKBody, <-chan error) {
+	return make(chan container.ContainerWaitOKBody), make(chan error)
+}
+
+func (replayDocker) ContainerKill(ctx context.Context, container, signal string) error {
+	return nil
+}
+
+func (replayDocker) ContainerStop(ctx context.Context, container string, timeout *time.Duration) error {
+	return nil
+}
+
+func (replayDocker) ContainerInspect(ctx context.Context, container string) (types.ContainerJSON, error) {
+	return types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{ID: container, Name: container},
+		NetworkSettings:   &types.NetworkSettings{},
+	}, nil
+}
+
+func (replayDocker) ContainerLogs(ctx context.Context, container string, options types.ContainerLogsOptions) (io.ReadCloser, error) {
+	return ioutil.NopCloser(strings.NewReader("")), nil
+}
+
+func (replayDocker) ContainerAttach(ctx context.Context, container string, options types.ContainerAttachOptions) (types.HijackedResponse, error) {
+	c, other := net.Pipe()
+	other.Close()
+	return types.HijackedResponse{Conn: replayStdin{c, container}, Reader: bufio.NewReader(c)}, nil
+}
+
+func (replayDocker) ContainerRename(ctx context.Context, container, newContainerName string) error {
+	return nil
+}
+
+func (replayDocker) ContainerPause(ctx context.Context, container string) error {
+	return nil
+}
+
+func (replayDocker) ContainerUnpause(ctx context.Context, container string) error {
+	return nil
+}
+
+func (replayDocker) CopyFromContainer(ctx context.Context, container, srcPath string) (io.ReadCloser, types.ContainerPathStat, error) {
+	return nil, types.ContainerPathStat{}, fmt.Errorf("replays have no worlds to copy")
+}
+
+func (replayDocker) CopyToContainer(ctx context.Context, container, path string, content io.Reader, options types.CopyToContainerOptions) error {
+	return nil
+}
+
+func (replayDocker) NetworkCreate(ctx context.Context, name string, options types.NetworkCreate) (types.NetworkCreateResponse, error) {
+	return types.NetworkCreateResponse{}, nil
+}
+
+func (replayDocker) NetworkInspect(ctx context.Context, network string, options types.NetworkInspectOptions) (types.NetworkResource, error) {
+	return types.NetworkResource{}, nil
+}
+
+func (replayDocker) Info(ctx context.Context) (types.Info, error) {
+	return types.Info{}, nil
+}
+
+// replayStdin is an attached container's stdin in a replay, logging each
+// command written to it.
+type replayStdin struct {
+	net.Conn
+	name string
+}
+
+func (c replayStdin) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimSuffix(string(p), "\n"), "\n") {
+		log.Printf("[%s] > %s", c.name, line)
+	}
+	return len(p), nil
+}
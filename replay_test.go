@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReplay(t *testing.T) {
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	lines := `[12:00:00] [Server thread/INFO]: Done (5.012s)! For help, type "help"
+[12:00:10] [Server thread/INFO]: alice joined the game
+[12:01:10] [Server thread/INFO]: alice has made the advancement [We Need to Go Deeper]
+[12:02:00] [Server thread/INFO]: <alice> rr
+[12:02:30] [Server thread/INFO]: Done (4.871s)! For help, type "help"
+[12:02:40] [Server thread/INFO]: alice joined the game
+[12:04:10] [Server thread/INFO]: alice has made the advancement [We Need to Go Deeper]
+`
+	path := filepath.Join(dir, "server.log")
+	err = ioutil.WriteFile(path, []byte(lines), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{Image: "test", Replicas: 1}
+	err = config.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attempts, err := Replay(context.Background(), path, config, DefaultCategory(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, a := range attempts {
+		got = append(got, fmt.Sprintf("#%d %s %v", a.Number, a.Result, a.Splits))
+	}
+	want := []string{"#0 nether [{Nether 1m0s}]", "#1 nether [{Nether 1m30s}]"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("attempts %q, want %q", got, want)
+	}
+	if _, err := os.Stat(StateFile); !os.IsNotExist(err) {
+		t.Errorf("%s was saved by a replay: %v", StateFile, err)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	units "github.com/docker/go-units"
+)
+
+// Reservation compares the resources reserved by the replica limits with
+// the docker host's capacity. Zero reserved CPUs or memory means unlimited.
+type Reservation struct {
+	Replicas   int     `json:"replicas"`
+	CPUs       float64 `json:"cpus"`
+	HostCPUs   int     `json:"host_cpus"`
+	Memory     int64   `json:"memory"`
+	HostMemory int64   `json:"host_memory"`
+}
+
+// NewReservation sums the per-replica limits for a pool of replicas against
+// the host described by info.
+func NewReservation(info types.Info, replicas int, cpus float64, memory int64) Reservation {
+	return Reservation{
+		Replicas:   replicas,
+		CPUs:       cpus * float64(replicas),
+		HostCPUs:   info.NCPU,
+		Memory:     memory * int64(replicas),
+		HostMemory: info.MemTotal,
+	}
+}
+
+// CPUOversubscribed reports whether the replicas reserve more CPUs than the
+// host has.
+func (r Reservation) CPUOversubscribed() bool {
+	return r.CPUs > float64(r.HostCPUs)
+}
+
+// MemoryOversubscribed reports whether the replicas reserve more memory than
+// the host has.
+func (r Reservation) MemoryOversubscribed() bool {
+	return r.Memory > r.HostMemory
+}
+
+// CheckResources compares the replica limits with the docker host's
+// capacity and warns if the pool would oversubscribe it.
+func (s *Session) CheckResources(ctx context.Context) {
+	ctx, cancel := apiContext(ctx, s.DockerTimeout)
+	defer cancel()
+	info, err := s.Client.Info(ctx)
+	if err != nil {
+		log.Printf("[core] error getting docker info: %s", err)
+		return
+	}
+	limits := s.config.Resources()
+	r := NewReservation(info, len(s.replicas), float64(limits.NanoCPUs)/1e9, limits.Memory)
+	if r.CPUOversubscribed() {
+		log.Printf("[core] warning: %d replicas reserve %g CPUs but the host has %d",
+			r.Replicas, r.CPUs, r.HostCPUs)
+	}
+	if r.MemoryOversubscribed() {
+		log.Printf("[core] warning: %d replicas reserve %s of memory but the host has %s",
+			r.Replicas, units.BytesSize(float64(r.Memory)), units.BytesSize(float64(r.HostMemory)))
+	}
+	s.reservation = &r
+}
+
+// describeResources summarizes container limits for logging, e.g.
+// "memory 2GiB, 2 CPUs".
+func describeResources(r container.Resources) string {
+	memory := "unlimited"
+	if r.Memory > 0 {
+		memory = units.BytesSize(float64(r.Memory))
+	}
+	text := "memory " + memory
+	switch {
+	case r.MemorySwap < 0:
+		text += " (unlimited swap)"
+	case r.MemorySwap > 0:
+		text += fmt.Sprintf(" (%s with swap)", units.BytesSize(float64(r.MemorySwap)))
+	}
+	if r.NanoCPUs > 0 {
+		text += fmt.Sprintf(", %g CPUs", float64(r.NanoCPUs)/1e9)
+	} else {
+		text += ", unlimited CPUs"
+	}
+	return text
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+const gib = 1 << 30
+
+func TestReservation(t *testing.T) {
+	host := types.Info{NCPU: 8, MemTotal: 16 * gib}
+	tests := []struct {
+		name     string
+		replicas int
+		cpus     float64
+		memory   int64
+		cpu, mem bool
+	}{
+		{"unlimited", 6, 0, 0, false, false},
+		{"fits", 4, 2, 4 * gib, false, false},
+		{"too many CPUs", 5, 2, 2 * gib, true, false},
+		{"too much memory", 5, 1, 4 * gib, false, true},
+		{"both", 6, 1.5, 3 * gib, true, true},
+	}
+	for _, tt := range tests {
+		r := NewReservation(host, tt.replicas, tt.cpus, tt.memory)
+		if r.CPUOversubscribed() != tt.cpu || r.MemoryOversubscribed() != tt.mem {
+			t.Errorf("%s: oversubscribed CPU %t, memory %t, want %t, %t",
+				tt.name, r.CPUOversubscribed(), r.MemoryOversubscribed(), tt.cpu, tt.mem)
+		}
+	}
+}
+
+func TestDescribeResources(t *testing.T) {
+	tests := []struct {
+		resources container.Resources
+		text      string
+	}{
+		{container.Resources{}, "memory unlimited, unlimited CPUs"},
+		{container.Resources{Memory: 2 * gib, NanoCPUs: 1.5e9}, "memory 2GiB, 1.5 CPUs"},
+		{container.Resources{Memory: 2 * gib, MemorySwap: -1}, "memory 2GiB (unlimited swap), unlimited CPUs"},
+		{container.Resources{Memory: 2 * gib, MemorySwap: 3 * gib}, "memory 2GiB (3GiB with swap), unlimited CPUs"},
+	}
+	for _, tt := range tests {
+		if text := describeResources(tt.resources); text != tt.text {
+			t.Errorf("describeResources(%+v) = %q, want %q", tt.resources, text, tt.text)
+		}
+	}
+}
@@ -0,0 +1,14 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"syscall"
+)
+
+// reuseAddr does nothing on Windows, where SO_REUSEADDR would let another
+// process take over the proxy's port.
+func reuseAddr(network string, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -4,10 +4,13 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"log"
 	"net"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -18,51 +21,336 @@ const (
 	StateFile = "state.json"
 )
 
+// Switch policies decide whether Loop() moves the active replica to a newly
+// generated one before the run has started.
+const (
+	SwitchNever  = "never"
+	SwitchNewest = "newest"
+)
+
+// Select policies decide which ready replica Loop() makes active when there
+// is none, e.g. after a reset: the one with the lowest ID, the next one by ID
+// after the replica last active, or the one least recently active.
+const (
+	SelectLowest     = "lowest"
+	SelectRoundRobin = "round-robin"
+	SelectLRU        = "lru"
+)
+
+// Message is a chat text component, e.g. for /tellraw. The styling and
+// click action are left out when unset.
 type Message struct {
-	Text  string `json:"text"`
-	Color string `json:"color"`
+	Text       string      `json:"text"`
+	Color      string      `json:"color"`
+	Bold       bool        `json:"bold,omitempty"`
+	Italic     bool        `json:"italic,omitempty"`
+	ClickEvent *ClickEvent `json:"clickEvent,omitempty"`
+}
+
+// ClickEvent is what clicking a chat component does, e.g. the "open_url",
+// "suggest_command" or "copy_to_clipboard" action with its Value.
+type ClickEvent struct {
+	Action string `json:"action"`
+	Value  string `json:"value"`
 }
 
 type Event struct {
-	GameID    int
-	Timestamp time.Time
-	Type      string
-	Payload   string
+	GameID    int       `json:"game_id"`
+	Timestamp time.Time `json:"timestamp"`
+	Type      string    `json:"type"`
+	Payload   string    `json:"payload"`
+
+	// Matched names the detection pattern that produced the event, if it
+	// came from a log message.
+	Matched string `json:"matched,omitempty"`
+
+	// Attempt is the number of the attempt a timer event belongs to, fixed
+	// when it is published so that a sink handling it later, after a
+	// reset, still reports the right one.
+	Attempt int `json:"attempt,omitempty"`
+}
+
+// Split is the time at which a run reached a milestone.
+type Split struct {
+	Name string        `json:"name"`
+	Time time.Duration `json:"time"`
 }
 
 type SessionData struct {
-	Attempt int `json:"attempt"`
+	Attempt int            `json:"attempt"`
+	Notes   map[int]string `json:"notes,omitempty"`
+	History []Attempt      `json:"history,omitempty"`
+}
+
+// ReplicaStatus is a point-in-time copy of a replica's state.
+type ReplicaStatus struct {
+	ID     int    `json:"id"`
+	Name   string `json:"name"`
+	Ready  bool   `json:"ready"`
+	Paused bool   `json:"paused"`
+	Active bool   `json:"active"`
+	Addr   string `json:"addr"`
+}
+
+// Status is a point-in-time copy of the session's state machine.
+type Status struct {
+	State     string    `json:"state"`
+	Active    int       `json:"active"`
+	Attempt   int       `json:"attempt"`
+	TimeStart time.Time `json:"time_start"`
+
+	// Paused is set while the run timer is held with the pause command.
+	Paused bool `json:"paused"`
 }
 
 type Session struct {
 	Events chan Event
-	Client *client.Client
+	Client DockerClient
 	Data   SessionData
 
-	Replicas map[int]*Game
-	Image    string
+	Image   string
+	APIAddr string
+
+	// DashboardAddr, if set, serves a read-only web dashboard.
+	DashboardAddr string
+
+	// Pprof serves the net/http/pprof profiles on the API.
+	Pprof bool
+
+	// APIToken is required as a bearer token by admin API endpoints, such
+	// as those that change detection. They are disabled if it is empty.
+	APIToken string
+
+	SpectatorAddr string
+
+	// ProxyStatus enables the proxy's server list responses while no
+	// replica is active, showing ProxyMOTD.
+	ProxyStatus bool
+	ProxyMOTD   string
+
+	// ProxyControl is the control socket of a standalone proxy. If set, the
+	// session sends upstream addresses there instead of proxying itself.
+	ProxyControl string
+
+	// ProxyIdleTimeout closes proxied connections with no traffic in
+	// either direction for this long. Zero disables it.
+	ProxyIdleTimeout time.Duration
+
+	// ProxyGrace holds new connections while no replica is active.
+	ProxyGrace time.Duration
+
+	// ProxyReconnect holds the runner's reconnection after a reset until
+	// the next replica is active.
+	ProxyReconnect time.Duration
 
-	Active    *Game
-	State     string
-	TimeStart time.Time
+	// ProxyDrainGrace delays closing connections to a replica after the
+	// proxy switches away from it.
+	ProxyDrainGrace time.Duration
+
+	// ProxyDialRetries retries connections to a replica that isn't yet
+	// accepting players.
+	ProxyDialRetries int
+
+	// DockerTimeout bounds short Docker API calls, see Game.DockerTimeout.
+	DockerTimeout time.Duration
+
+	// StopTimeout stops containers gracefully, see Game.StopTimeout.
+	StopTimeout time.Duration
+
+	// ProxyConnRate limits each client host to this many new connections
+	// per ProxyConnInterval, and ProxyMaxConns limits the connections
+	// proxied at once. Zero disables either limit.
+	ProxyConnRate     int
+	ProxyConnInterval time.Duration
+	ProxyMaxConns     int
+
+	// CaptureDir, if set, records the raw traffic of proxied connections.
+	CaptureDir string
+
+	IdlePause   time.Duration
+	GenSlots    chan struct{}
+	Heartbeat   time.Duration
+	Patterns    PatternSet
+	SplitCoords bool
+
+	// PauseWhenEmpty pauses every ready replica but the active one once
+	// no player has been connected to the proxy for this long, unpausing
+	// them when one connects. Zero disables it. It needs the in-process
+	// proxy, which reports on ProxyEmpty.
+	PauseWhenEmpty time.Duration
+	ProxyEmpty     chan bool
+
+	// empty is set while the proxy reports no players, and parked holds
+	// the IDs of the replicas paused since.
+	empty  bool
+	parked map[int]bool
+
+	// SplitDimension limits split announcements to players in a dimension:
+	// "" for everyone, "current" for the run's current dimension, or a
+	// dimension ID such as "minecraft:overworld".
+	SplitDimension string
+
+	ShutdownCommands []string
+	ShutdownTimeout  time.Duration
+
+	// StopOnExit kills every replica's container once the session has
+	// shut down, so none are left running.
+	StopOnExit bool
+
+	// BackupDir is where SaveFinal() writes a backup if the state file
+	// can't be saved on shutdown.
+	BackupDir string
+
+	// WorldTemplate, if set, is a world directory copied into each
+	// container under DataDir, so every reset starts from the same world.
+	WorldTemplate string
+	DataDir       string
+
+	// CrashGrace is how long a replica's container may keep running after
+	// its log stream ends before the stream is taken to have hiccuped
+	// rather than the server crashed.
+	CrashGrace time.Duration
+
+	// KeepContainers disables auto-removal, so that stopped containers are
+	// kept (renamed out of the way) for inspection.
+	KeepContainers bool
+
+	// Pace colors splits by how they compare with the personal best.
+	Pace []PaceColor
+
+	// Category decides which splits a run passes through, and in what
+	// order.
+	Category *Category
+
+	// ReissueSaveOff sends /save-off again if the active game saves during
+	// a run.
+	ReissueSaveOff bool
+
+	// SwitchPolicy is one of SwitchNever or SwitchNewest. With SwitchNewest,
+	// a replica that finishes generating becomes active if nobody has
+	// logged in to the active one yet.
+	SwitchPolicy string
+
+	// SelectPolicy is one of SelectLowest (the default if empty),
+	// SelectRoundRobin or SelectLRU. activated numbers each replica's
+	// latest activation, the last being activations.
+	SelectPolicy string
+	activated    map[int]int
+	activations  int
+
+	// AutoReset resets the active game this long after the credits, unless
+	// it is reset manually first. Zero disables it.
+	AutoReset time.Duration
+
+	// ResetDebounce ignores a reset command within this long of the last
+	// reset, unless somebody has logged in to the new active replica since,
+	// so that a doubled command doesn't also reset the replica switched to.
+	// Zero disables it.
+	ResetDebounce time.Duration
+	lastReset     time.Time
+
+	// Replay is set when game events come from a recorded log rather than
+	// live servers (see Replay): worlds are ready as soon as they are
+	// generated, since there is no server to probe, and the session is
+	// never saved.
+	Replay bool
+
+	// mu guards replicas (including each game's Ready, ReadyAt, Paused,
+	// ResetAt, Addr and WorldSeed), active, state, timeStart, pausedAt,
+	// pausedFor, current and Data. Only Loop() writes these fields (except Data.Notes and
+	// Data.Attempt, see SetNote and SetAttempt) and it must hold mu while
+	// doing so, but never across Docker or RCON calls: Game methods such as
+	// Refresh, Pause, Unpause and Reset are called without mu, and the
+	// fields are updated under it afterwards. Loop() may read them without
+	// mu; all other goroutines must hold mu for reading, or use the
+	// Status(), Replicas() and Attempt() accessors.
+	mu        sync.RWMutex
+	replicas  map[int]*Game
+	active    *Game
+	state     string
+	timeStart time.Time
+	current   *Attempt
+
+	// pausedAt is when the run timer was held with the pause command, or zero
+	// if it is running, and pausedFor the time it was held before that.
+	// Both are left out of split times.
+	pausedAt  time.Time
+	pausedFor time.Duration
 
 	ProxyAddr chan string
+
+	config *Config
+
+	// reservation is the resource summary from CheckResources(), if it
+	// succeeded. It is set by Init() before the API starts.
+	reservation *Reservation
+
+	// proxy is the in-process proxy, if any, set by Init().
+	proxy *ProxyServer
+
+	monitors  counter
+	launchers counter
+
+	Stream  Broadcaster
+	Sinks   SinkRegistry
+	Metrics MultiMetrics
+	started time.Time
+	saveMu  sync.Mutex
+	pullMu  sync.Mutex
+
+	// pendingSplit is a dimension split waiting on the player's position,
+	// announced without it when pendingTimeout fires.
+	pendingSplit   *Split
+	pendingTimeout <-chan time.Time
+
+	// export is a completed run's world to export once it is saved, or
+	// when exportTimeout fires.
+	export        *pendingExport
+	exportTimeout <-chan time.Time
+
+	// autoReset fires AutoReset after the credits of the current run.
+	autoReset <-chan time.Time
 }
 
 // NewSession creates a session, loads state, and initializes the replicas.
-func NewSession(cli *client.Client, image string, replicas int) (*Session, error) {
+// The config must already be validated.
+func NewSession(cli DockerClient, config *Config) (*Session, error) {
+	err := config.checkReplicas()
+	if err != nil {
+		return nil, err
+	}
 	s := &Session{
-		Client:    cli,
-		Image:     image,
-		Replicas:  make(map[int]*Game),
-		Events:    make(chan Event),
-		ProxyAddr: make(chan string),
+		Client:     cli,
+		Image:      config.Image,
+		config:     config,
+		Category:   DefaultCategory(),
+		Pace:       config.PaceSet(),
+		replicas:   make(map[int]*Game),
+		activated:  make(map[int]int),
+		Events:     make(chan Event),
+		ProxyAddr:  make(chan string),
+		ProxyEmpty: make(chan bool),
+		started:    time.Now(),
+	}
+	s.Sinks.RegisterInline(context.Background(), "stream", streamSink{s})
+	patterns := Patterns{
+		Milestones: config.MilestoneSet(),
+		Events:     config.Events,
+		Ignore:     config.Ignore,
+	}
+	err = patterns.Validate()
+	if err != nil {
+		return nil, err
+	}
+	s.Patterns.Set(patterns)
+	if config.MaxConcurrentGen > 0 {
+		s.GenSlots = make(chan struct{}, config.MaxConcurrentGen)
 	}
-	err := s.Load()
+	err = s.Load()
 	if err != nil {
 		return nil, err
 	}
-	for i := 0; i < replicas; i++ {
+	for i := 0; i < config.Replicas; i++ {
 		s.NewGame(i)
 	}
 	return s, nil
@@ -70,220 +358,1303 @@ func NewSession(cli *client.Client, image string, replicas int) (*Session, error
 
 // NewGame creates a new game object and adds it to the session.
 func (s *Session) NewGame(id int) {
-	s.Replicas[id] = &Game{
-		ID:      id,
-		Image:   s.Image,
-		Name:    fmt.Sprintf("mcspeedrun_%d", id),
-		Client:  s.Client,
-		Events:  s.Events,
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g := &Game{
+		ID:     id,
+		Image:  s.Image,
+		Name:   fmt.Sprintf("%s_%d", s.config.ContainerPrefix, id),
+		Client: s.Client,
+		Events: s.Events,
+
+		Patterns: &s.Patterns,
+		GenSlots: s.GenSlots,
+		PullMu:   &s.pullMu,
+
+		IPv6:          s.config.IPv6,
+		Network:       s.config.Network,
+		Binds:         s.config.Binds,
+		User:          s.config.ContainerUser,
+		ResetCommand:  s.config.ResetCommand,
+		SplitCommand:  s.config.SplitCommand,
+		PauseCommand:  s.config.PauseCommand,
+		ResumeCommand: s.config.ResumeCommand,
+		RconPassword:  rconPassword(),
+		Seed:          s.config.Seed,
+		SeedEnv:       s.config.SeedEnv,
+	}
+	g.Env = append(s.config.ContainerEnv(),
+		"ENABLE_RCON=true",
+		"RCON_PORT="+RconPort,
+		"RCON_PASSWORD="+g.RconPassword,
+	)
+	if s.config.LevelEnv != "" {
+		g.Env = append(g.Env, s.config.LevelEnv+"="+s.config.Level(id))
+	}
+	s.replicas[id] = g
+}
+
+// configureReplicas applies the session's container settings to every game,
+// to be used when their containers are next started.
+func (s *Session) configureReplicas() {
+	for _, replica := range s.replicas {
+		s.configureReplica(replica)
+	}
+}
+
+// configureReplica applies the session's container settings to a game.
+func (s *Session) configureReplica(replica *Game) {
+	replica.AutoRemove = !s.KeepContainers
+	replica.CrashGrace = s.CrashGrace
+	replica.Template = s.WorldTemplate
+	replica.DataDir = s.DataDir
+	replica.Level = DefaultLevel
+	if s.config.LevelEnv != "" {
+		replica.Level = s.config.Level(replica.ID)
+	}
+	replica.Resources = s.config.Resources()
+	replica.DockerTimeout = s.DockerTimeout
+	replica.StopTimeout = s.StopTimeout
+}
+
+// launch starts a replica's Launch() and Monitor() goroutines.
+func (s *Session) launch(ctx context.Context, replica *Game) {
+	goCounted(&s.launchers, func() { replica.Launch(ctx) })
+	goCounted(&s.monitors, func() { replica.Monitor(ctx) })
+}
+
+// fillPool adds replicas until Warm of them besides the active one are
+// generated or generating, without exceeding MaxReplicas. A reset replica
+// regenerates in place, so the pool only grows.
+func (s *Session) fillPool(ctx context.Context) {
+	for s.config.Warm > 0 && len(s.replicas) < s.config.MaxReplicas {
+		warm := len(s.replicas)
+		if s.active != nil {
+			warm--
+		}
+		if warm >= s.config.Warm {
+			return
+		}
+		id := len(s.replicas)
+		s.NewGame(id)
+		replica := s.replicas[id]
+		s.configureReplica(replica)
+		log.Printf("[core] adding %s to keep %d warm", replica.Name, s.config.Warm)
+		s.launch(ctx, replica)
+	}
+}
+
+// Replicas returns a snapshot of every replica's state, ordered by ID.
+func (s *Session) Replicas() []ReplicaStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	replicas := make([]ReplicaStatus, 0, len(s.replicas))
+	for _, replica := range s.replicas {
+		replicas = append(replicas, ReplicaStatus{
+			ID:     replica.ID,
+			Name:   replica.Name,
+			Ready:  replica.Ready,
+			Paused: replica.Paused,
+			Active: replica == s.active,
+			Addr:   replica.Addr,
+		})
+	}
+	sort.Slice(replicas, func(i, j int) bool {
+		return replicas[i].ID < replicas[j].ID
+	})
+	return replicas
+}
+
+// Status returns a snapshot of the state machine. Active is -1 when there is
+// no active replica.
+func (s *Session) Status() Status {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	status := Status{
+		State:     s.state,
+		Active:    -1,
+		Attempt:   s.Data.Attempt,
+		TimeStart: s.timeStart,
+		Paused:    !s.pausedAt.IsZero(),
+	}
+	if s.active != nil {
+		status.Active = s.active.ID
+	}
+	return status
+}
+
+// setState updates the state machine, and the run start time if start is
+// non-zero.
+func (s *Session) setState(state string, start time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = state
+	if !start.IsZero() {
+		s.timeStart = start
+		s.pausedAt, s.pausedFor = time.Time{}, 0
+	}
+}
+
+// retime restarts the run timer at t.
+func (s *Session) retime(t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.timeStart = t
+	s.pausedAt, s.pausedFor = time.Time{}, 0
+}
+
+// elapsed returns the run time at t, leaving out the time the timer was
+// held. While it is held, the run time stays at the time it was paused.
+func (s *Session) elapsed(t time.Time) time.Duration {
+	paused := s.pausedFor
+	if !s.pausedAt.IsZero() && t.After(s.pausedAt) {
+		paused += t.Sub(s.pausedAt)
+	}
+	return t.Sub(s.timeStart) - paused
+}
+
+// Elapsed returns the run time at t, see elapsed. It is safe to call from
+// any goroutine.
+func (s *Session) Elapsed(t time.Time) time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.elapsed(t)
+}
+
+// pauseRun holds the run timer from t. It reports false if no run is in
+// progress or the timer is already held.
+func (s *Session) pauseRun(t time.Time) bool {
+	if s.state == "" || s.state == "credits" || !s.pausedAt.IsZero() {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pausedAt = t
+	return true
+}
+
+// resumeRun starts the held run timer again from t. It reports false if the
+// timer isn't held.
+func (s *Session) resumeRun(t time.Time) bool {
+	if s.pausedAt.IsZero() {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t.After(s.pausedAt) {
+		s.pausedFor += t.Sub(s.pausedAt)
 	}
+	s.pausedAt = time.Time{}
+	return true
 }
 
 // Init launches the Launch() and Monitor() goroutines in each replica.
-// It also starts the Proxy() goroutine on the Session.
+// It also starts the Proxy() goroutine on the Session, and the API()
+// goroutine if an API address is configured.
 func (s *Session) Init(ctx context.Context) {
-	for _, replica := range s.Replicas {
-		go replica.Launch(ctx)
-		go replica.Monitor(ctx)
+	s.CheckResources(ctx)
+	s.configureReplicas()
+	for _, replica := range s.replicas {
+		s.launch(ctx, replica)
+	}
+	if s.ProxyControl == "" {
+		s.proxy = s.newProxyServer()
 	}
 	go s.Proxy(ctx)
+	if s.APIAddr != "" {
+		go s.API(ctx)
+	}
+	if s.DashboardAddr != "" {
+		go s.Dashboard(ctx)
+	}
 }
 
 // Loop monitors game events and updates the internal state machine.
 // Some events interact with the active game (e.g. to broadcast a
-// message to all players).
-func (s *Session) Loop(ctx context.Context) {
+// message to all players). It returns once the context is cancelled, with
+// an error if the session could not be saved.
+func (s *Session) Loop(ctx context.Context) error {
+	var idle <-chan time.Time
+	if s.IdlePause > 0 {
+		ticker := time.NewTicker(s.IdlePause / 2)
+		defer ticker.Stop()
+		idle = ticker.C
+	}
+	var heartbeat <-chan time.Time
+	if s.Heartbeat > 0 {
+		ticker := time.NewTicker(s.Heartbeat)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+
 	for {
 		// if we're missing an active game, attempt to find one
-		if s.Active == nil {
+		if s.active == nil {
 			s.ProxyAddr <- ""
-			for _, replica := range s.Replicas {
-				if replica.Ready {
-					log.Printf("[core] switching to %s", replica.Name)
-					s.Active = replica
-					s.ProxyAddr <- s.Active.Addr
-					break
-				}
+			replica := s.nextReplica(ctx)
+			if replica != nil {
+				log.Printf("[core] switching to %s", replica.Name)
+				s.activate(replica)
 			}
 		}
+		s.fillPool(ctx)
 
 		select {
 		case <-ctx.Done():
 			log.Printf("[core] shutting down")
-			err := s.Save()
-			if err != nil {
-				log.Printf("[core] error saving attempt: %s", err)
+			s.finishAttempt()
+			err := s.SaveFinal()
+			s.Shutdown()
+			if s.StopOnExit {
+				s.StopReplicas()
 			}
-			return
+			return err
+		case <-idle:
+			s.pauseIdle(ctx)
+		case empty := <-s.ProxyEmpty:
+			s.setEmpty(ctx, empty)
+		case <-s.exportTimeout:
+			log.Printf("[core] no save confirmed, exporting the world anyway")
+			s.finishExport(ctx)
+		case <-s.pendingTimeout:
+			// no position arrived, announce the split without it
+			if s.active != nil {
+				s.announce(ctx, *s.pendingSplit, "")
+			}
+			s.pendingSplit, s.pendingTimeout = nil, nil
+		case t := <-heartbeat:
+			s.publish(s.heartbeatEvent(t))
+		case <-s.autoReset:
+			if s.active != nil {
+				log.Printf("[core] auto-resetting %s", s.active.Name)
+				err := s.Save()
+				if err != nil {
+					log.Printf("[core] error saving attempt: %s", err)
+				}
+				s.reset(ctx)
+			}
+			s.autoReset = nil
 		case evt := <-s.Events:
-			log.Printf("[core] received '%s' from %d", evt.Type, evt.GameID)
+			logEvent("core", evt, "received '%s' from %d", evt.Type, evt.GameID)
 
 			// skip events with invalid game IDs
-			if evt.GameID >= len(s.Replicas) {
-				log.Printf("[core] unknown game ID %d", evt.GameID)
+			if _, ok := s.replicas[evt.GameID]; !ok {
+				logEvent("core", evt, "unknown game ID %d", evt.GameID)
 				continue
 			}
+			s.publish(evt)
+			s.Metrics.Count("events", 1, Tag{"type", evt.Type})
 
-			// skip all events with mismatched IDs except world gen events
-			if (s.Active == nil || evt.GameID != s.Active.ID) && evt.Type != "generated" {
-				log.Printf("[core] %s event from non-active game %d", evt.Type, evt.GameID)
+			// skip all events with mismatched IDs except lifecycle events
+			if (s.active == nil || evt.GameID != s.active.ID) && !isLifecycleEvent(evt.Type) {
+				logEvent("core", evt, "%s event from non-active game %d", evt.Type, evt.GameID)
 				continue
 			}
+			// lifecycle events from the other replicas aren't part of the
+			// run's timeline
+			if s.active != nil && evt.GameID == s.active.ID {
+				s.recordEvent(evt)
+			}
 
 			switch evt.Type {
 			case "cmd.reset":
-				s.State = ""
-				s.Data.Attempt += 1
-				s.Active.Reset(ctx)
-				s.Active = nil
+				if s.state == "" && time.Since(s.lastReset) < s.ResetDebounce {
+					log.Printf("[core] ignoring reset from %d within %s of the last one", evt.GameID, s.ResetDebounce)
+					continue
+				}
+				s.reset(ctx)
+
+			case "cmd.switch":
+				s.forceSwitch(ctx, s.replicas[evt.GameID])
+
+			case "cmd.resync":
+				// whichever replica is active now, even if it has changed
+				// since the request
+				if s.active == nil || s.active.Addr == "" {
+					continue
+				}
+				log.Printf("[core] resyncing the proxy to %s", s.active.Name)
+				s.ProxyAddr <- s.active.Addr
 
 			case "cmd.retime":
 				log.Printf("reset session timer")
-				s.TimeStart = evt.Timestamp
-				s.Active.Command(ctx, "/scoreboard players set @a timer_t 0")
-				s.Active.Command(ctx, "/scoreboard players set @a timer_s 0")
-				s.Active.Command(ctx, "/scoreboard players set @a timer_m 0")
-				s.Active.Command(ctx, "/scoreboard players set @a timer_h 0")
+				s.apply(evt)
+				s.timer("timer.start", 0, "")
+				s.setup(ctx, s.active, "running timer reset commands",
+					"/scoreboard players set @a timer_t 0",
+					"/scoreboard players set @a timer_s 0",
+					"/scoreboard players set @a timer_m 0",
+					"/scoreboard players set @a timer_h 0",
+				)
+
+			case "started":
+				s.mu.Lock()
+				s.replicas[evt.GameID].StartedAt = time.Now()
+				s.replicas[evt.GameID].WorldSeed = strings.TrimPrefix(evt.Payload, "seed=")
+				s.mu.Unlock()
+				s.Metrics.Count("restarts", 1, Tag{"game", strconv.Itoa(evt.GameID)})
 
 			case "generated":
-				s.Replicas[evt.GameID].Ready = true
-				s.Replicas[evt.GameID].Refresh(ctx)
-				log.Printf("[core] server %d is online", evt.GameID)
+				replica := s.replicas[evt.GameID]
+				if s.Replay {
+					if !replica.Ready {
+						s.markReady(ctx, replica)
+					}
+					continue
+				}
+				if evt.Timestamp.Before(replica.ResetAt) {
+					log.Printf("[core] ignoring world generated by server %d before its reset", evt.GameID)
+					continue
+				}
+				addr, err := replica.Refresh(ctx)
+				if err != nil {
+					// the address may be the old container's
+					s.gameError(replica, "inspecting the container", err)
+					continue
+				}
+				s.mu.Lock()
+				replica.Addr = addr
+				s.mu.Unlock()
+				if !replica.StartedAt.IsZero() {
+					s.Metrics.Timing("worldgen", time.Since(replica.StartedAt), Tag{"game", strconv.Itoa(evt.GameID)})
+				}
+				if len(s.config.GeneratedCommands) > 0 {
+					s.setup(ctx, replica, "running generated commands", s.config.GeneratedCommands...)
+				}
+				if replica.Addr == "" {
+					log.Printf("[core] server %d has no address", evt.GameID)
+					continue
+				}
+				go s.probe(ctx, replica.ID, replica.Addr)
+
+			case "ready":
+				replica := s.replicas[evt.GameID]
+				if replica.Ready || evt.Payload != replica.Addr || evt.Timestamp.Before(replica.ResetAt) {
+					continue
+				}
+				s.markReady(ctx, replica)
+
+			case "crash":
+				replica := s.replicas[evt.GameID]
+				s.Metrics.Count("crashes", 1, Tag{"game", strconv.Itoa(evt.GameID)})
+				if replica == s.active {
+					log.Printf("[core] active server %d crashed, resetting", evt.GameID)
+					s.reset(ctx)
+					continue
+				}
+				// the replacement container generates a new world, so
+				// treat the crash like a reset
+				s.mu.Lock()
+				replica.Ready = false
+				replica.ResetAt = evt.Timestamp
+				s.mu.Unlock()
+				s.updateReady()
+
+			case "crashloop":
+				log.Printf("[core] server %d keeps failing to start (%s), check the image and host resources", evt.GameID, evt.Payload)
+				s.Metrics.Count("crashloops", 1, Tag{"game", strconv.Itoa(evt.GameID)})
 
 			case "login":
-				if s.State != "" {
+				if _, ok := s.apply(evt); !ok {
 					continue
 				}
-				s.State = "overworld"
-				s.TimeStart = evt.Timestamp
-				s.Active.Say(ctx, fmt.Sprintf("attempt #%d", s.Data.Attempt), "green")
-				s.Active.Command(ctx, "/time set 0")
-				s.Active.Command(ctx, "/save-off")
-
-			case "nether":
-				if s.State != "overworld" {
+				s.timer("timer.start", 0, "")
+				if s.current.Seed != "" {
+					log.Printf("[core] attempt #%d is on seed %s", s.current.Number, s.current.Seed)
+				}
+				commands := []string{
+					tellraw(fmt.Sprintf("attempt #%d", s.current.Number), "green"),
+					"/time set 0",
+					"/save-off",
+				}
+				commands = append(commands, s.config.LoginCommands...)
+				s.setup(ctx, s.active, "running login commands", commands...)
+
+			case "nether", "end":
+				split, ok := s.apply(evt)
+				if !ok {
 					continue
 				}
-				s.State = "nether"
-				text := fmt.Sprintf("Nether: [%s]", evt.Timestamp.Sub(s.TimeStart))
-				s.Active.Say(ctx, text, "green")
+				s.timer("timer.split", split.Time, split.Name)
+				s.dimensionSplit(ctx, split)
 
-			case "end":
-				if s.State != "nether" {
+			case "cmd.split":
+				split, ok := s.apply(evt)
+				if !ok {
 					continue
 				}
-				s.State = "end"
-				text := fmt.Sprintf("End: [%s]", evt.Timestamp.Sub(s.TimeStart))
-				s.Active.Say(ctx, text, "green")
+				s.timer("timer.split", split.Time, split.Name)
+				s.announce(ctx, split, "")
+
+			case "cmd.pause":
+				if _, ok := s.apply(evt); !ok {
+					continue
+				}
+				log.Printf("[core] timer paused")
+				s.timer("timer.pause", s.elapsed(evt.Timestamp), "")
+				err := s.active.Say(ctx, fmt.Sprintf("timer held at %s, type %q to continue", s.elapsed(evt.Timestamp).Round(time.Second), s.config.ResumeCommand), "yellow")
+				if err != nil {
+					s.gameError(s.active, "sending the pause message", err)
+				}
+
+			case "cmd.resume":
+				if _, ok := s.apply(evt); !ok {
+					continue
+				}
+				log.Printf("[core] timer resumed")
+				s.timer("timer.resume", s.elapsed(evt.Timestamp), "")
+				err := s.active.Say(ctx, "timer resumed", "green")
+				if err != nil {
+					s.gameError(s.active, "sending the resume message", err)
+				}
+
+			case "endportal":
+				// vanilla logs nothing on entering the portal, so this only
+				// comes from a configured state event
+				split, ok := s.apply(evt)
+				if !ok {
+					continue
+				}
+				s.timer("timer.split", split.Time, split.Name)
+				s.announce(ctx, split, "")
+
+			case "position":
+				if s.pendingSplit == nil {
+					continue
+				}
+				s.announce(ctx, *s.pendingSplit, evt.Payload)
+				s.pendingSplit, s.pendingTimeout = nil, nil
+
+			case "save":
+				if s.export != nil {
+					s.finishExport(ctx)
+					continue
+				}
+				// saving was meant to be off for the run; turn it off again
+				// so it doesn't cause further stutters
+				if !s.ReissueSaveOff || s.state == "" || s.state == "credits" {
+					continue
+				}
+				log.Printf("[core] unexpected save during the run, disabling saving")
+				s.setup(ctx, s.active, "sending /save-off", "/save-off")
 
 			case "credits":
-				if s.State != "end" {
+				split, ok := s.apply(evt)
+				if !ok {
 					continue
 				}
-				s.State = "credits"
-				text := fmt.Sprintf("Credits: [%s]", evt.Timestamp.Sub(s.TimeStart))
-				s.Active.Say(ctx, text, "green")
+				s.timer("timer.finish", split.Time, "")
+				// announce before this run joins the history, so it is
+				// compared with the previous personal best
+				s.announce(ctx, split, "")
+				if s.config.ExportDir != "" && s.current != nil {
+					s.requestExport(ctx, *s.current)
+				}
+				s.finishAttempt()
+				if s.AutoReset > 0 {
+					err := s.active.Say(ctx, fmt.Sprintf("resetting in %s", s.AutoReset), "gray")
+					if err != nil {
+						s.gameError(s.active, "sending the auto-reset message", err)
+					}
+					s.autoReset = time.After(s.AutoReset)
+				}
+
+			default:
+				split, ok := s.apply(evt)
+				if !ok {
+					continue
+				}
+				s.timer("timer.split", split.Time, split.Name)
+				s.announce(ctx, split, "")
 			}
 		}
 	}
 }
 
-// Load loads all SessionData from the state.json file.
-func (s *Session) Load() error {
-	f, err := os.Open(StateFile)
-	if os.IsNotExist(err) {
-		return nil
+// apply makes the state machine's transition for a run event from the active
+// game: a login starts an attempt, the timer commands hold, resume or restart
+// the run timer, and split events record a split. Loop() and Rebuild() both
+// use it, each acting on the outcome in its own way. It returns the split
+// recorded, if any, and false if the event doesn't apply to the run.
+func (s *Session) apply(evt Event) (Split, bool) {
+	switch evt.Type {
+	case "login":
+		if s.state != "" {
+			return Split{}, false
+		}
+		s.setState("overworld", evt.Timestamp)
+		s.startAttempt(evt)
+		s.recordEvent(evt)
+		return Split{}, true
+	case "cmd.retime":
+		s.retime(evt.Timestamp)
+		return Split{}, true
+	case "cmd.pause":
+		return Split{}, s.pauseRun(evt.Timestamp)
+	case "cmd.resume":
+		return Split{}, s.resumeRun(evt.Timestamp)
+	case "nether", "endportal", "end", "credits":
+		return s.advance(evt)
+	case "cmd.split":
+		return s.manualSplit(evt)
 	}
+	return s.milestoneSplit(evt)
+}
 
-	if err != nil {
-		return err
+// splitNames are the names of the splits recorded by advance().
+var splitNames = map[string]string{
+	"nether":    "Nether",
+	"endportal": "End Portal",
+	"end":       "End",
+	"credits":   "Credits",
+}
+
+// advance moves the run into the state of a split event, if the category
+// allows it, and records the split. An endportal split is recorded once,
+// ahead of the end, without changing state. It reports false if the event
+// doesn't apply to the run.
+func (s *Session) advance(evt Event) (Split, bool) {
+	to := evt.Type
+	if to == "endportal" {
+		to = "end"
 	}
-	err = json.NewDecoder(f).Decode(&s.Data)
+	if s.state == "" || !s.Category.Allows(s.state, to) {
+		return Split{}, false
+	}
+	if evt.Type == "endportal" {
+		if s.hasSplit(splitNames["endportal"]) {
+			return Split{}, false
+		}
+	} else {
+		s.setState(evt.Type, time.Time{})
+	}
+	split := Split{splitNames[evt.Type], s.elapsed(evt.Timestamp)}
+	s.recordSplit(split)
+	s.Metrics.Timing("split", split.Time, Tag{"split", evt.Type})
+	return split, true
+}
+
+// manualSplit records a split named by the payload of a split command, if a
+// run is in progress. It reports false if there is no run or no name.
+func (s *Session) manualSplit(evt Event) (Split, bool) {
+	if s.state == "" || s.state == "credits" || evt.Payload == "" {
+		return Split{}, false
+	}
+	split := Split{evt.Payload, s.elapsed(evt.Timestamp)}
+	s.recordSplit(split)
+	s.Metrics.Timing("split", split.Time, Tag{"split", "manual"})
+	return split, true
+}
+
+// milestoneSplit records the split of a milestone event, if the milestone
+// has one and the run in progress hasn't reached it yet. It reports false
+// otherwise.
+func (s *Session) milestoneSplit(evt Event) (Split, bool) {
+	if s.state == "" || s.state == "credits" {
+		return Split{}, false
+	}
+	for _, m := range s.Patterns.Get().Milestones {
+		if m.Name != evt.Type || m.Split == "" {
+			continue
+		}
+		if s.hasSplit(m.Split) {
+			return Split{}, false
+		}
+		split := Split{m.Split, s.elapsed(evt.Timestamp)}
+		s.recordSplit(split)
+		s.Metrics.Timing("split", split.Time, Tag{"split", evt.Type})
+		return split, true
+	}
+	return Split{}, false
+}
+
+// timer publishes a timer control event for external timers. The payload
+// carries the run's elapsed time in milliseconds, and the split name for
+// timer.split.
+func (s *Session) timer(typ string, elapsed time.Duration, split string) {
+	evt := Event{
+		Timestamp: time.Now(),
+		Type:      typ,
+		Payload:   fmt.Sprintf("time=%d", elapsed.Milliseconds()),
+		Attempt:   s.Data.Attempt,
+	}
+	if split != "" {
+		evt.Payload += " split=" + split
+	}
+	if s.active != nil {
+		evt.GameID = s.active.ID
+	}
+	s.publish(evt)
+}
+
+// switchTo makes a newly generated replica active if the switch policy
+// allows it. It never switches once the run has started.
+func (s *Session) switchTo(replica *Game) {
+	if s.SwitchPolicy != SwitchNewest || s.state != "" {
+		return
+	}
+	if s.active == nil || s.active == replica {
+		return
+	}
+	log.Printf("[core] switching from %s to newer %s", s.active.Name, replica.Name)
+	s.activate(replica)
+}
+
+// activate makes a replica active and sends its address to the proxy.
+func (s *Session) activate(replica *Game) {
+	s.mu.Lock()
+	s.active = replica
+	s.mu.Unlock()
+	s.activations++
+	s.activated[replica.ID] = s.activations
+	s.reportActive()
+	s.ProxyAddr <- replica.Addr
+}
+
+// markReady records that a replica's world is ready to play.
+func (s *Session) markReady(ctx context.Context, replica *Game) {
+	s.mu.Lock()
+	replica.Ready = true
+	replica.ReadyAt = time.Now()
+	s.mu.Unlock()
+	log.Printf("[core] server %d is online", replica.ID)
+	s.updateReady()
+	s.switchTo(replica)
+	if s.empty {
+		s.park(ctx, replica)
+	}
+}
+
+// forceSwitch makes a ready replica active on request, whatever the switch
+// policy. Like switchTo, it never switches once the run has started.
+func (s *Session) forceSwitch(ctx context.Context, replica *Game) {
+	if s.state != "" {
+		log.Printf("[core] not switching to %s during a run", replica.Name)
+		return
+	}
+	if !replica.Ready || replica == s.active {
+		return
+	}
+	if replica.Paused {
+		err := s.unpause(ctx, replica)
+		if err != nil {
+			log.Printf("[core] error unpausing %s: %s", replica.Name, err)
+			return
+		}
+	}
+	log.Printf("[core] switching to %s on request", replica.Name)
+	s.activate(replica)
+}
+
+// reset records the current attempt and resets the active game. Loop() picks
+// a new active game on its next iteration.
+func (s *Session) reset(ctx context.Context) {
+	if s.state != "" {
+		s.timer("timer.reset", s.elapsed(time.Now()), "")
+	}
+	s.finishAttempt()
+	if s.export != nil {
+		// export before the container and its world are gone
+		s.finishExport(ctx)
+	}
+	s.pendingSplit, s.pendingTimeout = nil, nil
+	s.autoReset = nil
+	s.lastReset = time.Now()
+	replica := s.active
+	s.mu.Lock()
+	s.state = ""
+	s.Data.Attempt += 1
+	replica.Ready = false
+	replica.ResetAt = time.Now()
+	s.active = nil
+	s.mu.Unlock()
+	err := replica.Reset(ctx)
 	if err != nil {
-		return err
+		s.gameError(replica, "killing the container", err)
 	}
-	return err
+	s.Metrics.Count("attempt", 1)
+	s.reportActive()
+	s.updateReady()
 }
 
-// Save saves all SessionData to the state.json file.
-func (s *Session) Save() error {
-	f, err := os.OpenFile(StateFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+// dimensionSplit announces a dimension entry split. If SplitCoords is set, it
+// first queries the player's position and defers the announcement until the
+// position arrives (or a short timeout elapses).
+func (s *Session) dimensionSplit(ctx context.Context, split Split) {
+	if !s.SplitCoords {
+		s.announce(ctx, split, "")
+		return
+	}
+	err := s.active.Command(ctx, "/data get entity @p Pos")
 	if err != nil {
-		return err
+		log.Printf("[core] error querying position: %s", err)
+		s.announce(ctx, split, "")
+		return
+	}
+	s.pendingSplit = &split
+	s.pendingTimeout = time.After(2 * time.Second)
+}
+
+// announce broadcasts a split message, styled as configured, to the players
+// selected by SplitDimension. It is compared with the personal best, and
+// colored by pace.
+func (s *Session) announce(ctx context.Context, split Split, pos string) {
+	delta := ""
+	if d, ok := s.splitDelta(split); ok {
+		delta = formatDelta(d)
+	}
+	msgs := s.config.Announce.Message(split, delta, pos, s.splitColor(split))
+	dimension := s.SplitDimension
+	if dimension == "current" {
+		dimension = runDimension(s.state)
+	}
+	var err error
+	if dimension == "" {
+		err = s.active.SayComponents(ctx, msgs)
+	} else {
+		err = s.active.SayComponentsIn(ctx, dimension, msgs)
 	}
-	err = json.NewEncoder(f).Encode(s.Data)
 	if err != nil {
-		return err
+		s.gameError(s.active, "sending the "+split.Name+" split", err)
 	}
-	return f.Close()
 }
 
-// Proxy listens on the standard Minecraft port and proxies all traffic to the
-// active replica. The replica address is updated via the ProxyAddr channel.
-func (s *Session) Proxy(ctx context.Context) {
-	proxyAddr := <-s.ProxyAddr
+// Setup commands that fail are sent again up to commandRetries times,
+// commandRetryDelay apart.
+const commandRetries = 2
 
-	for {
-		l, err := net.Listen("tcp", "0.0.0.0:25565")
-		if err != nil {
-			panic(err)
+var commandRetryDelay = 500 * time.Millisecond
+
+// setup sends commands that a run relies on to a game, retrying if they
+// fail. what describes the step in the logs and in the error reported if
+// the commands keep failing, e.g. "running login commands".
+func (s *Session) setup(ctx context.Context, g *Game, what string, commands ...string) error {
+	for attempt := 0; ; attempt++ {
+		err := g.Commands(ctx, commands...)
+		if err == nil {
+			return nil
+		}
+		if attempt >= commandRetries || ctx.Err() != nil {
+			s.gameError(g, what, err)
+			return err
 		}
+		log.Printf("[core] error %s on %s, retrying: %s", what, g.Name, err)
+		select {
+		case <-time.After(commandRetryDelay):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// gameError logs a failed command or Docker call on a game and reports it
+// as a "game.error" event, so that the failure shows up on the event stream
+// rather than the run quietly missing its effect.
+func (s *Session) gameError(g *Game, what string, err error) {
+	log.Printf("[core] error %s on %s: %s", what, g.Name, err)
+	s.Metrics.Count("game.errors", 1, Tag{"game", strconv.Itoa(g.ID)})
+	s.publish(Event{
+		GameID:    g.ID,
+		Timestamp: time.Now(),
+		Type:      "game.error",
+		Payload:   fmt.Sprintf("%s: %s", what, err),
+	})
+}
 
-		go func(l net.Listener) {
-			select {
-			case proxyAddr = <-s.ProxyAddr:
-				log.Printf("[proxy] switching to %s", proxyAddr)
-			case <-ctx.Done():
+// runDimension returns the dimension a player is in for a given run state.
+func runDimension(state string) string {
+	switch state {
+	case "nether":
+		return "minecraft:the_nether"
+	case "end":
+		return "minecraft:the_end"
+	}
+	return "minecraft:overworld"
+}
+
+// Message formats a split announcement, including the delta to the personal
+// best and the position if they are given. A clickable position copies its
+// coordinates.
+func (a AnnounceStyle) Message(split Split, delta string, pos string, color string) []Message {
+	text := fmt.Sprintf("%s: [%s]", split.Name, split.Time)
+	if delta != "" {
+		text += fmt.Sprintf(" (%s)", delta)
+	}
+	msgs := []Message{{
+		Text:   text,
+		Color:  color,
+		Bold:   a.Bold,
+		Italic: a.Italic,
+	}}
+	if pos != "" {
+		msg := msgs[0]
+		msg.Text = fmt.Sprintf(" at %s", pos)
+		if a.ClickCoords {
+			msg.ClickEvent = &ClickEvent{
+				Action: "copy_to_clipboard",
+				Value:  strings.Replace(pos, ",", "", -1),
 			}
-			l.Close()
-		}(l)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
 
-		for {
-			conn, err := l.Accept()
-			if err != nil {
-				log.Printf("[proxy] error accepting connection: %s", err)
-				break
+// updateReady reports the number of ready replicas, and whether each one is
+// ready, to the metrics sinks.
+func (s *Session) updateReady() {
+	ready := 0
+	for _, replica := range s.replicas {
+		value := 0.0
+		if replica.Ready {
+			ready++
+			value = 1
+		}
+		s.Metrics.Gauge("replica.ready", value, Tag{"game", strconv.Itoa(replica.ID)})
+	}
+	s.Metrics.Gauge("replicas.ready", float64(ready))
+}
+
+// reportActive reports the active game's ID, or -1 if there is none, to the
+// metrics sinks.
+func (s *Session) reportActive() {
+	id := -1
+	if s.active != nil {
+		id = s.active.ID
+	}
+	s.Metrics.Gauge("active_game", float64(id))
+}
+
+// publish sends an event to the registered sinks, including the event
+// stream, counting any sinks that dropped it.
+func (s *Session) publish(evt Event) {
+	dropped := s.Sinks.Publish(evt)
+	if dropped > 0 {
+		s.Metrics.Count("sinks.dropped", int64(dropped))
+	}
+}
+
+// heartbeatEvent builds a heartbeat carrying the current state and the
+// session's uptime, so stream consumers can tell a quiet session from a dead
+// one. Heartbeats only go to the event stream, never through Loop().
+func (s *Session) heartbeatEvent(t time.Time) Event {
+	evt := Event{
+		GameID:    -1,
+		Timestamp: t,
+		Type:      "heartbeat",
+		Payload:   fmt.Sprintf("state=%s uptime=%s", s.state, t.Sub(s.started).Round(time.Second)),
+	}
+	if s.active != nil {
+		evt.GameID = s.active.ID
+	}
+	return evt
+}
+
+// streamSink feeds the event stream, counting any subscribers it evicts.
+type streamSink struct {
+	s *Session
+}
+
+func (k streamSink) Handle(ctx context.Context, evt Event) {
+	evicted := k.s.Stream.Publish(evt)
+	if evicted > 0 {
+		log.Printf("[core] evicted %d slow event stream subscribers", evicted)
+		k.s.Metrics.Count("stream.evicted", int64(evicted))
+	}
+}
+
+// isSessionEvent reports whether an event type is published by the session
+// itself rather than received from a game.
+func isSessionEvent(typ string) bool {
+	return typ == "heartbeat" || typ == "game.error" || strings.HasPrefix(typ, "timer.")
+}
+
+// isLifecycleEvent reports whether an event describes a replica's container
+// rather than the run, and so is accepted from non-active replicas.
+// cmd.switch names the replica to switch to, and cmd.resync applies to
+// whichever replica is active when it is handled.
+func isLifecycleEvent(typ string) bool {
+	switch typ {
+	case "started", "generated", "ready", "paused", "unpaused", "crash", "crashloop", "cmd.switch", "cmd.resync":
+		return true
+	}
+	return false
+}
+
+// Readiness probe for generated worlds: the server port is dialled every
+// probeInterval until it accepts a connection or probeDeadline passes.
+const (
+	probeTimeout  = time.Second
+	probeInterval = 500 * time.Millisecond
+	probeDeadline = 30 * time.Second
+)
+
+// probe waits for a replica's server port at addr to accept connections,
+// then sends a "ready" event for it to Loop(). A replica that never accepts
+// one is left not ready.
+func (s *Session) probe(ctx context.Context, id int, addr string) {
+	deadline := time.Now().Add(probeDeadline)
+	for {
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(addr, strconv.Itoa(s.config.ServerPort)), probeTimeout)
+		if err == nil {
+			if s.config.ProxyProtocol {
+				// servers expecting PROXY headers reject bare connections
+				writeProxyHeader(conn, nil, nil)
 			}
-			if proxyAddr == "" {
-				conn.Close()
-				continue
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			log.Printf("[core] server %d never accepted connections: %s", id, err)
+			return
+		}
+		select {
+		case <-time.After(probeInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	evt := Event{
+		GameID:    id,
+		Timestamp: time.Now(),
+		Type:      "ready",
+		Payload:   addr,
+	}
+	select {
+	case s.Events <- evt:
+	case <-ctx.Done():
+	}
+}
+
+// nextReplica picks a ready replica to become active by SelectPolicy,
+// preferring ones that are already running. A paused replica is unpaused
+// before it is returned. It returns nil if no replica is ready.
+func (s *Session) nextReplica(ctx context.Context) *Game {
+	var running, stopped []*Game
+	for _, replica := range s.replicas {
+		if !replica.Ready {
+			continue
+		}
+		if replica.Paused {
+			stopped = append(stopped, replica)
+		} else {
+			running = append(running, replica)
+		}
+	}
+	if len(running) > 0 {
+		return s.selectReplica(running)
+	}
+	if len(stopped) == 0 {
+		return nil
+	}
+	paused := s.selectReplica(stopped)
+
+	err := s.unpause(ctx, paused)
+	if err != nil {
+		log.Printf("[core] error unpausing %s: %s", paused.Name, err)
+		return nil
+	}
+	log.Printf("[core] unpaused %s", paused.Name)
+	return paused
+}
+
+// selectReplica picks one of the candidates by SelectPolicy. Ties, such as
+// replicas that have never been active, go to the lowest ID.
+func (s *Session) selectReplica(candidates []*Game) *Game {
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].ID < candidates[j].ID
+	})
+	switch s.SelectPolicy {
+	case SelectRoundRobin:
+		last := -1
+		for id, n := range s.activated {
+			if n == s.activations {
+				last = id
+			}
+		}
+		for _, replica := range candidates {
+			if replica.ID > last {
+				return replica
 			}
-			log.Printf("%s -> %s", conn.RemoteAddr(), proxyAddr)
+		}
+	case SelectLRU:
+		lru := candidates[0]
+		for _, replica := range candidates[1:] {
+			if s.activated[replica.ID] < s.activated[lru.ID] {
+				lru = replica
+			}
+		}
+		return lru
+	}
+	return candidates[0]
+}
+
+// pauseIdle pauses every ready, non-active replica that has been idle for
+// longer than IdlePause.
+func (s *Session) pauseIdle(ctx context.Context) {
+	for _, replica := range s.replicas {
+		if !replica.Ready || replica.Paused || replica == s.active {
+			continue
+		}
+		if time.Since(replica.ReadyAt) < s.IdlePause {
+			continue
+		}
+
+		err := s.pause(ctx, replica)
+		if err != nil {
+			log.Printf("[core] error pausing %s: %s", replica.Name, err)
+			continue
+		}
+		log.Printf("[core] paused idle %s", replica.Name)
+	}
+}
+
+// setEmpty pauses the ready replicas other than the active one once the
+// proxy reports that nobody is connected, and unpauses them once somebody
+// connects again.
+func (s *Session) setEmpty(ctx context.Context, empty bool) {
+	s.empty = empty
+	if empty {
+		log.Printf("[core] nobody is connected, pausing spare servers")
+		for _, replica := range s.replicas {
+			s.park(ctx, replica)
+		}
+		return
+	}
+
+	for id := range s.parked {
+		replica := s.replicas[id]
+		if !replica.Paused {
+			// already unpaused to become active
+			continue
+		}
+		err := s.unpause(ctx, replica)
+		if err != nil {
+			log.Printf("[core] error unpausing %s: %s", replica.Name, err)
+			continue
+		}
+		log.Printf("[core] unpaused %s", replica.Name)
+	}
+	s.parked = nil
+}
+
+// park pauses a ready replica while nobody is connected. The active replica
+// is never paused, so a run in progress carries on.
+func (s *Session) park(ctx context.Context, replica *Game) {
+	if !replica.Ready || replica.Paused || replica == s.active {
+		return
+	}
+	err := s.pause(ctx, replica)
+	if err != nil {
+		log.Printf("[core] error pausing %s: %s", replica.Name, err)
+		return
+	}
+	if s.parked == nil {
+		s.parked = make(map[int]bool)
+	}
+	s.parked[replica.ID] = true
+	log.Printf("[core] paused %s while nobody is connected", replica.Name)
+}
+
+// pause pauses a replica's container and then records it as paused.
+func (s *Session) pause(ctx context.Context, replica *Game) error {
+	err := replica.Pause(ctx)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	replica.Paused = true
+	s.mu.Unlock()
+	return nil
+}
 
-			// Handle the connection in a new goroutine.
-			go func(c net.Conn) {
-				var proxy net.Conn
-				var err error
+// unpause resumes a replica's container and then records it as running,
+// restarting its idle time.
+func (s *Session) unpause(ctx context.Context, replica *Game) error {
+	err := replica.Unpause(ctx)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	replica.Paused = false
+	replica.ReadyAt = time.Now()
+	s.mu.Unlock()
+	return nil
+}
+
+// Shutdown sends the configured shutdown commands to every ready replica. It
+// gives up once ShutdownTimeout has elapsed so a hung server can't block exit.
+func (s *Session) Shutdown() {
+	if len(s.ShutdownCommands) == 0 {
+		return
+	}
 
-				// connect to proxy address
-				proxy, err = net.Dial("tcp", proxyAddr+":25565")
+	// the session context is already cancelled at this point
+	ctx, cancel := context.WithTimeout(context.Background(), s.ShutdownTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, replica := range s.replicas {
+		if !replica.Ready || replica.Paused {
+			continue
+		}
+		wg.Add(1)
+		go func(g *Game) {
+			defer wg.Done()
+			for _, command := range s.ShutdownCommands {
+				log.Printf("[%s] sending shutdown command '%s'", g.Name, command)
+				err := g.Command(ctx, command)
 				if err != nil {
-					log.Printf("[proxy] error connecting to proxy: %s", err)
-					c.Close()
+					log.Printf("[%s] error sending shutdown command: %s", g.Name, err)
 					return
 				}
+			}
+		}(replica)
+	}
 
-				// Close the connection once.
-				var once sync.Once
-				onceBody := func() {
-					c.Close()
-					proxy.Close()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Printf("[core] timed out sending shutdown commands")
+	}
+}
+
+// StopReplicas kills the container of every replica. Like Shutdown, it runs
+// after the session context is cancelled.
+func (s *Session) StopReplicas() {
+	var wg sync.WaitGroup
+	for _, replica := range s.replicas {
+		wg.Add(1)
+		go func(g *Game) {
+			defer wg.Done()
+			err := g.Stop(context.Background())
+			if err != nil {
+				if !client.IsErrNotFound(err) {
+					log.Printf("[%s] error stopping container: %s", g.Name, err)
 				}
+				return
+			}
+			log.Printf("[%s] stopped container", g.Name)
+		}(replica)
+	}
+	wg.Wait()
+}
+
+// Load loads all SessionData from the state.json file.
+func (s *Session) Load() error {
+	f, err := os.Open(StateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+	err = json.NewDecoder(f).Decode(&s.Data)
+	if err != nil {
+		return err
+	}
+	return err
+}
 
-				// Read from conn, send to proxy.
-				go func(c net.Conn) {
-					io.Copy(proxy, c)
-					once.Do(onceBody)
-				}(c)
-
-				// Read from proxy, send to conn.
-				go func(c net.Conn) {
-					io.Copy(c, proxy)
-					once.Do(onceBody)
-				}(c)
-			}(conn)
+// Save saves all SessionData to the state.json file, unless the session is a
+// replay.
+func (s *Session) Save() error {
+	if s.Replay {
+		return nil
+	}
+	return s.saveTo(StateFile)
+}
+
+// saveRetries is how many more times SaveFinal() tries the state file.
+const saveRetries = 2
+
+// SaveFinal saves the session on shutdown. If the state file can't be
+// written, it retries, then writes a timestamped backup to BackupDir or,
+// failing that, the temp directory. It returns an error if the state file
+// wasn't written, even if a backup was.
+func (s *Session) SaveFinal() error {
+	err := s.Save()
+	for i := 0; err != nil && i < saveRetries; i++ {
+		log.Printf("[core] error saving session, retrying: %s", err)
+		time.Sleep(time.Second)
+		err = s.Save()
+	}
+	if err == nil {
+		return nil
+	}
+
+	name := fmt.Sprintf("state-%s.json", time.Now().Format("20060102-150405"))
+	var dirs []string
+	if s.BackupDir != "" {
+		dirs = append(dirs, s.BackupDir)
+	}
+	dirs = append(dirs, os.TempDir())
+	for _, dir := range dirs {
+		path := filepath.Join(dir, name)
+		berr := s.saveTo(path)
+		if berr == nil {
+			return fmt.Errorf("saving %s: %s (saved backup to %s)", StateFile, err, path)
 		}
+		log.Printf("[core] error saving backup to %s: %s", path, berr)
+	}
+	return fmt.Errorf("saving %s: %s (no backup saved)", StateFile, err)
+}
+
+// saveTo writes all SessionData to path.
+func (s *Session) saveTo(path string) error {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	s.mu.RLock()
+	err = json.NewEncoder(f).Encode(s.Data)
+	s.mu.RUnlock()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// SetNote stores a note against an attempt, replacing any existing note, and
+// saves the session. An empty note removes it.
+func (s *Session) SetNote(attempt int, note string) error {
+	s.mu.Lock()
+	if attempt < 0 || attempt > s.Data.Attempt {
+		s.mu.Unlock()
+		return fmt.Errorf("unknown attempt %d", attempt)
+	}
+	if s.Data.Notes == nil {
+		s.Data.Notes = make(map[int]string)
+	}
+	if note == "" {
+		delete(s.Data.Notes, attempt)
+	} else {
+		s.Data.Notes[attempt] = note
+	}
+	s.mu.Unlock()
+	return s.Save()
+}
 
-		l.Close()
+// SetAttempt corrects the attempt counter and saves the session. The attempt
+// in progress, if any, keeps its number.
+func (s *Session) SetAttempt(attempt int) error {
+	if attempt < 0 {
+		return fmt.Errorf("invalid attempt %d", attempt)
 	}
+	s.mu.Lock()
+	s.Data.Attempt = attempt
+	s.mu.Unlock()
+	return s.Save()
 }
@@ -0,0 +1,1321 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/errdefs"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// fakeDocker is a DockerClient without a daemon, recording the containers
+// it creates, kills, stops and renames, the images it pulls, and the commands
+// written to their stdin.
+// Inspected containers have an ID distinct from their name, and never exit.
+type fakeDocker struct {
+	mu       sync.Mutex
+	created  []*container.HostConfig
+	killed   []string
+	stopped  []string
+	renamed  []string
+	commands []string
+	pulled   []string
+
+	// noImage fails container creation as if the image were missing, until
+	// it is pulled.
+	noImage bool
+
+	// attachFailures fails that many attaches before they succeed.
+	attachFailures int
+
+	// hold, if set, holds up killing, pausing and unpausing containers
+	// like a slow daemon, releasing a call for each value sent on it, or
+	// all of them once it is closed. Held calls send the container's name
+	// on held if there is room.
+	hold chan struct{}
+	held chan string
+}
+
+// wait holds up a call on container while hold is open.
+func (f *fakeDocker) wait(container string) {
+	if f.hold != nil {
+		select {
+		case f.held <- container:
+		default:
+		}
+		<-f.hold
+	}
+}
+
+var _ DockerClient = (*fakeDocker)(nil)
+
+func (f *fakeDocker) ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, platform *specs.Platform, containerName string) (container.ContainerCreateCreatedBody, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.noImage && len(f.pulled) == 0 {
+		return container.ContainerCreateCreatedBody{}, errdefs.NotFound(errors.New("No such image: " + config.Image))
+	}
+	f.created = append(f.created, hostConfig)
+	return container.ContainerCreateCreatedBody{ID: "id-" + containerName}, nil
+}
+
+func (f *fakeDocker) ImagePull(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pulled = append(f.pulled, ref)
+	progress := `{"status":"Pulling from library/mc","id":"latest"}
+{"status":"Downloading","progress":"[=>  ]","id":"abc123"}
+{"status":"Status: Downloaded newer image for mc:latest"}
+`
+	return ioutil.NopCloser(strings.NewReader(progress)), nil
+}
+
+func (f *fakeDocker) ContainerStart(ctx context.Context, container string, options types.ContainerStartOptions) error {
+	return nil
+}
+
+// ContainerWait reports the context's error once it's done, like the Docker
+// client, but the container never exits.
+func (f *fakeDocker) ContainerWait(ctx context.Context, name string, condition container.WaitCondition) (<-chan container.ContainerWaitOKBody, <-chan error) {
+	errc := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		errc <- ctx.Err()
+	}()
+	return make(chan container.ContainerWaitOKBody), errc
+}
+
+func (f *fakeDocker) ContainerKill(ctx context.Context, container, signal string) error {
+	f.wait(container)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.killed = append(f.killed, container)
+	return nil
+}
+
+func (f *fakeDocker) ContainerStop(ctx context.Context, container string, timeout *time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.stopped = append(f.stopped, fmt.Sprintf("%s after %s", container, *timeout))
+	return nil
+}
+
+func (f *fakeDocker) ContainerInspect(ctx context.Context, container string) (types.ContainerJSON, error) {
+	return types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{ID: "id-" + container, Name: container},
+		NetworkSettings:   &types.NetworkSettings{},
+	}, nil
+}
+
+func (f *fakeDocker) ContainerLogs(ctx context.Context, container string, options types.ContainerLogsOptions) (io.ReadCloser, error) {
+	return ioutil.NopCloser(strings.NewReader("")), nil
+}
+
+func (f *fakeDocker) ContainerAttach(ctx context.Context, container string, options types.ContainerAttachOptions) (types.HijackedResponse, error) {
+	f.mu.Lock()
+	if f.attachFailures > 0 {
+		f.attachFailures--
+		f.mu.Unlock()
+		return types.HijackedResponse{}, errors.New("attach failed")
+	}
+	f.mu.Unlock()
+	c, _ := net.Pipe()
+	return types.HijackedResponse{Conn: stdinConn{c, f, container}, Reader: bufio.NewReader(c)}, nil
+}
+
+// stdinConn is an attached container's stdin, recording each line written
+// to it as a command as soon as it is written, so that commands sent over
+// successive attaches are recorded in order.
+type stdinConn struct {
+	net.Conn
+	f    *fakeDocker
+	name string
+}
+
+func (c stdinConn) Write(p []byte) (int, error) {
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+	for _, line := range strings.SplitAfter(string(p), "\n") {
+		if line != "" {
+			c.f.commands = append(c.f.commands, c.name+" "+strings.TrimSuffix(line, "\n"))
+		}
+	}
+	return len(p), nil
+}
+
+func (f *fakeDocker) ContainerRename(ctx context.Context, container, newContainerName string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.renamed = append(f.renamed, newContainerName)
+	return nil
+}
+
+func (f *fakeDocker) ContainerPause(ctx context.Context, container string) error {
+	f.wait(container)
+	return nil
+}
+
+func (f *fakeDocker) ContainerUnpause(ctx context.Context, container string) error {
+	f.wait(container)
+	return nil
+}
+
+func (f *fakeDocker) CopyFromContainer(ctx context.Context, container, srcPath string) (io.ReadCloser, types.ContainerPathStat, error) {
+	return ioutil.NopCloser(strings.NewReader("")), types.ContainerPathStat{}, nil
+}
+
+func (f *fakeDocker) CopyToContainer(ctx context.Context, container, path string, content io.Reader, options types.CopyToContainerOptions) error {
+	return nil
+}
+
+func (f *fakeDocker) NetworkCreate(ctx context.Context, name string, options types.NetworkCreate) (types.NetworkCreateResponse, error) {
+	return types.NetworkCreateResponse{}, nil
+}
+
+func (f *fakeDocker) NetworkInspect(ctx context.Context, network string, options types.NetworkInspectOptions) (types.NetworkResource, error) {
+	return types.NetworkResource{}, nil
+}
+
+func (f *fakeDocker) Info(ctx context.Context) (types.Info, error) {
+	return types.Info{}, nil
+}
+
+// Commands returns the commands sent so far, each prefixed with the
+// container's name.
+func (f *fakeDocker) Commands() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.commands...)
+}
+
+// Created returns the host config of each container created so far.
+func (f *fakeDocker) Created() []*container.HostConfig {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*container.HostConfig(nil), f.created...)
+}
+
+// Renamed returns the new names of the containers renamed so far.
+func (f *fakeDocker) Renamed() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.renamed...)
+}
+
+// Pulled returns the images pulled so far.
+func (f *fakeDocker) Pulled() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.pulled...)
+}
+
+// Killed returns the containers killed so far.
+func (f *fakeDocker) Killed() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.killed...)
+}
+
+// Stopped returns the containers stopped so far, with their timeouts.
+func (f *fakeDocker) Stopped() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.stopped...)
+}
+
+// newTestSession creates a session of n replicas on a fakeDocker, in a
+// temporary directory so that no state file is loaded.
+func newTestSession(t *testing.T, n int) (*Session, *fakeDocker) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	config := &Config{Image: "test", Replicas: n}
+	err = config.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeDocker{}
+	s, err := NewSession(f, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, f
+}
+
+func TestNewSessionReplicas(t *testing.T) {
+	for _, n := range []int{0, DefaultReplicaLimit + 1} {
+		config := &Config{Image: "test", Replicas: n, MaxReplicas: n, ReplicaLimit: DefaultReplicaLimit}
+		_, err := NewSession(&fakeDocker{}, config)
+		if err == nil {
+			t.Errorf("%d replicas: no error", n)
+		}
+	}
+}
+
+// runLoop runs the session's Loop until the test ends. It returns a function
+// listing the addresses sent to the proxy so far.
+func runLoop(t *testing.T, s *Session) func() []string {
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		s.Loop(ctx)
+		close(stopped)
+	}()
+	var mu sync.Mutex
+	var proxied []string
+	go func() {
+		for {
+			select {
+			case addr := <-s.ProxyAddr:
+				mu.Lock()
+				proxied = append(proxied, addr)
+				mu.Unlock()
+			case <-stopped:
+				return
+			}
+		}
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-stopped
+	})
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), proxied...)
+	}
+}
+
+// send hands events to Loop and waits until it has handled them. Loop
+// handles events in order, so once it has received an event for an unknown
+// game, the ones before it are done.
+func send(t *testing.T, s *Session, events ...Event) {
+	events = append(events, Event{GameID: -1, Type: "sync"})
+	for _, evt := range events {
+		select {
+		case s.Events <- evt:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Loop didn't take '%s' from %d", evt.Type, evt.GameID)
+		}
+	}
+}
+
+// ready returns a ready event for replica id, as the probe sends it.
+func ready(id int) Event {
+	return Event{GameID: id, Timestamp: time.Now(), Type: "ready"}
+}
+
+func TestLoopReset(t *testing.T) {
+	tests := []struct {
+		name        string
+		stopTimeout time.Duration
+		stopped     string
+	}{
+		{"kill", 0, "killed mcspeedrun_0"},
+		{"graceful", 30 * time.Second, "stopped mcspeedrun_0 after 30s"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, cli := newTestSession(t, 2)
+			s.StopTimeout = tt.stopTimeout
+			s.configureReplicas()
+			runLoop(t, s)
+			send(t, s, ready(0), ready(1))
+			if st := s.Status(); st.Active != 0 || st.Attempt != 0 {
+				t.Fatalf("before reset: active %d, attempt %d", st.Active, st.Attempt)
+			}
+
+			send(t, s, Event{GameID: 0, Timestamp: time.Now(), Type: "cmd.reset"})
+			st := s.Status()
+			if st.Active != 1 || st.Attempt != 1 || st.State != "" {
+				t.Errorf("after reset: active %d, attempt %d, state %q", st.Active, st.Attempt, st.State)
+			}
+			if s.Replicas()[0].Ready {
+				t.Errorf("reset replica is still ready")
+			}
+			var stopped []string
+			deadline := time.Now().Add(5 * time.Second)
+			for len(stopped) == 0 && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+				for _, name := range cli.Killed() {
+					stopped = append(stopped, "killed "+name)
+				}
+				for _, stop := range cli.Stopped() {
+					stopped = append(stopped, "stopped "+stop)
+				}
+			}
+			if len(stopped) != 1 || stopped[0] != tt.stopped {
+				t.Errorf("stopped %q, want [%s]", stopped, tt.stopped)
+			}
+		})
+	}
+}
+
+func TestLoopResetDebounce(t *testing.T) {
+	s, _ := newTestSession(t, 3)
+	s.ResetDebounce = time.Hour
+	runLoop(t, s)
+	send(t, s, ready(0), ready(1))
+	send(t, s, Event{GameID: 0, Timestamp: time.Now(), Type: "cmd.reset"})
+
+	// a second reset straight away is taken for a duplicate
+	send(t, s, Event{GameID: 1, Timestamp: time.Now(), Type: "cmd.reset"})
+	if st := s.Status(); st.Active != 1 || st.Attempt != 1 {
+		t.Errorf("after a duplicate reset: active %d, attempt %d, want 1, 1", st.Active, st.Attempt)
+	}
+
+	// once the runner has joined the new world, resetting it is deliberate
+	send(t, s,
+		Event{GameID: 1, Timestamp: time.Now(), Type: "login", Payload: "alice joined the game"},
+		Event{GameID: 1, Timestamp: time.Now(), Type: "cmd.reset"},
+	)
+	if st := s.Status(); st.Attempt != 2 {
+		t.Errorf("after a reset in the new world: attempt %d, want 2", st.Attempt)
+	}
+}
+
+func TestLoopResetStaleReady(t *testing.T) {
+	s, _ := newTestSession(t, 2)
+	runLoop(t, s)
+	stale := ready(0)
+	send(t, s, ready(0), ready(1))
+	send(t, s, Event{GameID: 0, Timestamp: time.Now(), Type: "cmd.reset"})
+
+	// a probe that succeeded before the reset doesn't bring it back
+	send(t, s, stale)
+	if s.Replicas()[0].Ready {
+		t.Errorf("replica is ready from a probe before its reset")
+	}
+	send(t, s, ready(0))
+	if !s.Replicas()[0].Ready {
+		t.Errorf("replica isn't ready after its reset")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	s, cli := newTestSession(t, 2)
+	s.ShutdownCommands = []string{"/say bye", "/save-all"}
+	s.ShutdownTimeout = 5 * time.Second
+	s.replicas[0].Ready = true
+	s.Shutdown()
+
+	want := []string{"mcspeedrun_0 /say bye", "mcspeedrun_0 /save-all"}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(cli.Commands()) < len(want) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := cli.Commands(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+}
+
+func TestLoopStopOnExit(t *testing.T) {
+	s, cli := newTestSession(t, 2)
+	s.StopOnExit = true
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		s.Loop(ctx)
+		close(stopped)
+	}()
+	go func() {
+		for {
+			select {
+			case <-s.ProxyAddr:
+			case <-stopped:
+				return
+			}
+		}
+	}()
+	cancel()
+	<-stopped
+
+	killed := cli.Killed()
+	sort.Strings(killed)
+	want := []string{"mcspeedrun_0", "mcspeedrun_1"}
+	if fmt.Sprint(killed) != fmt.Sprint(want) {
+		t.Errorf("killed %q, want %q", killed, want)
+	}
+}
+
+func TestLoopIdlePause(t *testing.T) {
+	s, _ := newTestSession(t, 3)
+	s.IdlePause = 20 * time.Millisecond
+	runLoop(t, s)
+	send(t, s, ready(0), ready(1), ready(2))
+
+	paused := func() []bool {
+		var p []bool
+		for _, replica := range s.Replicas() {
+			p = append(p, replica.Paused)
+		}
+		return p
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for fmt.Sprint(paused()) != "[false true true]" && time.Now().Before(deadline) {
+		send(t, s)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if p := paused(); fmt.Sprint(p) != "[false true true]" {
+		t.Fatalf("paused %v, want the idle replicas besides the active one", p)
+	}
+
+	// with no running replica left, the reset picks a paused one
+	send(t, s, Event{GameID: 0, Timestamp: time.Now(), Type: "cmd.reset"})
+	active := s.Status().Active
+	if active != 1 && active != 2 {
+		t.Fatalf("active %d after the reset, want 1 or 2", active)
+	}
+	if s.Replicas()[active].Paused {
+		t.Errorf("the new active replica is still paused")
+	}
+}
+
+func TestLoopPauseWhenEmpty(t *testing.T) {
+	s, _ := newTestSession(t, 3)
+	runLoop(t, s)
+	send(t, s, ready(0), ready(1))
+	paused := func() string {
+		var p []bool
+		for _, replica := range s.Replicas() {
+			p = append(p, replica.Paused)
+		}
+		return fmt.Sprint(p)
+	}
+
+	s.ProxyEmpty <- true
+	send(t, s)
+	if p := paused(); p != "[false true false]" {
+		t.Errorf("paused %s once empty, want the ready replica besides the active one", p)
+	}
+	// replicas that become ready while empty are paused too
+	send(t, s, ready(2))
+	if p := paused(); p != "[false true true]" {
+		t.Errorf("paused %s after a replica is ready, want it paused", p)
+	}
+
+	s.ProxyEmpty <- false
+	send(t, s)
+	if p := paused(); p != "[false false false]" {
+		t.Errorf("paused %s once a player connects, want none", p)
+	}
+}
+
+// TestLoopSlowDocker checks that the accessors don't wait for Loop's Docker
+// calls, which are made without holding the session's lock.
+func TestLoopSlowDocker(t *testing.T) {
+	s, cli := newTestSession(t, 2)
+	cli.hold, cli.held = make(chan struct{}), make(chan string, 1)
+	runLoop(t, s)
+	send(t, s, ready(0), ready(1))
+
+	// pollWhileHeld waits for Loop to be held up calling Docker for
+	// container, and returns the status and replicas read meanwhile
+	pollWhileHeld := func(container string) (Status, []ReplicaStatus) {
+		t.Helper()
+		select {
+		case name := <-cli.held:
+			if name != container {
+				t.Errorf("held up on %s, want %s", name, container)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no Docker call for %s", container)
+		}
+		var st Status
+		var replicas []ReplicaStatus
+		polled := make(chan struct{})
+		go func() {
+			st, replicas = s.Status(), s.Replicas()
+			close(polled)
+		}()
+		select {
+		case <-polled:
+		case <-time.After(5 * time.Second):
+			t.Errorf("accessors blocked while calling Docker for %s", container)
+		}
+		cli.hold <- struct{}{}
+		<-polled
+		return st, replicas
+	}
+
+	s.ProxyEmpty <- true
+	pollWhileHeld("mcspeedrun_1")
+	s.ProxyEmpty <- false
+	pollWhileHeld("mcspeedrun_1")
+
+	go func() { s.Events <- Event{GameID: 0, Timestamp: time.Now(), Type: "cmd.reset"} }()
+	st, replicas := pollWhileHeld("mcspeedrun_0")
+	// the reset is published before the container is killed
+	if st.Attempt != 1 || st.Active != -1 || replicas[0].Ready {
+		t.Errorf("while killing: attempt %d, active %d, replica 0 ready %t, want 1, -1, false", st.Attempt, st.Active, replicas[0].Ready)
+	}
+	close(cli.hold)
+	send(t, s)
+	if st := s.Status(); st.Active != 1 {
+		t.Errorf("active %d after the reset, want 1", st.Active)
+	}
+}
+
+func TestLoopHeartbeat(t *testing.T) {
+	s, _ := newTestSession(t, 2)
+	s.Heartbeat = 10 * time.Millisecond
+	stream := s.Stream.Subscribe()
+	defer s.Stream.Unsubscribe(stream)
+	runLoop(t, s)
+	send(t, s, ready(0))
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case evt := <-stream:
+			if evt.Type != "heartbeat" || evt.GameID != 0 {
+				continue
+			}
+			if !strings.HasPrefix(evt.Payload, "state= uptime=") {
+				t.Errorf("heartbeat payload %q", evt.Payload)
+			}
+			return
+		case <-timeout:
+			t.Fatal("no heartbeat from the active replica")
+		}
+	}
+}
+
+func TestLoopSplitCoords(t *testing.T) {
+	s, cli := newTestSession(t, 1)
+	s.SplitCoords = true
+	runLoop(t, s)
+	now := time.Now()
+	send(t, s,
+		ready(0),
+		Event{GameID: 0, Timestamp: now, Type: "login", Payload: "alice joined the game"},
+		Event{GameID: 0, Timestamp: now.Add(time.Minute), Type: "nether"},
+		Event{GameID: 0, Timestamp: now.Add(time.Minute), Type: "position", Payload: "12, 64, -9"},
+	)
+
+	deadline := time.Now().Add(5 * time.Second)
+	var query, announced bool
+	for !(query && announced) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		for _, cmd := range cli.Commands() {
+			query = query || cmd == "mcspeedrun_0 /data get entity @p Pos"
+			announced = announced || strings.Contains(cmd, "12, 64, -9")
+		}
+	}
+	if !query || !announced {
+		t.Errorf("queried the position: %t, announced it: %t; sent %q", query, announced, cli.Commands())
+	}
+}
+
+func TestLoopAutoReset(t *testing.T) {
+	tests := []struct {
+		name   string
+		manual bool
+	}{
+		{"after credits", false},
+		{"cancelled by a manual reset", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestSession(t, 3)
+			s.AutoReset = 50 * time.Millisecond
+			runLoop(t, s)
+			now := time.Now()
+			send(t, s,
+				ready(0), ready(1), ready(2),
+				Event{GameID: 0, Timestamp: now, Type: "login", Payload: "alice joined the game"},
+				Event{GameID: 0, Timestamp: now.Add(time.Minute), Type: "nether"},
+				Event{GameID: 0, Timestamp: now.Add(2 * time.Minute), Type: "end"},
+				Event{GameID: 0, Timestamp: now.Add(3 * time.Minute), Type: "credits"},
+			)
+			if tt.manual {
+				send(t, s, Event{GameID: 0, Timestamp: time.Now(), Type: "cmd.reset"})
+			}
+
+			deadline := time.Now().Add(5 * time.Second)
+			for s.Status().Attempt == 0 && time.Now().Before(deadline) {
+				send(t, s)
+				time.Sleep(10 * time.Millisecond)
+			}
+			// give a cancelled auto-reset the time to fire anyway
+			time.Sleep(4 * s.AutoReset)
+			send(t, s)
+			if st := s.Status(); st.Attempt != 1 || st.Active < 1 {
+				t.Errorf("attempt %d on %d, want attempt 1 on another replica", st.Attempt, st.Active)
+			}
+			if a, ok := s.Attempt(0); !ok || a.Result != "credits" {
+				t.Errorf("attempt %+v, want the completed run", a)
+			}
+		})
+	}
+}
+
+func TestLoopEndPortal(t *testing.T) {
+	s, _ := newTestSession(t, 1)
+	runLoop(t, s)
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	at := func(minutes int) time.Time { return start.Add(time.Duration(minutes) * time.Minute) }
+	send(t, s,
+		ready(0),
+		Event{GameID: 0, Timestamp: start, Type: "login", Payload: "alice joined the game"},
+		Event{GameID: 0, Timestamp: at(5), Type: "nether"},
+		Event{GameID: 0, Timestamp: at(10), Type: "endportal"},
+		// re-entering the portal, e.g. after dying in the end, isn't a split
+		Event{GameID: 0, Timestamp: at(11), Type: "endportal"},
+		Event{GameID: 0, Timestamp: at(12), Type: "end"},
+	)
+
+	attempt, ok := s.Attempt(0)
+	if !ok {
+		t.Fatal("no attempt in progress")
+	}
+	var splits []string
+	for _, split := range attempt.Splits {
+		splits = append(splits, fmt.Sprintf("%s@%s", split.Name, split.Time))
+	}
+	want := "[Nether@5m0s End Portal@10m0s End@12m0s]"
+	if fmt.Sprint(splits) != want {
+		t.Errorf("splits %s, want %s", splits, want)
+	}
+	if state := s.Status().State; state != "end" {
+		t.Errorf("state %q, want end", state)
+	}
+}
+
+func TestLoopMilestoneSplits(t *testing.T) {
+	tests := []struct {
+		name       string
+		milestones []Milestone
+		splits     string
+		timers     string
+	}{
+		{"default", nil, "[Nether@5m0s End@20m0s]", "[Nether End]"},
+		{
+			"opted in",
+			[]Milestone{{Name: "bastion", Split: "Bastion"}, {Name: "fortress", Split: "Fortress"}},
+			"[Fortress@2m0s Nether@5m0s Bastion@8m0s End@20m0s]",
+			"[Fortress Nether Bastion End]",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestSession(t, 1)
+			s.Patterns.Set(Patterns{Milestones: (&Config{Milestones: tt.milestones}).MilestoneSet()})
+			stream := s.Stream.Subscribe()
+			defer s.Stream.Unsubscribe(stream)
+			runLoop(t, s)
+			start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+			at := func(minutes int) time.Time { return start.Add(time.Duration(minutes) * time.Minute) }
+			send(t, s,
+				ready(0),
+				// milestones before the run starts aren't splits
+				Event{GameID: 0, Timestamp: start.Add(-time.Minute), Type: "bastion"},
+				Event{GameID: 0, Timestamp: start, Type: "login", Payload: "alice joined the game"},
+				Event{GameID: 0, Timestamp: at(2), Type: "fortress"},
+				Event{GameID: 0, Timestamp: at(5), Type: "nether"},
+				Event{GameID: 0, Timestamp: at(8), Type: "bastion"},
+				// only the first time a milestone is reached is a split
+				Event{GameID: 0, Timestamp: at(9), Type: "fortress"},
+				Event{GameID: 0, Timestamp: at(20), Type: "end"},
+			)
+
+			attempt, ok := s.Attempt(0)
+			if !ok {
+				t.Fatal("no attempt in progress")
+			}
+			var splits []string
+			for _, split := range attempt.Splits {
+				splits = append(splits, fmt.Sprintf("%s@%s", split.Name, split.Time))
+			}
+			if fmt.Sprint(splits) != tt.splits {
+				t.Errorf("splits %s, want %s", splits, tt.splits)
+			}
+			var timers []string
+			for len(stream) > 0 {
+				evt := <-stream
+				if evt.Type == "timer.split" {
+					timers = append(timers, evt.Payload[strings.Index(evt.Payload, "split=")+len("split="):])
+				}
+			}
+			if fmt.Sprint(timers) != tt.timers {
+				t.Errorf("timer splits %s, want %s", timers, tt.timers)
+			}
+			// milestones don't disturb the category's order
+			if state := s.Status().State; state != "end" {
+				t.Errorf("state %q, want end", state)
+			}
+		})
+	}
+}
+
+func TestLoopEventLog(t *testing.T) {
+	s, _ := newTestSession(t, 1)
+	l, err := OpenEventLog("events.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	s.Sinks.RegisterInline(context.Background(), "event log", l)
+	stream := s.Stream.Subscribe()
+	defer s.Stream.Unsubscribe(stream)
+	runLoop(t, s)
+	send(t, s,
+		ready(0),
+		Event{GameID: 0, Timestamp: time.Now(), Type: "login", Payload: "alice joined the game"},
+		Event{GameID: 0, Timestamp: time.Now(), Type: "nether"},
+	)
+
+	// the stream has every event, the log only the games' events
+	var streamed []string
+	for len(stream) > 0 {
+		streamed = append(streamed, (<-stream).Type)
+	}
+	if !contains(streamed, "nether") || !contains(streamed, "timer.split") {
+		t.Errorf("streamed %s, want nether and timer.split", streamed)
+	}
+	data, err := ioutil.ReadFile("events.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logged []string
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for dec.More() {
+		var evt Event
+		err = dec.Decode(&evt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		logged = append(logged, evt.Type)
+	}
+	if want := "[ready login nether]"; fmt.Sprint(logged) != want {
+		t.Errorf("logged %s, want %s", logged, want)
+	}
+}
+
+func TestLoopSwitchPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		login  bool
+		active int
+	}{
+		{"never", SwitchNever, false, 0},
+		{"newest", SwitchNewest, false, 1},
+		{"newest during a run", SwitchNewest, true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestSession(t, 2)
+			s.SwitchPolicy = tt.policy
+			runLoop(t, s)
+			send(t, s, ready(0))
+			if tt.login {
+				send(t, s, Event{GameID: 0, Timestamp: time.Now(), Type: "login", Payload: "alice joined the game"})
+			}
+			send(t, s, ready(1))
+			if active := s.Status().Active; active != tt.active {
+				t.Errorf("active %d, want %d", active, tt.active)
+			}
+		})
+	}
+}
+
+func TestLoopSelectPolicy(t *testing.T) {
+	tests := []struct {
+		policy string
+		active []int
+	}{
+		{SelectLowest, []int{0, 1, 0}},
+		{SelectRoundRobin, []int{0, 1, 2}},
+		{SelectLRU, []int{1, 0, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			s, _ := newTestSession(t, 3)
+			s.SelectPolicy = tt.policy
+			runLoop(t, s)
+			send(t, s, ready(0), ready(1), ready(2))
+			send(t, s, Event{GameID: 2, Type: "cmd.switch"})
+
+			// the reset replica is ready again before each pick
+			var active []int
+			for i := 0; i < 3; i++ {
+				id := s.Status().Active
+				send(t, s, Event{GameID: id, Timestamp: time.Now(), Type: "cmd.reset"})
+				active = append(active, s.Status().Active)
+				send(t, s, ready(id))
+			}
+			if fmt.Sprint(active) != fmt.Sprint(tt.active) {
+				t.Errorf("active %v, want %v", active, tt.active)
+			}
+		})
+	}
+}
+
+func TestLoopReissueSaveOff(t *testing.T) {
+	tests := []struct {
+		name     string
+		reissue  bool
+		login    bool
+		reissued bool
+	}{
+		{"during a run", true, true, true},
+		{"disabled", false, true, false},
+		{"before the run", true, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, cli := newTestSession(t, 1)
+			s.ReissueSaveOff = tt.reissue
+			runLoop(t, s)
+			send(t, s, ready(0))
+			if tt.login {
+				send(t, s, Event{GameID: 0, Timestamp: time.Now(), Type: "login", Payload: "alice joined the game"})
+			}
+			saveOff := func() int {
+				n := 0
+				for _, cmd := range cli.Commands() {
+					if cmd == "mcspeedrun_0 /save-off" {
+						n++
+					}
+				}
+				return n
+			}
+			// wait for the login's commands before counting
+			time.Sleep(100 * time.Millisecond)
+			before := saveOff()
+
+			send(t, s, Event{GameID: 0, Timestamp: time.Now(), Type: "save", Payload: "Saved the game"})
+			want := before
+			if tt.reissued {
+				want++
+			}
+			deadline := time.Now().Add(time.Second)
+			for saveOff() != want && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			time.Sleep(50 * time.Millisecond)
+			if n := saveOff(); n != want {
+				t.Errorf("sent /save-off %d times after the save, want %d", n-before, want-before)
+			}
+		})
+	}
+}
+
+func TestSaveFinal(t *testing.T) {
+	tests := []struct {
+		name   string
+		broken bool
+	}{
+		{"saved", false},
+		{"backed up", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestSession(t, 1)
+			s.BackupDir = t.TempDir()
+			s.Data.Attempt = 7
+			if tt.broken {
+				// a directory in the way of the state file
+				err := os.Mkdir(StateFile, 0755)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := s.SaveFinal()
+			path := StateFile
+			if tt.broken {
+				backups, _ := filepath.Glob(filepath.Join(s.BackupDir, "state-*.json"))
+				if len(backups) != 1 {
+					t.Fatalf("backups %q, want one", backups)
+				}
+				path = backups[0]
+				if err == nil || !strings.Contains(err.Error(), "saved backup to "+path) {
+					t.Errorf("error %v, want it to name the backup", err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(data), `"attempt":7`) {
+				t.Errorf("%s: %s, want attempt 7", path, data)
+			}
+		})
+	}
+}
+
+func TestLoopTimerEvents(t *testing.T) {
+	s, _ := newTestSession(t, 2)
+	stream := s.Stream.Subscribe()
+	defer s.Stream.Unsubscribe(stream)
+	runLoop(t, s)
+	start := time.Now().Add(-time.Hour)
+	at := func(minutes int) time.Time { return start.Add(time.Duration(minutes) * time.Minute) }
+	send(t, s,
+		ready(0), ready(1),
+		Event{GameID: 0, Timestamp: at(0), Type: "login", Payload: "alice joined the game"},
+		Event{GameID: 0, Timestamp: at(1), Type: "nether"},
+		Event{GameID: 0, Timestamp: at(2), Type: "end"},
+		Event{GameID: 0, Timestamp: at(3), Type: "cmd.reset"},
+		Event{GameID: 1, Timestamp: time.Now(), Type: "login", Payload: "alice joined the game"},
+	)
+
+	// each timer event carries the attempt it was published for
+	var timers []string
+	for len(stream) > 0 {
+		evt := <-stream
+		if strings.HasPrefix(evt.Type, "timer.") {
+			timers = append(timers, fmt.Sprintf("%s #%d %s", evt.Type, evt.Attempt, evt.Payload))
+		}
+	}
+	want := []string{
+		"timer.start #0 time=0",
+		"timer.split #0 time=60000 split=Nether",
+		"timer.split #0 time=120000 split=End",
+		"timer.reset #0",
+		"timer.start #1 time=0",
+	}
+	if len(timers) != len(want) {
+		t.Fatalf("timer events %q, want %q", timers, want)
+	}
+	for i := range want {
+		if !strings.HasPrefix(timers[i], want[i]) {
+			t.Errorf("timer event %d is %q, want %q", i, timers[i], want[i])
+		}
+	}
+}
+
+func TestLoopPause(t *testing.T) {
+	s, _ := newTestSession(t, 1)
+	stream := s.Stream.Subscribe()
+	defer s.Stream.Unsubscribe(stream)
+	runLoop(t, s)
+	start := time.Now().Add(-time.Hour)
+	at := func(minutes int) time.Time { return start.Add(time.Duration(minutes) * time.Minute) }
+	send(t, s,
+		ready(0),
+		Event{GameID: 0, Timestamp: at(0), Type: "login", Payload: "alice joined the game"},
+		Event{GameID: 0, Timestamp: at(1), Type: "cmd.pause"},
+		// a split while held is timed as of the pause
+		Event{GameID: 0, Timestamp: at(2), Type: "nether"},
+		Event{GameID: 0, Timestamp: at(3), Type: "cmd.pause"},
+		Event{GameID: 0, Timestamp: at(4), Type: "cmd.resume"},
+		Event{GameID: 0, Timestamp: at(6), Type: "end"},
+	)
+
+	attempt, _ := s.Attempt(0)
+	var splits []string
+	for _, split := range attempt.Splits {
+		splits = append(splits, fmt.Sprintf("%s %s", split.Name, split.Time))
+	}
+	if want := "[Nether 1m0s End 3m0s]"; fmt.Sprint(splits) != want {
+		t.Errorf("splits %s, want %s", splits, want)
+	}
+
+	var timers []string
+	for len(stream) > 0 {
+		evt := <-stream
+		if strings.HasPrefix(evt.Type, "timer.") {
+			timers = append(timers, evt.Type+" "+evt.Payload)
+		}
+	}
+	want := []string{
+		"timer.start time=0",
+		"timer.pause time=60000",
+		"timer.split time=60000 split=Nether",
+		"timer.resume time=60000",
+		"timer.split time=180000 split=End",
+	}
+	if fmt.Sprint(timers) != fmt.Sprint(want) {
+		t.Errorf("timer events %q, want %q", timers, want)
+	}
+}
+
+func TestKeepContainers(t *testing.T) {
+	tests := []struct {
+		keep       bool
+		autoRemove bool
+	}{
+		{false, true},
+		{true, false},
+	}
+	for _, tt := range tests {
+		s, cli := newTestSession(t, 1)
+		s.KeepContainers = tt.keep
+		s.configureReplicas()
+		runLoop(t, s)
+
+		err := s.replicas[0].Start(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		created := cli.Created()
+		if len(created) != 1 || created[0].AutoRemove != tt.autoRemove {
+			t.Errorf("keep %t: created %+v, want auto-remove %t", tt.keep, created, tt.autoRemove)
+		}
+	}
+
+	// a kept container is renamed out of the way of the next one
+	s, cli := newTestSession(t, 1)
+	s.replicas[0].keep(context.Background())
+	if renamed := cli.Renamed(); len(renamed) != 1 || !strings.HasPrefix(renamed[0], "mcspeedrun_0_") {
+		t.Errorf("renamed %q, want mcspeedrun_0_<time>", renamed)
+	}
+}
+
+func TestLoopCrash(t *testing.T) {
+	s, _ := newTestSession(t, 3)
+	runLoop(t, s)
+	send(t, s, ready(0), ready(1), ready(2))
+
+	tests := []struct {
+		name    string
+		id      int
+		active  int
+		attempt int
+		ready   string
+	}{
+		{"spare replica", 2, 0, 0, "[true true false]"},
+		{"active replica", 0, 1, 1, "[false true false]"},
+	}
+	for _, tt := range tests {
+		send(t, s, Event{GameID: tt.id, Timestamp: time.Now(), Type: "crash", Payload: "exit code 1"})
+		var ready []bool
+		for _, replica := range s.Replicas() {
+			ready = append(ready, replica.Ready)
+		}
+		st := s.Status()
+		if st.Active != tt.active || st.Attempt != tt.attempt || fmt.Sprint(ready) != tt.ready {
+			t.Errorf("%s crashed: active %d, attempt %d, ready %v, want %d, %d, %s",
+				tt.name, st.Active, st.Attempt, ready, tt.active, tt.attempt, tt.ready)
+		}
+	}
+}
+
+func TestLoopLoginCommands(t *testing.T) {
+	tests := []struct {
+		name  string
+		login []string
+		want  []string
+	}{
+		{"defaults", nil, []string{"/time set 0", "/save-off"}},
+		{"coordinates", []string{"/gamerule showCoordinates true"},
+			[]string{"/time set 0", "/save-off", "/gamerule showCoordinates true"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, cli := newTestSession(t, 1)
+			s.config.LoginCommands = tt.login
+			runLoop(t, s)
+			send(t, s, ready(0), Event{GameID: 0, Timestamp: time.Now(), Type: "login", Payload: "alice joined the game"})
+
+			want := []string{"mcspeedrun_0 " + tellraw("attempt #0", "green")}
+			for _, cmd := range tt.want {
+				want = append(want, "mcspeedrun_0 "+cmd)
+			}
+			deadline := time.Now().Add(5 * time.Second)
+			for len(cli.Commands()) < len(want) && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if got := cli.Commands(); fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("sent %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestLoopCommandErrors(t *testing.T) {
+	delay := commandRetryDelay
+	commandRetryDelay = time.Millisecond
+	t.Cleanup(func() { commandRetryDelay = delay })
+	login := Event{GameID: 0, Timestamp: time.Now(), Type: "login", Payload: "alice joined the game"}
+
+	// a failed attach is retried
+	s, cli := newTestSession(t, 1)
+	cli.attachFailures = commandRetries
+	runLoop(t, s)
+	send(t, s, ready(0), login)
+	if got := cli.Commands(); len(got) != 3 {
+		t.Errorf("sent %q after retrying, want the login commands", got)
+	}
+
+	// commands that keep failing are reported
+	s, cli = newTestSession(t, 1)
+	cli.attachFailures = commandRetries + 1
+	stream := s.Stream.Subscribe()
+	defer s.Stream.Unsubscribe(stream)
+	runLoop(t, s)
+	send(t, s, ready(0), login)
+	if got := cli.Commands(); len(got) != 0 {
+		t.Errorf("sent %q, want nothing", got)
+	}
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case evt := <-stream:
+			if evt.Type != "game.error" {
+				continue
+			}
+			if evt.GameID != 0 || evt.Payload != "running login commands: attach failed" {
+				t.Errorf("error event %+v", evt)
+			}
+			return
+		case <-timeout:
+			t.Fatal("no error event")
+		}
+	}
+}
+
+func TestLoopGeneratedCommands(t *testing.T) {
+	s, cli := newTestSession(t, 1)
+	s.config.GeneratedCommands = []string{"/difficulty hard", "/gamerule doDaylightCycle false"}
+	runLoop(t, s)
+	send(t, s, Event{GameID: 0, Timestamp: time.Now(), Type: "generated"})
+
+	want := []string{"mcspeedrun_0 /difficulty hard", "mcspeedrun_0 /gamerule doDaylightCycle false"}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(cli.Commands()) < len(want) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := cli.Commands(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+}
+
+// poll calls each reader in a loop on its own goroutine until the returned
+// function is called, which waits for them to stop.
+func poll(readers ...func()) func() {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, read := range readers {
+		wg.Add(1)
+		go func(read func()) {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					read()
+					runtime.Gosched()
+				}
+			}
+		}(read)
+	}
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+// TestLoopConcurrentReaders drives runs through Loop while the accessors
+// used by the API, dashboard and proxy poll the session, for -race.
+func TestLoopConcurrentReaders(t *testing.T) {
+	s, _ := newTestSession(t, 2)
+	runLoop(t, s)
+
+	stop := poll(
+		func() { s.Status() },
+		func() { s.Replicas() },
+		func() { s.History() },
+		func() { s.Attempt(0) },
+		func() { s.DashboardState() },
+		func() { s.SetNote(0, "seed was good") },
+	)
+	for i := 0; i < 5; i++ {
+		id := i % 2
+		now := time.Now()
+		send(t, s,
+			ready(0), ready(1),
+			Event{GameID: id, Timestamp: now, Type: "login", Payload: "alice joined the game"},
+			Event{GameID: id, Timestamp: now.Add(time.Minute), Type: "nether"},
+			Event{GameID: id, Timestamp: now.Add(2 * time.Minute), Type: "cmd.reset"},
+		)
+	}
+	stop()
+
+	if attempt := s.Status().Attempt; attempt != 5 {
+		t.Errorf("attempt %d, want 5", attempt)
+	}
+	if n := len(s.History()); n != 5 {
+		t.Errorf("%d attempts in the history, want 5", n)
+	}
+}
+
+// TestStatusConcurrent polls Status, Elapsed and /status while Loop starts,
+// pauses and resets runs, for -race. Each snapshot must be consistent: a run
+// in progress has an active replica and a start time.
+func TestStatusConcurrent(t *testing.T) {
+	s, _ := newTestSession(t, 2)
+	runLoop(t, s)
+
+	check := func(st Status) {
+		if st.State != "" && (st.Active < 0 || st.TimeStart.IsZero()) {
+			t.Errorf("state %q with active %d, start %s", st.State, st.Active, st.TimeStart)
+		}
+	}
+	stop := poll(
+		func() { check(s.Status()) },
+		func() {
+			var st Status
+			w := request(s, "GET", "/status", "", "")
+			err := json.Unmarshal(w.Body.Bytes(), &st)
+			if err != nil {
+				t.Errorf("decoding %s: %s", w.Body, err)
+				return
+			}
+			check(st)
+		},
+		func() {
+			if elapsed := s.Elapsed(time.Now()); s.Status().State != "" && elapsed < 0 {
+				t.Errorf("elapsed %s", elapsed)
+			}
+		},
+	)
+	for i := 0; i < 5; i++ {
+		start := time.Now().Add(-time.Hour)
+		send(t, s,
+			ready(0), ready(1),
+			Event{GameID: i % 2, Timestamp: start, Type: "login", Payload: "alice joined the game"},
+			Event{GameID: i % 2, Timestamp: start.Add(time.Minute), Type: "cmd.pause"},
+			Event{GameID: i % 2, Timestamp: start.Add(2 * time.Minute), Type: "cmd.resume"},
+			Event{GameID: i % 2, Timestamp: start.Add(3 * time.Minute), Type: "nether"},
+			Event{GameID: i % 2, Timestamp: start.Add(4 * time.Minute), Type: "cmd.reset"},
+		)
+	}
+	stop()
+
+	if st := s.Status(); st.State != "" || st.Attempt != 5 {
+		t.Errorf("state %q, attempt %d, want \"\", 5", st.State, st.Attempt)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+)
+
+// sinkBuffer is how many events a sink may fall behind before new events
+// are dropped for it.
+const sinkBuffer = 64
+
+// EventSink is an integration that acts on session events, e.g. by
+// forwarding them to an external service. Handle is called from the sink's
+// own goroutine, one event at a time, so it may block without holding up the
+// session or other sinks.
+type EventSink interface {
+	Handle(ctx context.Context, evt Event)
+}
+
+// SinkRegistry fans events out to the sinks registered at startup. Each sink
+// has its own buffered queue; a sink that falls behind misses events rather
+// than blocking the producer.
+type SinkRegistry struct {
+	mu    sync.Mutex
+	sinks []*registeredSink
+}
+
+type registeredSink struct {
+	name string
+	ch   chan Event
+
+	// inline, if set, is handed each event from Publish itself, with ctx.
+	inline EventSink
+	ctx    context.Context
+}
+
+// Register adds a sink and starts delivering events to it until the context
+// is cancelled.
+func (r *SinkRegistry) Register(ctx context.Context, name string, sink EventSink) {
+	rs := &registeredSink{
+		name: name,
+		ch:   make(chan Event, sinkBuffer),
+	}
+	r.mu.Lock()
+	r.sinks = append(r.sinks, rs)
+	r.mu.Unlock()
+
+	go func() {
+		for {
+			select {
+			case evt := <-rs.ch:
+				sink.Handle(ctx, evt)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// RegisterInline adds a sink that is handed each event from Publish itself,
+// in the producer's goroutine. It suits sinks that return promptly and must
+// not miss or reorder events, such as the event stream and the event log.
+func (r *SinkRegistry) RegisterInline(ctx context.Context, name string, sink EventSink) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sinks = append(r.sinks, &registeredSink{name: name, inline: sink, ctx: ctx})
+}
+
+// Publish hands an event to the inline sinks and queues it for every other
+// sink without blocking, and returns the number of sinks that dropped it
+// because their queue was full.
+func (r *SinkRegistry) Publish(evt Event) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	dropped := 0
+	for _, rs := range r.sinks {
+		if rs.inline != nil {
+			rs.inline.Handle(rs.ctx, evt)
+			continue
+		}
+		select {
+		case rs.ch <- evt:
+		default:
+			log.Printf("[sink] %s is falling behind, dropped '%s'", rs.name, evt.Type)
+			dropped++
+		}
+	}
+	return dropped
+}
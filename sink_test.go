@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// chanSink forwards events to a channel, blocking while it's full.
+type chanSink chan Event
+
+func (c chanSink) Handle(ctx context.Context, evt Event) {
+	select {
+	case c <- evt:
+	case <-ctx.Done():
+	}
+}
+
+func TestSinkRegistry(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var r SinkRegistry
+	fast := make(chanSink, 2*sinkBuffer)
+	stuck := make(chanSink)
+	r.Register(ctx, "fast", fast)
+	r.Register(ctx, "stuck", stuck)
+
+	// waits until a sink has taken every queued event
+	drained := func(rs *registeredSink) {
+		for len(rs.ch) > 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// the stuck sink holds the first event in Handle, then queues
+	// sinkBuffer more and drops the rest
+	r.Publish(Event{GameID: 0, Type: "test"})
+	drained(r.sinks[1])
+	dropped := 0
+	for i := 1; i < sinkBuffer+10; i++ {
+		dropped += r.Publish(Event{GameID: i, Type: "test"})
+		drained(r.sinks[0])
+	}
+	if dropped != 9 {
+		t.Errorf("dropped %d events, want 9", dropped)
+	}
+
+	// every event reaches the fast sink, in order
+	for i := 0; i < sinkBuffer+10; i++ {
+		select {
+		case evt := <-fast:
+			if evt.GameID != i {
+				t.Fatalf("event %d is %d", i, evt.GameID)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("fast sink got %d events", i)
+		}
+	}
+}
+
+func TestSinkRegistryInline(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var r SinkRegistry
+	inline := make(chanSink, 2*sinkBuffer)
+	r.RegisterInline(ctx, "inline", inline)
+
+	// an inline sink has every event by the time Publish returns, however
+	// many there are
+	for i := 0; i < sinkBuffer+10; i++ {
+		if dropped := r.Publish(Event{GameID: i, Type: "test"}); dropped != 0 {
+			t.Fatalf("dropped event %d", i)
+		}
+		if len(inline) != i+1 {
+			t.Fatalf("inline sink has %d events after %d published", len(inline), i+1)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statsdPacketSize keeps batched packets under a typical Ethernet MTU.
+const statsdPacketSize = 1432
+
+// StatsD sends metrics to a StatsD server over UDP. Metrics are batched into
+// newline-separated packets which are flushed when full or once a second.
+// With DogStatsD set, tags are sent in the DogStatsD "|#key:value" form;
+// otherwise tag values are appended to the metric name.
+type StatsD struct {
+	Prefix    string
+	DogStatsD bool
+
+	conn net.Conn
+	mu   sync.Mutex
+	buf  bytes.Buffer
+}
+
+// NewStatsD connects to the StatsD server at addr and flushes batched
+// metrics until the context is cancelled.
+func NewStatsD(ctx context.Context, addr string) (*StatsD, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &StatsD{
+		Prefix: "mcspeedrun.",
+		conn:   conn,
+	}
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.Flush()
+			case <-ctx.Done():
+				s.Flush()
+				conn.Close()
+				return
+			}
+		}
+	}()
+	return s, nil
+}
+
+func (s *StatsD) Count(name string, value int64, tags ...Tag) {
+	s.send(name, fmt.Sprintf("%d|c", value), tags)
+}
+
+func (s *StatsD) Gauge(name string, value float64, tags ...Tag) {
+	s.send(name, fmt.Sprintf("%g|g", value), tags)
+}
+
+func (s *StatsD) Timing(name string, value time.Duration, tags ...Tag) {
+	s.send(name, fmt.Sprintf("%d|ms", value.Milliseconds()), tags)
+}
+
+// Flush sends any batched metrics.
+func (s *StatsD) Flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flush()
+}
+
+// flush sends the batched metrics. The caller must hold mu.
+func (s *StatsD) flush() {
+	if s.buf.Len() == 0 {
+		return
+	}
+	_, err := s.conn.Write(s.buf.Bytes())
+	if err != nil {
+		log.Printf("[statsd] error sending metrics: %s", err)
+	}
+	s.buf.Reset()
+}
+
+// send formats a metric line and adds it to the batch.
+func (s *StatsD) send(name string, value string, tags []Tag) {
+	var line strings.Builder
+	line.WriteString(s.Prefix)
+	line.WriteString(name)
+	if !s.DogStatsD {
+		for _, tag := range tags {
+			line.WriteString(".")
+			line.WriteString(tag.Value)
+		}
+	}
+	line.WriteString(":")
+	line.WriteString(value)
+	if s.DogStatsD && len(tags) > 0 {
+		line.WriteString("|#")
+		for i, tag := range tags {
+			if i > 0 {
+				line.WriteString(",")
+			}
+			line.WriteString(tag.Key + ":" + tag.Value)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.buf.Len()+line.Len()+1 > statsdPacketSize {
+		s.flush()
+	}
+	if s.buf.Len() > 0 {
+		s.buf.WriteByte('\n')
+	}
+	s.buf.WriteString(line.String())
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsD(t *testing.T) {
+	tests := []struct {
+		name      string
+		dogstatsd bool
+		want      string
+	}{
+		{"statsd", false, "mcspeedrun.events.nether:1|c\nmcspeedrun.ready:2|g\nmcspeedrun.split.end:90500|ms"},
+		{"dogstatsd", true, "mcspeedrun.events:1|c|#type:nether\nmcspeedrun.ready:2|g\nmcspeedrun.split:90500|ms|#split:end"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pc.Close()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			s, err := NewStatsD(ctx, pc.LocalAddr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.DogStatsD = tt.dogstatsd
+
+			s.Count("events", 1, Tag{"type", "nether"})
+			s.Gauge("ready", 2)
+			s.Timing("split", 90500*time.Millisecond, Tag{"split", "end"})
+			s.Flush()
+
+			buf := make([]byte, statsdPacketSize)
+			pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, _, err := pc.ReadFrom(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := string(buf[:n]); got != tt.want {
+				t.Errorf("sent %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStatsDBatch(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, err := NewStatsD(ctx, pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const metrics = 200
+	for i := 0; i < metrics; i++ {
+		s.Count("events", 1, Tag{"type", "nether"})
+	}
+	s.Flush()
+
+	lines := 0
+	buf := make([]byte, 2*statsdPacketSize)
+	for lines < metrics {
+		pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("received %d of %d metrics: %s", lines, metrics, err)
+		}
+		if n > statsdPacketSize {
+			t.Errorf("packet of %d bytes, want at most %d", n, statsdPacketSize)
+		}
+		lines += strings.Count(string(buf[:n]), "\n") + 1
+	}
+}
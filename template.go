@@ -0,0 +1,85 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/docker/docker/api/types"
+)
+
+// CheckTemplate checks that dir holds a Minecraft world.
+func CheckTemplate(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("world template %s is not a directory", dir)
+	}
+	_, err = os.Stat(filepath.Join(dir, "level.dat"))
+	if err != nil {
+		return fmt.Errorf("world template %s has no level.dat", dir)
+	}
+	return nil
+}
+
+// copyTemplate copies the world template into a created container, as the
+// world directory Level under DataDir, owned by the container's user.
+func (g *Game) copyTemplate(ctx context.Context, id string) error {
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(tarDir(w, g.Template, g.Level))
+	}()
+	err := g.Client.CopyToContainer(ctx, id, g.DataDir, r, types.CopyToContainerOptions{
+		CopyUIDGID: true,
+	})
+	r.Close()
+	return err
+}
+
+// tarDir writes the contents of dir to w as a tar archive, under the
+// directory name.
+func tarDir(w io.Writer, dir string, name string) error {
+	tw := tar.NewWriter(w)
+	err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = path.Join(name, filepath.ToSlash(rel))
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		err = tw.WriteHeader(hdr)
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeFiles creates files, relative to dir, with their contents.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(path, []byte(data), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCheckTemplate(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"world/level.dat":  "level",
+		"empty/readme.txt": "not a world",
+		"file":             "not a directory",
+	})
+	tests := []struct {
+		dir string
+		ok  bool
+	}{
+		{"world", true},
+		{"empty", false},
+		{"file", false},
+		{"missing", false},
+	}
+	for _, tt := range tests {
+		err := CheckTemplate(filepath.Join(dir, tt.dir))
+		if (err == nil) != tt.ok {
+			t.Errorf("CheckTemplate(%s) = %v, want ok %t", tt.dir, err, tt.ok)
+		}
+	}
+}
+
+func TestTarDir(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"level.dat":        "level",
+		"region/r.0.0.mca": "region",
+	}
+	writeFiles(t, dir, files)
+	err := os.Symlink("level.dat", filepath.Join(dir, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	err = tarDir(&buf, dir, "world_0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(tr)
+		got[hdr.Name] = string(data)
+	}
+	// symlinks are skipped
+	want := map[string]string{
+		"world_0/":                 "",
+		"world_0/level.dat":        "level",
+		"world_0/region/":          "",
+		"world_0/region/r.0.0.mca": "region",
+	}
+	if len(got) != len(want) {
+		t.Errorf("archive has %q, want %q", got, want)
+	}
+	for name, data := range want {
+		if got[name] != data {
+			t.Errorf("%s is %q, want %q", name, got[name], data)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// webhookTimeout bounds each webhook request.
+const webhookTimeout = 10 * time.Second
+
+// Webhook posts a chat message to a Discord or Slack incoming webhook for
+// every split and finished run, e.g. "Nether: 1m23.456s (attempt #5)".
+// The attempt number is the one the timer event was published with.
+type Webhook struct {
+	URL string
+
+	client http.Client
+}
+
+// NewWebhook returns a sink posting to the webhook at url.
+func NewWebhook(url string) *Webhook {
+	return &Webhook{
+		URL:    url,
+		client: http.Client{Timeout: webhookTimeout},
+	}
+}
+
+func (w *Webhook) Handle(ctx context.Context, evt Event) {
+	var name string
+	switch evt.Type {
+	case "timer.split":
+		name = timerSplit(evt.Payload)
+	case "timer.finish":
+		name = "Finished"
+	default:
+		return
+	}
+	elapsed, ok := timerElapsed(evt.Payload)
+	if !ok {
+		return
+	}
+	text := fmt.Sprintf("%s: %s (attempt #%d)", name, elapsed, evt.Attempt)
+
+	err := w.post(ctx, text)
+	if err != nil {
+		log.Printf("[webhook] error posting %q: %s", text, err)
+	}
+}
+
+// post sends a message. Discord reads "content" and Slack reads "text".
+func (w *Webhook) post(ctx context.Context, text string) error {
+	body, err := json.Marshal(map[string]string{
+		"content": text,
+		"text":    text,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// timerSplit parses the split name from a timer.split event's payload, e.g.
+// "time=95500 split=End Portal".
+func timerSplit(payload string) string {
+	i := strings.Index(payload, " split=")
+	if i < 0 {
+		return "Split"
+	}
+	return payload[i+len(" split="):]
+}
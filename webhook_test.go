@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWebhook(t *testing.T) {
+	posted := make(chan map[string]string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil || r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("%s with %s: %v", r.Method, r.Header.Get("Content-Type"), err)
+		}
+		posted <- body
+	}))
+	defer srv.Close()
+
+	w := NewWebhook(srv.URL)
+	for _, evt := range []Event{
+		{Type: "timer.start", Payload: "time=0", Attempt: 5},
+		{Type: "timer.split", Payload: "time=83456 split=End Portal", Attempt: 5},
+		{Type: "nether", Payload: "alice has made the advancement [We Need to Go Deeper]"},
+		{Type: "timer.finish", Payload: "time=754321", Attempt: 5},
+	} {
+		w.Handle(context.Background(), evt)
+	}
+	close(posted)
+
+	want := []string{
+		"End Portal: 1m23.456s (attempt #5)",
+		"Finished: 12m34.321s (attempt #5)",
+	}
+	var got []string
+	for body := range posted {
+		if body["content"] != body["text"] {
+			t.Errorf("content %q and text %q differ", body["content"], body["text"])
+		}
+		got = append(got, body["content"])
+	}
+	if len(got) != len(want) {
+		t.Fatalf("posted %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("post %d is %q, want %q", i, got[i], want[i])
+		}
+	}
+}